@@ -0,0 +1,274 @@
+package blobs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"math"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxCommittedBlocks is the most blocks the service allows a block blob to
+	// have committed
+	MaxCommittedBlocks = 50000
+	// MaxBlockSize is the largest block the service accepts
+	MaxBlockSize = 4000 << 20
+	// DefaultMergeThreshold is the default StageOptions MergeThreshold
+	DefaultMergeThreshold = 64
+)
+
+// ErrTooManyBlocks is returned by StageChanges, before anything is staged, if
+// the block list would exceed StageOptions MaxBlocks. The blob should be
+// written in a single put instead.
+var ErrTooManyBlocks = errors.New("the block list would exceed the committed block limit")
+
+// StageOptions control how StageChanges divides the data into blocks
+type StageOptions struct {
+	BlockSize int // The most bytes staged in each new block
+	// MergeThreshold is the number of trailing committed blocks smaller than
+	// BlockSize, as are left by small appends, past which they are merged with
+	// the appended data and staged again. Zero means DefaultMergeThreshold.
+	MergeThreshold int
+	// MaxBlocks is the most blocks the list may have. Zero means
+	// MaxCommittedBlocks.
+	MaxBlocks int
+}
+
+// Block is a committed block of a block blob
+type Block struct {
+	ID   string // The base64 encoded block id
+	Size int64
+}
+
+// CommitOptions are the conditions, and the blob index tags, applied when a
+// block list is committed
+type CommitOptions struct {
+	IfMatch     string            // The commit fails with a 412 unless the blob ETag matches
+	IfNoneMatch string            // The commit fails with a 409 if the blob ETag matches, "*" matches any blob
+	Tags        map[string]string // Replaces the blob index tags, in the same operation as the content
+	// ContentMD5, if set, is stored as the MD5 of the committed content, see
+	// ContentMD5Key. PutContent sets it from the data.
+	ContentMD5 []byte
+}
+
+// conditional returns true if the write is conditional on the existing blob
+func (o CommitOptions) conditional() bool {
+	return o.IfMatch != "" || o.IfNoneMatch != ""
+}
+
+func (o CommitOptions) accessConditions() *azStorageBlob.BlobAccessConditions {
+	if o.IfMatch == "" && o.IfNoneMatch == "" {
+		return nil
+	}
+	conditions := &azStorageBlob.ModifiedAccessConditions{}
+	if o.IfMatch != "" {
+		conditions.IfMatch = &o.IfMatch
+	}
+	if o.IfNoneMatch != "" {
+		conditions.IfNoneMatch = &o.IfNoneMatch
+	}
+	return &azStorageBlob.BlobAccessConditions{ModifiedAccessConditions: conditions}
+}
+
+// BlockWriter is implemented by stores which can write a blob as a list of
+// separately staged blocks. For the azblob.Storer, NewBlockWriter uses the
+// azure sdk container client.
+type BlockWriter interface {
+	StageBlock(ctx context.Context, blobPath string, blockID string, data []byte) error
+	CommitBlockList(
+		ctx context.Context, blobPath string, blockIDs []string, opts CommitOptions,
+	) (*azblob.WriteResponse, error)
+	// BlockList returns the committed blocks, a blob written in a single put
+	// has none.
+	BlockList(ctx context.Context, blobPath string) ([]Block, error)
+}
+
+// NewBlockWriter returns the BlockWriter for the store. Stores which do not
+// implement BlockWriter, but which provide the azure sdk container client, are
+// adapted, as are those decorated by RetryStore. Otherwise false is returned.
+func NewBlockWriter(store any) (BlockWriter, bool) {
+	switch s := store.(type) {
+	case retrier:
+		w, ok := NewBlockWriter(s.decorated())
+		if !ok {
+			return nil, false
+		}
+		return &retryBlockWriter{w: w, opts: s.retryOptions()}, true
+	case BlockWriter:
+		return s, true
+	case containerClientProvider:
+		return &sdkBlockWriter{client: s.GetContainerClient()}, true
+	default:
+		return nil, false
+	}
+}
+
+// NewBlockID returns a new, unique, block id. All the ids generated are the
+// same length, as is required for the blocks of a single blob.
+func NewBlockID() string {
+	id := uuid.New()
+	return base64.StdEncoding.EncodeToString(id[:])
+}
+
+type sdkBlockWriter struct {
+	client *azStorageBlob.ContainerClient
+}
+
+func (w *sdkBlockWriter) blockBlobClient(blobPath string) (*azStorageBlob.BlockBlobClient, error) {
+	if w.client == nil {
+		return nil, errors.New("no container client available for block writer")
+	}
+	blobClient, err := w.client.NewBlockBlobClient(blobPath)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+	return blobClient, nil
+}
+
+func (w *sdkBlockWriter) StageBlock(ctx context.Context, blobPath string, blockID string, data []byte) error {
+	blobClient, err := w.blockBlobClient(blobPath)
+	if err != nil {
+		return err
+	}
+	// The service checks the transactional hash before the block is staged
+	_, err = blobClient.StageBlock(ctx, blockID, azblob.NewBytesReaderCloser(data),
+		&azStorageBlob.BlockBlobStageBlockOptions{TransactionalContentCRC64: ContentCRC64(data)})
+	if err != nil {
+		return azblob.ErrorFromError(err)
+	}
+	return nil
+}
+
+func (w *sdkBlockWriter) CommitBlockList(
+	ctx context.Context, blobPath string, blockIDs []string, opts CommitOptions,
+) (*azblob.WriteResponse, error) {
+	blobClient, err := w.blockBlobClient(blobPath)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &azStorageBlob.BlockBlobCommitBlockListOptions{
+		BlobTagsMap:          opts.Tags,
+		BlobAccessConditions: opts.accessConditions(),
+	}
+	if opts.ContentMD5 != nil {
+		options.Metadata = map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(opts.ContentMD5)}
+		options.BlobHTTPHeaders = &azStorageBlob.BlobHTTPHeaders{BlobContentMD5: opts.ContentMD5}
+	}
+	resp, err := blobClient.CommitBlockList(ctx, blockIDs, options)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+
+	wr := &azblob.WriteResponse{
+		ETag:         resp.ETag,
+		LastModified: resp.LastModified,
+	}
+	if resp.RawResponse != nil {
+		wr.StatusCode = resp.RawResponse.StatusCode
+		wr.Status = resp.RawResponse.Status
+	}
+	return wr, nil
+}
+
+func (w *sdkBlockWriter) BlockList(ctx context.Context, blobPath string) ([]Block, error) {
+	blobClient, err := w.blockBlobClient(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := blobClient.GetBlockList(ctx, azStorageBlob.BlockListTypeCommitted, nil)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+	blocks := make([]Block, 0, len(resp.CommittedBlocks))
+	for _, b := range resp.CommittedBlocks {
+		if b == nil || b.Name == nil || b.Size == nil {
+			continue
+		}
+		blocks = append(blocks, Block{ID: *b.Name, Size: *b.Size})
+	}
+	return blocks, nil
+}
+
+// StageChanges stages the blocks needed to commit data, given the blocks
+// currently committed for the blob, re-using those which unchanged reports
+// hold the same bytes. The returned list, once committed, describes data
+// exactly. ErrTooManyBlocks is returned if it would exceed opts.MaxBlocks.
+func StageChanges(
+	ctx context.Context, w BlockWriter, blobPath string,
+	committed []Block, unchanged func(i int, content []byte) bool,
+	data []byte, opts StageOptions,
+) ([]Block, error) {
+	blockSize := int64(opts.BlockSize)
+	mergeThreshold := opts.MergeThreshold
+	if mergeThreshold == 0 {
+		mergeThreshold = DefaultMergeThreshold
+	}
+	maxBlocks := opts.MaxBlocks
+	if maxBlocks == 0 {
+		maxBlocks = MaxCommittedBlocks
+	}
+
+	var committedSize int64
+	idLen := len(NewBlockID())
+	for _, b := range committed {
+		committedSize += b.Size
+		if len(b.ID) != idLen {
+			committedSize = math.MaxInt64
+			break
+		}
+	}
+	if committedSize > int64(len(data)) {
+		committed = nil
+	}
+
+	small := 0
+	for small < len(committed) && committed[len(committed)-1-small].Size < blockSize {
+		small++
+	}
+	if small > mergeThreshold {
+		committed = committed[:len(committed)-small]
+	}
+
+	var reusedSize int64
+	for _, b := range committed {
+		reusedSize += b.Size
+	}
+	appended := (int64(len(data)) - reusedSize + blockSize - 1) / blockSize
+	if int64(len(committed))+appended > int64(maxBlocks) {
+		return nil, ErrTooManyBlocks
+	}
+
+	stage := func(content []byte) (Block, error) {
+		b := Block{ID: NewBlockID(), Size: int64(len(content))}
+		return b, w.StageBlock(ctx, blobPath, b.ID, content)
+	}
+
+	blocks := make([]Block, 0, len(committed)+int(appended))
+	var offset int64
+	for i, b := range committed {
+		end := offset + b.Size
+		if !unchanged(i, data[offset:end]) {
+			var err error
+			if b, err = stage(data[offset:end]); err != nil {
+				return nil, err
+			}
+		}
+		blocks = append(blocks, b)
+		offset = end
+	}
+	for offset < int64(len(data)) {
+		end := min(offset+blockSize, int64(len(data)))
+		b, err := stage(data[offset:end])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+		offset = end
+	}
+	return blocks, nil
+}
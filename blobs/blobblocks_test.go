@@ -0,0 +1,70 @@
+package blobs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stagingWriter records the bytes staged
+type stagingWriter struct {
+	staged int
+}
+
+func (w *stagingWriter) StageBlock(ctx context.Context, blobPath string, blockID string, data []byte) error {
+	w.staged += len(data)
+	return nil
+}
+
+func (w *stagingWriter) CommitBlockList(
+	ctx context.Context, blobPath string, blockIDs []string, opts CommitOptions,
+) (*azblob.WriteResponse, error) {
+	return &azblob.WriteResponse{}, nil
+}
+
+func (w *stagingWriter) BlockList(ctx context.Context, blobPath string) ([]Block, error) {
+	return nil, nil
+}
+
+func TestStageChanges(t *testing.T) {
+	unchanged := func(i int, content []byte) bool { return true }
+	blocksSize := func(blocks []Block) (size int64) {
+		for _, b := range blocks {
+			size += b.Size
+		}
+		return size
+	}
+	opts := StageOptions{BlockSize: 16, MergeThreshold: 4, MaxBlocks: 12}
+
+	// each small append adds a block until the threshold is passed
+	w := &stagingWriter{}
+	var blocks []Block
+	data := make([]byte, 32)
+	for range 5 {
+		data = append(data, 1, 2, 3)
+		var err error
+		blocks, err = StageChanges(t.Context(), w, "blob", blocks, unchanged, data, opts)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), blocksSize(blocks))
+	}
+	assert.Len(t, blocks, 7)
+	assert.Equal(t, 32+5*3, w.staged)
+
+	// then the small blocks are merged with the appended data
+	data = append(data, 4)
+	blocks, err := StageChanges(t.Context(), w, "blob", blocks, unchanged, data, opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), blocksSize(blocks))
+	assert.Equal(t, []int64{16, 16, 16}, []int64{blocks[0].Size, blocks[1].Size, blocks[2].Size})
+	assert.Len(t, blocks, 3)
+	assert.Equal(t, 32+5*3+16, w.staged)
+
+	// nothing is staged if the list would be too long
+	w = &stagingWriter{}
+	_, err = StageChanges(t.Context(), w, "blob", nil, unchanged, make([]byte, 12*16+1), opts)
+	assert.ErrorIs(t, err, ErrTooManyBlocks)
+	assert.Equal(t, 0, w.staged)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
 const (
@@ -28,23 +29,20 @@ func AsStorageError(err error) (azStorageBlob.StorageError, bool) {
 	return *serr, true
 }
 
+// AsResponseError returns the azure response error in the chain of err, or
+// the one which is the cause of an InternalError in the chain.
 func AsResponseError(err error) (azcore.ResponseError, bool) {
-	var ok bool
 	var rerr *azcore.ResponseError
-
-	//nolint
-	if rerr, ok = err.(*azcore.ResponseError); ok {
+	if errors.As(err, &rerr) {
 		return *rerr, true
 	}
 
 	// check for an InternalError that has ResponseError as its cause
-	rerr = &azcore.ResponseError{}
-
-	//nolint
-	ierr, ok := err.(*azStorageBlob.InternalError)
-	if ierr == nil || !ok {
+	var ierr *azStorageBlob.InternalError
+	if !errors.As(err, &ierr) || ierr == nil {
 		return azcore.ResponseError{}, false
 	}
+	rerr = &azcore.ResponseError{}
 	if !ierr.As(&rerr) {
 		return azcore.ResponseError{}, false
 	}
@@ -86,6 +84,19 @@ func IsBlobNotFound(err error) bool {
 	return true
 }
 
+// IsConditionNotMet returns true if a conditional write failed because the
+// blob was changed, or created, by another writer since it was read.
+func IsConditionNotMet(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, storage.ErrContentOC) || errors.Is(err, storage.ErrExistsOC) {
+		return true
+	}
+	statusCode, ok := errorStatus(err)
+	return ok && (statusCode == http.StatusPreconditionFailed || statusCode == http.StatusConflict)
+}
+
 // IsRateLimiting detects if the error is HTTP Status 429 Too Many Requests
 // The recomended wait time is returned if it is available. If the returned wait
 // time is zero, the caller should apply an appropriate default backoff.
@@ -93,36 +104,41 @@ func IsRateLimiting(err error) (time.Duration, bool) {
 	if err == nil {
 		return 0, false
 	}
-	rerr, ok := AsResponseError(err)
-	if !ok {
-		return 0, false
-	}
-	if rerr.StatusCode != http.StatusTooManyRequests {
+	if statusCode, ok := errorStatus(err); !ok || statusCode != http.StatusTooManyRequests {
 		return 0, false
 	}
 
 	// It is a 429, check if there is a Retry-After header and return the indicated time if possible.
+	rerr, ok := AsResponseError(err)
+	if !ok {
+		return 0, true
+	}
+	return retryAfter(rerr), true
+}
 
-	// Retry-After header is optional, if it is not present, the caller should still see it as a 429
+// retryAfter returns the wait time from the Retry-After header of the
+// response, or zero if there is none or it can't be parsed.
+func retryAfter(rerr azcore.ResponseError) time.Duration {
+	// Retry-After header is optional
 	if rerr.RawResponse == nil {
-		return 0, true
+		return 0
 	}
 	retryAfter := rerr.RawResponse.Header.Get("Retry-After")
 	if retryAfter == "" {
-		return 0, true
+		return 0
 	}
 
 	// Try to parse Retry-After as an integer (seconds)
 	if seconds, err := strconv.Atoi(retryAfter); err == nil {
-		return time.Duration(seconds) * time.Second, true
+		return time.Duration(seconds) * time.Second
 	}
 
 	// Try to parse Retry-After as a date
 	if retryTime, err := http.ParseTime(retryAfter); err == nil {
 		retryTime = retryTime.In(time.UTC) // crucial, as Until does not work with different locations
-		return time.Until(retryTime), true
+		return time.Until(retryTime)
 	}
 
-	// couldn't parse the time, but it is definitely a 429. the caller should apply an appropriate default backoff.
-	return 0, true
+	// couldn't parse the time, the caller should apply an appropriate default backoff.
+	return 0
 }
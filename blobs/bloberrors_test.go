@@ -2,11 +2,13 @@ package blobs
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/forestrie/go-merklelog/massifs/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -90,6 +92,19 @@ func TestIsRateLimiting(t *testing.T) {
 			expectedWait:   0,
 			expectedResult: true,
 		},
+		{
+			name: "wrapped 429 with Retry-After header in seconds",
+			err: fmt.Errorf("list failed: %w", &azcore.ResponseError{
+				StatusCode: http.StatusTooManyRequests,
+				RawResponse: &http.Response{
+					Header: http.Header{
+						"Retry-After": []string{"10"},
+					},
+				},
+			}),
+			expectedWait:   10 * time.Second,
+			expectedResult: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -111,3 +126,13 @@ func TestIsRateLimiting(t *testing.T) {
 		})
 	}
 }
+
+func TestIsConditionNotMet(t *testing.T) {
+	assert.False(t, IsConditionNotMet(nil))
+	assert.False(t, IsConditionNotMet(errors.New("some error")))
+	assert.False(t, IsConditionNotMet(&azcore.ResponseError{StatusCode: http.StatusNotFound}))
+	assert.True(t, IsConditionNotMet(&azcore.ResponseError{StatusCode: http.StatusPreconditionFailed}))
+	assert.True(t, IsConditionNotMet(fmt.Errorf("put: %w", &azcore.ResponseError{StatusCode: http.StatusConflict})))
+	assert.True(t, IsConditionNotMet(fmt.Errorf("put: %w", storage.ErrContentOC)))
+	assert.True(t, IsConditionNotMet(storage.ErrExistsOC))
+}
@@ -0,0 +1,119 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// FailoverReader reads from the Primary store, and from the Secondary store if
+// the primary is not available, as reported by IsNotAvailable. The secondary
+// is typically the read-access geo-redundant (RA-GRS) endpoint of the storage
+// account, which is replicated asynchronously and so may be behind the
+// primary.
+//
+// The LogBlobContext methods, and the blob listing functions, set the Stale
+// flag on the contexts they read from the secondary.
+type FailoverReader struct {
+	Primary   Reader
+	Secondary Reader
+}
+
+func NewFailoverReader(primary, secondary Reader) *FailoverReader {
+	return &FailoverReader{Primary: primary, Secondary: secondary}
+}
+
+func (r *FailoverReader) Reader(
+	ctx context.Context,
+	identity string,
+	opts ...azblob.Option,
+) (*azblob.ReaderResponse, error) {
+	rr, _, err := failover(r, func(store Reader) (*azblob.ReaderResponse, error) {
+		return store.Reader(ctx, identity, opts...)
+	})
+	return rr, err
+}
+
+func (r *FailoverReader) FilteredList(
+	ctx context.Context, tagsFilter string, opts ...azblob.Option,
+) (*azblob.FilterResponse, error) {
+	fr, _, err := failover(r, func(store Reader) (*azblob.FilterResponse, error) {
+		return store.FilteredList(ctx, tagsFilter, opts...)
+	})
+	return fr, err
+}
+
+func (r *FailoverReader) List(ctx context.Context, opts ...azblob.Option) (*azblob.ListerResponse, error) {
+	lr, _, err := failover(r, func(store Reader) (*azblob.ListerResponse, error) {
+		return store.List(ctx, opts...)
+	})
+	return lr, err
+}
+
+// IsNotAvailable returns true if the error means the store could not serve
+// the request, rather than that the request failed: storage.ErrNotAvailable,
+// the statuses which are translated to it, other server errors, and failures
+// of the transport.
+func IsNotAvailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, storage.ErrNotAvailable) {
+		return true
+	}
+	if statusCode, ok := errorStatus(err); ok {
+		return statusCode == http.StatusForbidden ||
+			statusCode == http.StatusTooManyRequests ||
+			statusCode >= http.StatusInternalServerError
+	}
+	return IsRetryable(err)
+}
+
+// failover calls read with the store. If the store is a FailoverReader, read
+// is called with its primary, and again with its secondary if the primary is
+// not available. stale is true if the result is from the secondary. If the
+// secondary also fails, the error from the primary is returned, as the
+// secondary may simply not have the blob yet. A RetryStore decorating a
+// FailoverReader is applied to each of its stores.
+func failover[T any](store Reader, read func(store Reader) (T, error)) (v T, stale bool, err error) {
+	if rs, ok := store.(retrier); ok {
+		if fr, ok := rs.decorated().(*FailoverReader); ok {
+			opts := rs.retryOptions()
+			store = &FailoverReader{Primary: decorate(fr.Primary, opts), Secondary: decorate(fr.Secondary, opts)}
+		}
+	}
+	fr, ok := store.(*FailoverReader)
+	if !ok {
+		v, err = read(store)
+		return v, false, err
+	}
+	v, err = read(fr.Primary)
+	if err == nil || !IsNotAvailable(err) || fr.Secondary == nil {
+		return v, false, err
+	}
+	sv, serr := read(fr.Secondary)
+	if serr != nil {
+		return v, false, err
+	}
+	return sv, true, nil
+}
+
+// readResult is the result of the blob read functions
+type readResult struct {
+	rr   *azblob.ReaderResponse
+	data []byte
+}
+
+// failoverRead is failover for the blob read functions
+func failoverRead(
+	store Reader, read func(store Reader) (*azblob.ReaderResponse, []byte, error),
+) (*azblob.ReaderResponse, []byte, bool, error) {
+	res, stale, err := failover(store, func(store Reader) (readResult, error) {
+		rr, data, err := read(store)
+		return readResult{rr: rr, data: data}, err
+	})
+	return res.rr, res.data, stale, err
+}
@@ -0,0 +1,128 @@
+package blobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverReader_ReadData(t *testing.T) {
+	primary := &faultStore{}
+	primary.data = []byte("primary")
+	primary.etag = "etag-2"
+	secondary := &faultStore{}
+	secondary.data = []byte("second")
+	secondary.etag = "etag-1"
+	store := NewFailoverReader(primary, secondary)
+
+	bc := &LogBlobContext{BlobPath: "blob"}
+	primary.faults = []error{statusError(503, "ServerBusy")}
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.Equal(t, secondary.data, bc.Data)
+	assert.True(t, bc.Stale)
+
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.Equal(t, primary.data, bc.Data)
+	assert.False(t, bc.Stale)
+
+	primary.faults = []error{transportError()}
+	require.NoError(t, bc.ReadDataRange(t.Context(), 1, 3, store))
+	assert.Equal(t, []byte("eco"), bc.Data)
+	assert.True(t, bc.Stale)
+
+	// the secondary may not have the blob yet, the primary error is returned
+	primary.faults = []error{statusError(503, "ServerBusy")}
+	secondary.faults = []error{statusError(404, "BlobNotFound")}
+	err := bc.ReadData(t.Context(), store)
+	assert.Equal(t, statusError(503, "ServerBusy"), err)
+
+	// errors for the request itself do not fail over
+	calls := secondary.calls
+	primary.faults = []error{statusError(412, "ConditionNotMet")}
+	assert.Error(t, bc.ReadData(t.Context(), store))
+	assert.Equal(t, calls, secondary.calls)
+}
+
+func TestFailoverReader_retry(t *testing.T) {
+	primary := &faultStore{}
+	primary.data = []byte("primary")
+	primary.etag = "etag-2"
+	secondary := &faultStore{}
+	secondary.data = []byte("second")
+	secondary.etag = "etag-1"
+	store := NewRetryStore(NewFailoverReader(primary, secondary), RetryOptions{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+
+	// a transient failure of the primary is retried
+	bc := &LogBlobContext{BlobPath: "blob"}
+	primary.faults = []error{statusError(503, "ServerBusy")}
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.Equal(t, primary.data, bc.Data)
+	assert.False(t, bc.Stale)
+	assert.Equal(t, 0, secondary.calls)
+
+	// the secondary is read once the retries are exhausted, and is stale
+	primary.faults = []error{statusError(503, "ServerBusy"), statusError(503, "ServerBusy")}
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.Equal(t, secondary.data, bc.Data)
+	assert.True(t, bc.Stale)
+
+	primary.faults = []error{transportError(), transportError()}
+	require.NoError(t, bc.ReadDataRange(t.Context(), 1, 3, store))
+	assert.Equal(t, []byte("eco"), bc.Data)
+	assert.True(t, bc.Stale)
+
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.False(t, bc.Stale)
+}
+
+func TestFailoverReader_RefreshData(t *testing.T) {
+	primary := &faultStore{}
+	primary.data = make([]byte, 2*RefreshOverlap)
+	primary.etag = "etag-1"
+	secondary := &faultStore{}
+	secondary.mockRangeReader = primary.mockRangeReader
+	store := NewFailoverReader(primary, secondary)
+
+	bc := &LogBlobContext{BlobPath: "blob"}
+	require.NoError(t, bc.ReadData(t.Context(), store))
+	assert.False(t, bc.Stale)
+
+	primary.faults = []error{statusError(503, "ServerBusy")}
+	result, err := bc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshUnchanged, result)
+	assert.True(t, bc.Stale)
+
+	result, err = bc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshUnchanged, result)
+	assert.False(t, bc.Stale)
+}
+
+func TestFailoverReader_List(t *testing.T) {
+	primary := &faultStore{faults: []error{statusError(503, "ServerBusy")}}
+	store := NewFailoverReader(primary, newLastNBlobStore(2))
+
+	bc, count, err := LastPrefixedBlob(t.Context(), store, "prefix/path/")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), count)
+	assert.Equal(t, "blob-1", bc.BlobPath)
+	assert.True(t, bc.Stale)
+}
+
+func TestIsNotAvailable(t *testing.T) {
+	assert.True(t, IsNotAvailable(storage.ErrNotAvailable))
+	assert.True(t, IsNotAvailable(statusError(403, "AuthorizationFailure")))
+	assert.True(t, IsNotAvailable(statusError(429, "")))
+	assert.True(t, IsNotAvailable(statusError(500, "InternalError")))
+	assert.True(t, IsNotAvailable(statusError(503, "ServerBusy")))
+	assert.True(t, IsNotAvailable(transportError()))
+	assert.False(t, IsNotAvailable(nil))
+	assert.False(t, IsNotAvailable(statusError(404, "BlobNotFound")))
+	assert.False(t, IsNotAvailable(statusError(409, "BlobAlreadyExists")))
+	assert.False(t, IsNotAvailable(statusError(412, "ConditionNotMet")))
+	assert.False(t, IsNotAvailable(storage.ErrDoesNotExist))
+}
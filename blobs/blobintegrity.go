@@ -0,0 +1,197 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"strings"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+)
+
+// ContentMD5Key is the metadata key for the base64 encoded MD5 of the blob
+// content, it is written with every blob put by this package.
+const ContentMD5Key = "content_md5"
+
+// ErrContentIntegrity is returned when the content read does not match the
+// hash stored with the blob, or the hash sent with the response.
+var ErrContentIntegrity = errors.New("blob content does not match its content hash")
+
+// crc64Table is the polynomial used for the storage service x-ms-content-crc64
+var crc64Table = crc64.MakeTable(0x9A6C9329AC4BC9B5)
+
+// ContentMD5 returns the MD5 of the content, as sent in the Content-MD5
+// header, and as stored in the ContentMD5Key metadata.
+func ContentMD5(data []byte) []byte {
+	sum := md5.Sum(data)
+	return sum[:]
+}
+
+// ContentCRC64 returns the CRC64 of the content, as sent in the
+// x-ms-content-crc64 header.
+func ContentCRC64(data []byte) []byte {
+	return binary.LittleEndian.AppendUint64(nil, crc64.Checksum(data, crc64Table))
+}
+
+// WithContentMD5 stores the MD5 of the content in the blob metadata, so that
+// readers can check the content read is the content which was written.
+func WithContentMD5(data []byte) azblob.Option {
+	return azblob.WithMetadata(map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(ContentMD5(data))})
+}
+
+// metadataContentMD5 returns the MD5 stored in the metadata of the blob. The
+// service returns the metadata keys in canonical header form.
+func metadataContentMD5(metadata map[string]string) ([]byte, bool) {
+	for k, v := range metadata {
+		if !strings.EqualFold(k, ContentMD5Key) {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return nil, false
+		}
+		return sum, true
+	}
+	return nil, false
+}
+
+// verifyContent checks the content read against the MD5, or the CRC64, sent
+// with the response, or if there are neither, against the MD5 stored in the
+// metadata. Only the complete content can be checked, partial reads are not.
+func verifyContent(blobPath string, rr *azblob.ReaderResponse, data []byte) error {
+	if rr == nil || int64(len(data)) != rr.ContentLength {
+		return nil
+	}
+	wantMD5, wantCRC64 := rr.ContentMD5, rr.ContentCRC64
+	if len(wantMD5) == 0 && len(wantCRC64) == 0 {
+		wantMD5, _ = metadataContentMD5(rr.Metadata)
+	}
+	if len(wantMD5) > 0 && !bytes.Equal(ContentMD5(data), wantMD5) {
+		return fmt.Errorf("%w: %s md5 mismatch", ErrContentIntegrity, blobPath)
+	}
+	if len(wantCRC64) > 0 && !bytes.Equal(ContentCRC64(data), wantCRC64) {
+		return fmt.Errorf("%w: %s crc64 mismatch", ErrContentIntegrity, blobPath)
+	}
+	return nil
+}
+
+// verifyingReader checks the hashes sent with a response once all of the
+// content has been read. The error is returned in place of the final read.
+type verifyingReader struct {
+	io.ReadCloser
+	blobPath string
+	remain   int64
+	md5      hash.Hash
+	wantMD5  []byte
+	crc64    uint64
+	wantCRC  []byte
+}
+
+// newVerifyingReader returns body unchanged if there are no hashes to check
+func newVerifyingReader(body io.ReadCloser, blobPath string, length int64, wantMD5, wantCRC64 []byte) io.ReadCloser {
+	if len(wantMD5) == 0 && len(wantCRC64) == 0 {
+		return body
+	}
+	return &verifyingReader{
+		ReadCloser: body, blobPath: blobPath, remain: length,
+		md5: md5.New(), wantMD5: wantMD5, wantCRC: wantCRC64,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.remain > 0 {
+		r.md5.Write(p[:n])
+		r.crc64 = crc64.Update(r.crc64, crc64Table, p[:n])
+		r.remain -= int64(n)
+		if r.remain <= 0 {
+			if verr := r.verify(); verr != nil {
+				return n, verr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) verify() error {
+	if len(r.wantMD5) > 0 && !bytes.Equal(r.md5.Sum(nil), r.wantMD5) {
+		return fmt.Errorf("%w: %s md5 mismatch", ErrContentIntegrity, r.blobPath)
+	}
+	if len(r.wantCRC) > 0 && !bytes.Equal(binary.LittleEndian.AppendUint64(nil, r.crc64), r.wantCRC) {
+		return fmt.Errorf("%w: %s crc64 mismatch", ErrContentIntegrity, r.blobPath)
+	}
+	return nil
+}
+
+// PutContent writes the blob, with its MD5 stored in the metadata, and sent as
+// the transactional content hash where the store provides the azure sdk
+// container client.
+func PutContent(
+	ctx context.Context, store any, blobPath string, data []byte, opts CommitOptions,
+) (*azblob.WriteResponse, error) {
+	switch s := store.(type) {
+	case retrier:
+		return retryWrite(ctx, s.retryOptions(), opts.conditional(), func(ctx context.Context) (*azblob.WriteResponse, error) {
+			return PutContent(ctx, s.decorated(), blobPath, data, opts)
+		})
+	case containerClientProvider:
+		return sdkPutContent(ctx, s.GetContainerClient(), blobPath, data, opts)
+	case writer:
+		putOpts := []azblob.Option{WithContentMD5(data)}
+		if opts.Tags != nil {
+			putOpts = append(putOpts, azblob.WithTags(opts.Tags))
+		}
+		if opts.IfMatch != "" {
+			putOpts = append(putOpts, azblob.WithEtagMatch(opts.IfMatch))
+		}
+		if opts.IfNoneMatch != "" {
+			putOpts = append(putOpts, azblob.WithEtagNoneMatch(opts.IfNoneMatch))
+		}
+		return s.Put(ctx, blobPath, azblob.NewBytesReaderCloser(data), putOpts...)
+	default:
+		return nil, errors.New("the store does not support writes")
+	}
+}
+
+func sdkPutContent(
+	ctx context.Context, client *azStorageBlob.ContainerClient, blobPath string, data []byte, opts CommitOptions,
+) (*azblob.WriteResponse, error) {
+	if client == nil {
+		return nil, errors.New("no container client available for writer")
+	}
+	blobClient, err := client.NewBlockBlobClient(blobPath)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+	sum := ContentMD5(data)
+	options := &azStorageBlob.BlockBlobUploadOptions{
+		TagsMap:                 opts.Tags,
+		Metadata:                map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(sum)},
+		TransactionalContentMD5: sum,
+		HTTPHeaders:             &azStorageBlob.BlobHTTPHeaders{BlobContentMD5: sum},
+		BlobAccessConditions:    opts.accessConditions(),
+	}
+	resp, err := blobClient.Upload(ctx, azblob.NewBytesReaderCloser(data), options)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+
+	wr := &azblob.WriteResponse{
+		ETag:         resp.ETag,
+		LastModified: resp.LastModified,
+		Size:         int64(len(data)),
+	}
+	if resp.RawResponse != nil {
+		wr.StatusCode = resp.RawResponse.StatusCode
+		wr.Status = resp.RawResponse.Status
+	}
+	return wr, nil
+}
@@ -0,0 +1,107 @@
+package blobs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobRead_integrity(t *testing.T) {
+	data := []byte("massif content")
+	store := &mockBytesReader{data: data}
+
+	// the service returns the metadata keys in canonical header form
+	store.metadata = map[string]string{"Content_md5": base64.StdEncoding.EncodeToString(ContentMD5(data))}
+	_, got, err := BlobRead(t.Context(), "blob", store)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	store.metadata = map[string]string{"Content_md5": base64.StdEncoding.EncodeToString(ContentMD5([]byte("other")))}
+	_, _, err = BlobRead(t.Context(), "blob", store)
+	assert.ErrorIs(t, err, ErrContentIntegrity)
+	bc := &LogBlobContext{BlobPath: "blob"}
+	assert.ErrorIs(t, bc.ReadData(t.Context(), store), ErrContentIntegrity)
+
+	// partial reads can't be checked
+	_, got, err = BlobReadN(t.Context(), 6, "blob", store)
+	require.NoError(t, err)
+	assert.Equal(t, data[:6], got)
+	_, _, err = BlobReadN(t.Context(), len(data), "blob", store)
+	assert.ErrorIs(t, err, ErrContentIntegrity)
+
+	// the hash returned with the response is checked in preference to the
+	// metadata
+	store.contentMD5 = ContentMD5(data)
+	_, got, err = BlobRead(t.Context(), "blob", store)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	store.contentMD5 = ContentMD5([]byte("other"))
+	store.metadata = map[string]string{"Content_md5": base64.StdEncoding.EncodeToString(ContentMD5(data))}
+	_, _, err = BlobRead(t.Context(), "blob", store)
+	assert.ErrorIs(t, err, ErrContentIntegrity)
+
+	// blobs written without the hash are not checked
+	store.contentMD5 = nil
+	store.metadata = nil
+	_, _, err = BlobRead(t.Context(), "blob", store)
+	assert.NoError(t, err)
+}
+
+func TestBlobRead_noContentMD5(t *testing.T) {
+	data := []byte("massif content")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	blobClient, err := azStorageBlob.NewBlobClientWithNoCredential(server.URL+"/merklelogs/blob", nil)
+	require.NoError(t, err)
+
+	// a blob written without the metadata is read without further requests
+	store := &mockBytesReader{data: data, etag: "etag-1", blobClient: blobClient}
+	_, got, err := BlobRead(t.Context(), "blob", store)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Zero(t, requests)
+}
+
+func TestVerifyingReader(t *testing.T) {
+	data := []byte("range content")
+	read := func(wantMD5, wantCRC64 []byte) ([]byte, error) {
+		body := newVerifyingReader(io.NopCloser(bytes.NewReader(data)), "blob", int64(len(data)), wantMD5, wantCRC64)
+		return readResponse(&azblob.ReaderResponse{Reader: body}, int64(len(data)))
+	}
+
+	got, err := read(ContentMD5(data), nil)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	_, err = read(nil, ContentCRC64(data))
+	require.NoError(t, err)
+	_, err = read(nil, nil)
+	require.NoError(t, err)
+
+	_, err = read(ContentMD5([]byte("other")), nil)
+	assert.ErrorIs(t, err, ErrContentIntegrity)
+	_, err = read(ContentMD5(data), ContentCRC64([]byte("other")))
+	assert.ErrorIs(t, err, ErrContentIntegrity)
+}
+
+func TestPutContent(t *testing.T) {
+	fake := &faultStore{faults: []error{statusError(503, "ServerBusy")}}
+	data := []byte("checkpoint")
+	_, err := PutContent(t.Context(), NewRetryStore(fake, testRetryOptions()), "blob", data, CommitOptions{IfNoneMatch: "*"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{data, data}, fake.puts)
+
+	_, err = PutContent(t.Context(), &mockBytesReader{}, "blob", data, CommitOptions{})
+	assert.Error(t, err)
+}
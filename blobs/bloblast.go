@@ -23,10 +23,13 @@ func LastPrefixedBlob(
 
 	var marker azblob.ListMarker
 	for {
-		r, err := store.List(ctx, append(opts, azblob.WithListMarker(marker))...)
+		r, secondary, err := failover(store, func(store Reader) (*azblob.ListerResponse, error) {
+			return store.List(ctx, append(opts, azblob.WithListMarker(marker))...)
+		})
 		if err != nil {
 			return bc, foundCount, err
 		}
+		bc.Stale = bc.Stale || secondary
 		if len(r.Items) == 0 {
 			return bc, foundCount, nil
 		}
@@ -63,10 +66,13 @@ func FirstPrefixedBlob(
 		azblob.WithListMaxResults(1),
 	}, opts...)
 
-	r, err := store.List(ctx, opts...)
+	r, secondary, err := failover(store, func(store Reader) (*azblob.ListerResponse, error) {
+		return store.List(ctx, opts...)
+	})
 	if err != nil {
 		return bc, err
 	}
+	bc.Stale = secondary
 	if len(r.Items) == 0 {
 		return bc, ErrBlobNotFound
 	}
@@ -102,7 +108,9 @@ func PrefixedBlobLastN(
 
 	var marker azblob.ListMarker
 	for {
-		r, err := store.List(ctx, append(opts, azblob.WithListMarker(marker))...)
+		r, secondary, err := failover(store, func(store Reader) (*azblob.ListerResponse, error) {
+			return store.List(ctx, append(opts, azblob.WithListMarker(marker))...)
+		})
 		if err != nil {
 			return tail, foundCount, err
 		}
@@ -135,6 +143,7 @@ func PrefixedBlobLastN(
 			}
 			tail[n-stale+i].BlobPath = *it.Name
 			tail[n-stale+i].Tags = listResponseTags(it.BlobTags)
+			tail[n-stale+i].Stale = secondary
 		}
 
 		marker = r.Marker
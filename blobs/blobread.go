@@ -10,7 +10,8 @@ import (
 	"github.com/datatrails/go-datatrails-common/azblob"
 )
 
-// BlobRead reads the blob of the given store.
+// BlobRead reads the blob of the given store, ErrContentIntegrity is returned
+// if the content does not match the hashes returned with it.
 func BlobRead(
 	ctx context.Context, blobPath string, store Reader,
 	opts ...azblob.Option,
@@ -20,28 +21,18 @@ func BlobRead(
 		return rr, nil, err
 	}
 
-	data := make([]byte, rr.ContentLength)
-	read := int64(0)
-	for read < rr.ContentLength {
-		n, err := rr.Reader.Read(data[read:])
-		if err != nil && !errors.Is(err, io.EOF) {
-			return nil, nil, err
-		}
-		read += int64(n)
+	data, err := readResponse(rr, rr.ContentLength)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	// The reader is now definitely exhausted for the purpose it was created. To
-	// avoid odd effects, or accidental misuse we nill it out. And we do so regardless of error.
-
-	rr.Reader = nil // The caller has no use for this
-
-	// If we read less. truncate the buffer
-	if read < int64(len(data)) {
-		data = data[0:read]
+	if err = verifyContent(blobPath, rr, data); err != nil {
+		return nil, nil, err
 	}
 	return rr, data, nil
 }
 
+// BlobReadN reads at most readNMax bytes of the blob. The content is checked,
+// as it is for BlobRead, only if all of it is read.
 func BlobReadN(
 	ctx context.Context, readNMax int, blobPath string, store Reader,
 	opts ...azblob.Option,
@@ -53,24 +44,46 @@ func BlobReadN(
 
 	lenToRead := int64(min(readNMax, int(rr.ContentLength)))
 
+	data, err := readResponse(rr, lenToRead)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = verifyContent(blobPath, rr, data); err != nil {
+		return nil, nil, err
+	}
+	return rr, data, nil
+}
+
+// readResponse reads up to lenToRead bytes from the response reader, and
+// closes it.
+func readResponse(rr *azblob.ReaderResponse, lenToRead int64) ([]byte, error) {
+	// The reader is now definitely exhausted for the purpose it was created.
+	// It is closed, releasing the connection and the context of the request,
+	// and to avoid odd effects, or accidental misuse, we nill it out. And we
+	// do so regardless of error.
+	defer func() {
+		if rr.Reader != nil {
+			_ = rr.Reader.Close()
+		}
+		rr.Reader = nil // The caller has no use for this
+	}()
+
 	data := make([]byte, lenToRead)
 	read := int64(0)
 	for read < lenToRead {
 		n, err := rr.Reader.Read(data[read:])
 		if err != nil && !errors.Is(err, io.EOF) {
-			return nil, nil, err
+			return nil, err
 		}
 		read += int64(n)
+		if n == 0 && errors.Is(err, io.EOF) {
+			break
+		}
 	}
 
-	// The reader is now definitely exhausted for the purpose it was created. To
-	// avoid odd effects, or accidental misuse we nill it out. And we do so regardless of error.
-
-	rr.Reader = nil // The caller has no use for this
-
 	// If we read less. truncate the buffer
 	if read < int64(len(data)) {
 		data = data[0:read]
 	}
-	return rr, data, nil
+	return data, nil
 }
@@ -14,6 +14,10 @@ const (
 	DefaultContainer      = "merklelogs"
 )
 
+// AzureBlobSecondaryURLFmt is the read-access geo-redundant (RA-GRS) secondary
+// endpoint of the storage account
+const AzureBlobSecondaryURLFmt = "https://%s-secondary.blob.core.windows.net"
+
 type Reader interface {
 	Reader(
 		ctx context.Context,
@@ -29,6 +33,11 @@ type Options struct {
 	Container string
 	Account   string
 	EnvAuth   bool
+	// SecondaryURL, if set, is the endpoint which reads fail over to when the
+	// primary is not available, see FailoverReader. Typically the RA-GRS
+	// secondary, AzureBlobSecondaryURLFmt. It is not supported for the
+	// emulator, or with EnvAuth.
+	SecondaryURL string
 }
 
 func NewBlobReader(log azblob.Logger, url string, opts Options) (azblob.Reader, string, error) {
@@ -53,6 +62,10 @@ func NewBlobReader(log azblob.Logger, url string, opts Options) (azblob.Reader,
 		log.Infof("defaulting to the standard container %s", container)
 	}
 
+	if opts.SecondaryURL != "" && (account == AzuriteStorageAccount || envAuth) {
+		return nil, "", fmt.Errorf("a secondary url is only supported for unauthenticated remote connections")
+	}
+
 	if account == AzuriteStorageAccount {
 		if url != "" {
 			return nil, "", fmt.Errorf("the url for the emulator account is fixed, overriding it is not supported or useful")
@@ -91,5 +104,19 @@ func NewBlobReader(log azblob.Logger, url string, opts Options) (azblob.Reader,
 		return nil, "", fmt.Errorf("failed to connect to blob store: %v", err)
 	}
 
+	if opts.SecondaryURL != "" {
+		secondaryURL := opts.SecondaryURL
+		if !strings.HasSuffix(secondaryURL, "/") {
+			secondaryURL = secondaryURL + "/"
+		}
+		secondary, err := azblob.NewReaderNoAuth(
+			log, secondaryURL, azblob.WithContainer(container), azblob.WithAccountName(account))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to connect to secondary blob store: %v", err)
+		}
+		log.Infof("reads fail over to the secondary %s", secondaryURL)
+		reader = NewFailoverReader(reader, secondary)
+	}
+
 	return reader, remoteURL, nil
 }
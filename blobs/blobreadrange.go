@@ -0,0 +1,264 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+)
+
+// RangeReader is implemented by stores which can read a byte range of a blob.
+// For the azblob.Storer, BlobReadRange uses the azure sdk container client.
+type RangeReader interface {
+	ReaderRange(
+		ctx context.Context,
+		blobPath string,
+		offset, count int64,
+		opts ...RangeOption,
+	) (*azblob.ReaderResponse, error)
+}
+
+// RangeOptions are the conditions applied to a ranged read
+type RangeOptions struct {
+	IfMatch     string // The read fails with storage.ErrContentOC unless the blob ETag matches
+	IfNoneMatch string // The read returns no data, and status 304, if the blob ETag matches
+	GetTags     bool   // The blob index tags are returned with the response
+}
+
+type RangeOption func(*RangeOptions)
+
+// WithRangeIfMatch makes the read conditional on the blob being unchanged
+func WithRangeIfMatch(etag string) RangeOption {
+	return func(o *RangeOptions) {
+		o.IfMatch = etag
+	}
+}
+
+// WithRangeIfNoneMatch makes the read conditional on the blob having changed
+func WithRangeIfNoneMatch(etag string) RangeOption {
+	return func(o *RangeOptions) {
+		o.IfNoneMatch = etag
+	}
+}
+
+// WithRangeGetTags returns the blob index tags with the range. They are read
+// with a separate request, as they are for azblob.WithGetTags.
+func WithRangeGetTags() RangeOption {
+	return func(o *RangeOptions) {
+		o.GetTags = true
+	}
+}
+
+func readRangeOptions(opts ...RangeOption) RangeOptions {
+	var o RangeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// IsNotModified returns true if the response is for a conditional read which
+// found the blob unchanged.
+func IsNotModified(rr *azblob.ReaderResponse) bool {
+	return rr != nil && rr.StatusCode == http.StatusNotModified
+}
+
+// maxRangeContentMD5 is the largest range the service returns the MD5 for
+const maxRangeContentMD5 = 4 << 20
+
+// containerClientProvider is implemented by azblob.Storer
+type containerClientProvider interface {
+	GetContainerClient() *azStorageBlob.ContainerClient
+}
+
+// BlobReadRange reads length bytes of the blob, starting at offset, using an
+// HTTP Range request. Fewer bytes are returned if the blob ends first, and a
+// negative length reads to the end of the blob. Stores which don't support
+// range reads, see SupportsRangeReads, read the blob from the start.
+//
+// The content is checked against the MD5, or the CRC64, returned for the
+// range, ErrContentIntegrity is returned if they differ.
+func BlobReadRange(
+	ctx context.Context, blobPath string, store Reader, offset, length int64, opts ...RangeOption,
+) (*azblob.ReaderResponse, []byte, error) {
+	if offset < 0 || length == 0 {
+		return nil, nil, fmt.Errorf("invalid range, offset %d, length %d", offset, length)
+	}
+
+	var rr *azblob.ReaderResponse
+	var err error
+
+	switch s := store.(type) {
+	case retrier:
+		inner, ok := s.decorated().(Reader)
+		if !ok {
+			return nil, nil, errRetryStoreNotReader
+		}
+		// Retry the read of the content as well as the request
+		var data []byte
+		rr, err = retry(ctx, s.retryOptions(), func(ctx context.Context) (*azblob.ReaderResponse, error) {
+			var err error
+			rr, data, err = BlobReadRange(ctx, blobPath, inner, offset, length, opts...)
+			return rr, err
+		})
+		return rr, data, err
+	case *FailoverReader:
+		rr, data, _, err := failoverRead(s, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+			return BlobReadRange(ctx, blobPath, store, offset, length, opts...)
+		})
+		return rr, data, err
+	case RangeReader:
+		rr, err = s.ReaderRange(ctx, blobPath, offset, length, opts...)
+		if err == nil && rr.Reader != nil {
+			rr.Reader = newVerifyingReader(rr.Reader, blobPath, rr.ContentLength, rr.ContentMD5, rr.ContentCRC64)
+		}
+	case containerClientProvider:
+		rr, err = sdkReaderRange(ctx, s.GetContainerClient(), blobPath, offset, length, readRangeOptions(opts...))
+	default:
+		var data []byte
+		var readOpts []azblob.Option
+		o := readRangeOptions(opts...)
+		if o.IfMatch != "" {
+			readOpts = append(readOpts, azblob.WithEtagMatch(o.IfMatch))
+		}
+		if o.IfNoneMatch != "" {
+			readOpts = append(readOpts, azblob.WithEtagNoneMatch(o.IfNoneMatch))
+		}
+		if o.GetTags {
+			readOpts = append(readOpts, azblob.WithGetTags())
+		}
+		if length < 0 {
+			rr, data, err = BlobRead(ctx, blobPath, store, readOpts...)
+		} else {
+			rr, data, err = BlobReadN(ctx, int(offset+length), blobPath, store, readOpts...)
+		}
+		if o.IfNoneMatch != "" && rr != nil && rr.ConditionNotMet() {
+			rr.StatusCode = http.StatusNotModified
+			return rr, nil, nil
+		}
+		if err != nil {
+			return rr, nil, err
+		}
+		if int64(len(data)) <= offset {
+			return rr, nil, nil
+		}
+		return rr, data[offset:], nil
+	}
+	if isRangeNotSatisfiable(err) {
+		// The offset is at or beyond the end of the blob
+		return &azblob.ReaderResponse{StatusCode: http.StatusRequestedRangeNotSatisfiable}, nil, nil
+	}
+	if err != nil {
+		return rr, nil, err
+	}
+	if IsNotModified(rr) {
+		return rr, nil, nil
+	}
+
+	toRead := rr.ContentLength
+	if length > 0 {
+		toRead = min(length, toRead)
+	}
+	data, err := readResponse(rr, toRead)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rr, data, nil
+}
+
+// SupportsRangeReads returns true if BlobReadRange reads only the requested
+// range from the store, rather than reading the blob from the start.
+func SupportsRangeReads(store any) bool {
+	switch s := store.(type) {
+	case retrier:
+		return SupportsRangeReads(s.decorated())
+	case *FailoverReader:
+		return SupportsRangeReads(s.Primary)
+	case RangeReader:
+		return true
+	case containerClientProvider:
+		return s.GetContainerClient() != nil
+	default:
+		return false
+	}
+}
+
+func sdkReaderRange(
+	ctx context.Context, client *azStorageBlob.ContainerClient, blobPath string, offset, count int64, o RangeOptions,
+) (*azblob.ReaderResponse, error) {
+	if client == nil {
+		return nil, errors.New("no container client available for reader")
+	}
+	blobClient, err := client.NewBlobClient(blobPath)
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+	options := &azStorageBlob.BlobDownloadOptions{Offset: &offset}
+	if count > 0 {
+		options.Count = &count
+		if count <= maxRangeContentMD5 {
+			getMD5 := true
+			options.RangeGetContentMD5 = &getMD5
+		}
+	}
+	if o.IfMatch != "" || o.IfNoneMatch != "" {
+		conditions := &azStorageBlob.ModifiedAccessConditions{}
+		if o.IfMatch != "" {
+			conditions.IfMatch = &o.IfMatch
+		}
+		if o.IfNoneMatch != "" {
+			conditions.IfNoneMatch = &o.IfNoneMatch
+		}
+		options.BlobAccessConditions = &azStorageBlob.BlobAccessConditions{ModifiedAccessConditions: conditions}
+	}
+	get, err := blobClient.Download(ctx, options)
+	if o.IfNoneMatch != "" && hasStatus(err, http.StatusNotModified) {
+		return &azblob.ReaderResponse{
+			BlobClient: blobClient,
+			ETag:       &o.IfNoneMatch,
+			StatusCode: http.StatusNotModified,
+		}, nil
+	}
+	if err != nil {
+		return nil, azblob.ErrorFromError(err)
+	}
+
+	rr := &azblob.ReaderResponse{
+		BlobClient:   blobClient,
+		ETag:         get.ETag,
+		LastModified: get.LastModified,
+		Metadata:     get.Metadata,
+	}
+	if o.GetTags {
+		tags, err := blobClient.GetTags(ctx, nil)
+		if err != nil {
+			_ = get.Body(nil).Close()
+			return nil, azblob.ErrorFromError(err)
+		}
+		rr.Tags = listResponseTags(&tags.BlobTags)
+	}
+	if get.ContentLength != nil {
+		rr.ContentLength = *get.ContentLength
+	}
+	if get.RawResponse != nil {
+		rr.StatusCode = get.RawResponse.StatusCode
+		rr.Status = get.RawResponse.Status
+		rr.Reader = newVerifyingReader(get.Body(nil), blobPath, rr.ContentLength, get.ContentMD5, get.ContentCRC64)
+	}
+	return rr, nil
+}
+
+func isRangeNotSatisfiable(err error) bool {
+	return hasStatus(err, http.StatusRequestedRangeNotSatisfiable)
+}
+
+func hasStatus(err error, statusCode int) bool {
+	var terr *azStorageBlob.StorageError
+	if errors.As(err, &terr) {
+		return terr.Response().StatusCode == statusCode
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockBytesReader serves a single blob, and records the ranges requested when
+// ranged reads are supported.
+type mockBytesReader struct {
+	data       []byte
+	etag       string
+	metadata   map[string]string
+	contentMD5 []byte // Returned as the response ContentMD5
+	ranges     [][2]int64
+	blobClient *azStorageBlob.BlobClient // Returned with the response, as azblob.Storer does
+}
+
+func (r *mockBytesReader) response(data []byte) *azblob.ReaderResponse {
+	return &azblob.ReaderResponse{
+		Reader:        io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		ETag:          &r.etag,
+		Metadata:      r.metadata,
+		ContentMD5:    r.contentMD5,
+		StatusCode:    http.StatusOK,
+		BlobClient:    r.blobClient,
+	}
+}
+
+func (r *mockBytesReader) Reader(ctx context.Context, identity string, opts ...azblob.Option) (*azblob.ReaderResponse, error) {
+	return r.response(r.data), nil
+}
+
+func (r *mockBytesReader) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	return &azblob.FilterResponse{}, nil
+}
+
+func (r *mockBytesReader) List(ctx context.Context, opts ...azblob.Option) (*azblob.ListerResponse, error) {
+	return &azblob.ListerResponse{}, nil
+}
+
+type mockRangeReader struct {
+	mockBytesReader
+}
+
+func (r *mockRangeReader) ReaderRange(
+	ctx context.Context, blobPath string, offset, count int64, opts ...RangeOption,
+) (*azblob.ReaderResponse, error) {
+	r.ranges = append(r.ranges, [2]int64{offset, count})
+	if o := readRangeOptions(opts...); o.IfNoneMatch == r.etag {
+		return &azblob.ReaderResponse{ETag: &r.etag, StatusCode: http.StatusNotModified}, nil
+	}
+	start := min(offset, int64(len(r.data)))
+	end := int64(len(r.data))
+	if count > 0 {
+		end = min(offset+count, end)
+	}
+	return r.response(r.data[start:end]), nil
+}
+
+func TestBlobReadRange(t *testing.T) {
+	data := []byte("0123456789")
+
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+		want   []byte
+	}{
+		{name: "start", offset: 0, length: 4, want: []byte("0123")},
+		{name: "middle", offset: 3, length: 4, want: []byte("3456")},
+		{name: "past the end", offset: 8, length: 4, want: []byte("89")},
+		{name: "beyond the end", offset: 12, length: 4, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranged := &mockRangeReader{mockBytesReader{data: data, etag: "etag-1"}}
+			rr, got, err := BlobReadRange(t.Context(), "blob", ranged, tt.offset, tt.length)
+			require.NoError(t, err)
+			assert.Equal(t, string(tt.want), string(got))
+			assert.Equal(t, [][2]int64{{tt.offset, tt.length}}, ranged.ranges)
+			assert.Equal(t, "etag-1", *rr.ETag)
+
+			// stores which can not read ranges fall back to reading the head of the blob
+			plain := &mockBytesReader{data: data, etag: "etag-1"}
+			_, got, err = BlobReadRange(t.Context(), "blob", plain, tt.offset, tt.length)
+			require.NoError(t, err)
+			assert.Equal(t, string(tt.want), string(got))
+		})
+	}
+
+	assert.True(t, SupportsRangeReads(&mockRangeReader{}))
+	assert.True(t, SupportsRangeReads(NewRetryStore(&mockRangeReader{}, testRetryOptions())))
+	assert.False(t, SupportsRangeReads(&mockBytesReader{}))
+	assert.False(t, SupportsRangeReads(NewFailoverReader(&mockBytesReader{}, &mockRangeReader{})))
+
+	_, _, err := BlobReadRange(t.Context(), "blob", &mockBytesReader{data: data}, -1, 4)
+	assert.Error(t, err)
+	_, _, err = BlobReadRange(t.Context(), "blob", &mockBytesReader{data: data}, 0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,377 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+)
+
+const (
+	DefaultRetryMaxAttempts    = 4
+	DefaultRetryInitialBackoff = 200 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryMultiplier     = 2.0
+	DefaultRetryJitter         = 0.5
+)
+
+// RetryOptions configure the exponential backoff applied by RetryStore.
+// Zero values select the defaults, except for Jitter and the timeouts, for
+// which zero means none.
+type RetryOptions struct {
+	MaxAttempts    int           // The attempts made, including the first
+	InitialBackoff time.Duration // The wait before the first retry
+	MaxBackoff     time.Duration // The limit on the wait between attempts
+	Multiplier     float64       // The factor the wait is increased by for each retry
+	// Jitter is the fraction, from 0 to 1, of each wait which is randomized
+	Jitter float64
+	// AttemptTimeout limits each attempt, an attempt which times out is retried
+	AttemptTimeout time.Duration
+	// OperationTimeout limits each operation, including all of its attempts
+	// and the waits between them.
+	OperationTimeout time.Duration
+}
+
+// DefaultRetryOptions returns the default options, with jitter
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		Multiplier:     DefaultRetryMultiplier,
+		Jitter:         DefaultRetryJitter,
+	}
+}
+
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = DefaultRetryMultiplier
+	}
+	o.Jitter = min(max(o.Jitter, 0), 1)
+	return o
+}
+
+// backoff returns the wait before the retry following the failed attempt,
+// attempts are counted from 1.
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	wait := float64(o.InitialBackoff) * math.Pow(o.Multiplier, float64(attempt-1))
+	wait = min(wait, float64(o.MaxBackoff))
+	wait -= wait * o.Jitter * rand.Float64()
+	return time.Duration(wait)
+}
+
+// Backoff returns the wait before the retry following the failed attempt,
+// attempts are counted from 1.
+func (o RetryOptions) Backoff(attempt int) time.Duration {
+	return o.withDefaults().backoff(attempt)
+}
+
+// RetryStore decorates a store, retrying the operations which fail with a
+// transient error, as reported by IsRetryable, with exponential backoff.
+type RetryStore struct {
+	store any
+	opts  RetryOptions
+}
+
+// NewRetryStore decorates the store, which may be a Reader, a writer with a
+// Put method, or both. The operations the store does not implement fail.
+func NewRetryStore(store any, opts RetryOptions) *RetryStore {
+	return &RetryStore{store: store, opts: opts.withDefaults()}
+}
+
+// retrier is implemented by RetryStore. The functions which use capabilities
+// of a store beyond Reader find them on the store decorated, and apply the
+// same retries to them.
+type retrier interface {
+	decorated() any
+	retryOptions() RetryOptions
+}
+
+func (s *RetryStore) decorated() any {
+	return s.store
+}
+
+func (s *RetryStore) retryOptions() RetryOptions {
+	return s.opts
+}
+
+// decorate returns the store decorated with the retry options, or nil if the
+// store is nil.
+func decorate(store Reader, opts RetryOptions) Reader {
+	if store == nil {
+		return nil
+	}
+	return &RetryStore{store: store, opts: opts}
+}
+
+var errRetryStoreNotReader = errors.New("the decorated store does not support reads")
+
+type writer interface {
+	Put(
+		ctx context.Context,
+		identity string,
+		source io.ReadSeekCloser,
+		opts ...azblob.Option,
+	) (*azblob.WriteResponse, error)
+}
+
+func (s *RetryStore) Reader(
+	ctx context.Context,
+	identity string,
+	opts ...azblob.Option,
+) (*azblob.ReaderResponse, error) {
+	r, ok := s.store.(Reader)
+	if !ok {
+		return nil, errRetryStoreNotReader
+	}
+	return retryResponse(ctx, s.opts, func(ctx context.Context) (*azblob.ReaderResponse, error) {
+		return r.Reader(ctx, identity, opts...)
+	})
+}
+
+func (s *RetryStore) FilteredList(
+	ctx context.Context, tagsFilter string, opts ...azblob.Option,
+) (*azblob.FilterResponse, error) {
+	r, ok := s.store.(Reader)
+	if !ok {
+		return nil, errRetryStoreNotReader
+	}
+	return retry(ctx, s.opts, func(ctx context.Context) (*azblob.FilterResponse, error) {
+		return r.FilteredList(ctx, tagsFilter, opts...)
+	})
+}
+
+func (s *RetryStore) List(ctx context.Context, opts ...azblob.Option) (*azblob.ListerResponse, error) {
+	r, ok := s.store.(Reader)
+	if !ok {
+		return nil, errRetryStoreNotReader
+	}
+	return retry(ctx, s.opts, func(ctx context.Context) (*azblob.ListerResponse, error) {
+		return r.List(ctx, opts...)
+	})
+}
+
+// Put writes the source, which is re-wound for each attempt. The options may
+// make it conditional, so it is retried as a conditional write.
+func (s *RetryStore) Put(
+	ctx context.Context,
+	identity string,
+	source io.ReadSeekCloser,
+	opts ...azblob.Option,
+) (*azblob.WriteResponse, error) {
+	w, ok := s.store.(writer)
+	if !ok {
+		return nil, errors.New("the decorated store does not support writes")
+	}
+	return retryWrite(ctx, s.opts, true, func(ctx context.Context) (*azblob.WriteResponse, error) {
+		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return w.Put(ctx, identity, source, opts...)
+	})
+}
+
+// retryBlockWriter retries the operations of the decorated block writer
+type retryBlockWriter struct {
+	w    BlockWriter
+	opts RetryOptions
+}
+
+func (w *retryBlockWriter) StageBlock(ctx context.Context, blobPath string, blockID string, data []byte) error {
+	_, err := retry(ctx, w.opts, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, w.w.StageBlock(ctx, blobPath, blockID, data)
+	})
+	return err
+}
+
+func (w *retryBlockWriter) CommitBlockList(
+	ctx context.Context, blobPath string, blockIDs []string, opts CommitOptions,
+) (*azblob.WriteResponse, error) {
+	return retryWrite(ctx, w.opts, opts.conditional(), func(ctx context.Context) (*azblob.WriteResponse, error) {
+		return w.w.CommitBlockList(ctx, blobPath, blockIDs, opts)
+	})
+}
+
+func (w *retryBlockWriter) BlockList(ctx context.Context, blobPath string) ([]Block, error) {
+	return retry(ctx, w.opts, func(ctx context.Context) ([]Block, error) {
+		return w.w.BlockList(ctx, blobPath)
+	})
+}
+
+// IsRetryable returns true if the error is transient: throttling, a timeout
+// or an unavailable service, or a failure of the transport.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if statusCode, ok := errorStatus(err); ok {
+		switch statusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// errorStatus returns the http status of the storage service error
+func errorStatus(err error) (int, bool) {
+	var storageError *azStorageBlob.StorageError
+	if errors.As(err, &storageError) {
+		return storageError.Response().StatusCode, true
+	}
+	if rerr, ok := AsResponseError(err); ok {
+		return rerr.StatusCode, true
+	}
+	return 0, false
+}
+
+// retryWait returns the wait before the next attempt. The wait requested by
+// the service takes precedence over the backoff.
+func retryWait(opts RetryOptions, attempt int, err error) time.Duration {
+	if rerr, ok := AsResponseError(err); ok {
+		if wait := retryAfter(rerr); wait > 0 {
+			return wait
+		}
+	}
+	return opts.backoff(attempt)
+}
+
+// retry calls op until it succeeds, fails with an error which is not
+// retryable, or the attempts or the operation deadline are exhausted. The last
+// error is returned.
+func retry[T any](ctx context.Context, opts RetryOptions, op func(ctx context.Context) (T, error)) (T, error) {
+	return retryHold(ctx, opts, false, op, nil)
+}
+
+// retryWrite is retry for writes. A conditional write is retried only if the
+// service reported that it failed, otherwise a retry could conflict with the
+// write itself.
+func retryWrite[T any](
+	ctx context.Context, opts RetryOptions, conditional bool, op func(ctx context.Context) (T, error),
+) (T, error) {
+	return retryHold(ctx, opts, conditional, op, nil)
+}
+
+// retryResponse is retry for reads, the per attempt timeout applies until the
+// body of the successful response is closed.
+func retryResponse(
+	ctx context.Context, opts RetryOptions,
+	op func(ctx context.Context) (*azblob.ReaderResponse, error),
+) (*azblob.ReaderResponse, error) {
+	return retryHold(ctx, opts, false, op, func(rr *azblob.ReaderResponse, cancel context.CancelFunc) bool {
+		if rr == nil || rr.Reader == nil {
+			return false
+		}
+		rr.Reader = &cancelOnClose{ReadCloser: rr.Reader, cancel: cancel}
+		return true
+	})
+}
+
+// retryHold is retry for operations whose result depends on the attempt
+// context. hold, if not nil, returns true if it takes responsibility for the
+// cancel func of the successful attempt.
+func retryHold[T any](
+	ctx context.Context, opts RetryOptions, conditional bool,
+	op func(ctx context.Context) (T, error),
+	hold func(v T, cancel context.CancelFunc) bool,
+) (T, error) {
+	var zero T
+	opCancel := context.CancelFunc(func() {})
+	if opts.OperationTimeout > 0 {
+		ctx, opCancel = context.WithTimeout(ctx, opts.OperationTimeout)
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if opts.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.AttemptTimeout)
+		}
+		v, err := op(attemptCtx)
+		if err == nil {
+			release := func() {
+				cancel()
+				opCancel()
+			}
+			if hold == nil || !hold(v, release) {
+				release()
+			}
+			return v, nil
+		}
+		cancel()
+
+		// An attempt which timed out is retried, provided the operation
+		// has not also run out of time.
+		timedOut := errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+		retryable := timedOut || IsRetryable(err)
+		if _, answered := errorStatus(err); conditional && !answered {
+			retryable = false
+		}
+		if attempt >= opts.MaxAttempts || !retryable {
+			opCancel()
+			return v, err
+		}
+
+		wait := retryWait(opts, attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			opCancel()
+			return v, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = fmt.Errorf("%w: %v", ctx.Err(), err)
+			opCancel()
+			return zero, err
+		case <-timer.C:
+		}
+	}
+}
+
+// cancelOnClose releases the attempt context when the response is closed, or
+// has been read to the end.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		c.cancel()
+	}
+	return n, err
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,331 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// faultStore injects the queued faults, one per call, before serving the
+// blob. A nil fault lets the call through, errHang blocks the call until its
+// context is done.
+type faultStore struct {
+	mockRangeReader
+	mu     sync.Mutex
+	faults []error
+	calls  int
+	puts   [][]byte
+	// readCtx is the context of the last Reader request
+	readCtx context.Context
+}
+
+var errHang = errors.New("hang")
+
+func (s *faultStore) fault(ctx context.Context) error {
+	s.mu.Lock()
+	s.calls++
+	var err error
+	if len(s.faults) > 0 {
+		err, s.faults = s.faults[0], s.faults[1:]
+	}
+	s.mu.Unlock()
+	if err == errHang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+// ctxReadCloser fails reads once the context of the request is done
+type ctxReadCloser struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *ctxReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *ctxReadCloser) Close() error { return nil }
+
+func (s *faultStore) Reader(ctx context.Context, identity string, opts ...azblob.Option) (*azblob.ReaderResponse, error) {
+	if err := s.fault(ctx); err != nil {
+		return nil, err
+	}
+	s.readCtx = ctx
+	rr := s.response(s.data)
+	rr.Reader = &ctxReadCloser{ctx: ctx, Reader: bytes.NewReader(s.data)}
+	return rr, nil
+}
+
+func (s *faultStore) ReaderRange(
+	ctx context.Context, blobPath string, offset, count int64, opts ...RangeOption,
+) (*azblob.ReaderResponse, error) {
+	if err := s.fault(ctx); err != nil {
+		return nil, err
+	}
+	return s.mockRangeReader.ReaderRange(ctx, blobPath, offset, count, opts...)
+}
+
+func (s *faultStore) List(ctx context.Context, opts ...azblob.Option) (*azblob.ListerResponse, error) {
+	if err := s.fault(ctx); err != nil {
+		return nil, err
+	}
+	return &azblob.ListerResponse{}, nil
+}
+
+func (s *faultStore) Put(
+	ctx context.Context, identity string, source io.ReadSeekCloser, opts ...azblob.Option,
+) (*azblob.WriteResponse, error) {
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, err
+	}
+	s.puts = append(s.puts, data)
+	if err := s.fault(ctx); err != nil {
+		return nil, err
+	}
+	return &azblob.WriteResponse{StatusCode: http.StatusCreated}, nil
+}
+
+func statusError(statusCode int, errorCode string) error {
+	return &azcore.ResponseError{StatusCode: statusCode, ErrorCode: errorCode}
+}
+
+func transportError() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+}
+
+func testRetryOptions() RetryOptions {
+	return RetryOptions{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+}
+
+func TestRetryStore_faults(t *testing.T) {
+	tests := []struct {
+		name      string
+		faults    []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "no faults", wantCalls: 1},
+		{name: "service unavailable", faults: []error{statusError(503, "ServerBusy"), statusError(503, "ServerBusy")}, wantCalls: 3},
+		{name: "throttled", faults: []error{statusError(429, "")}, wantCalls: 2},
+		{name: "transport", faults: []error{transportError()}, wantCalls: 2},
+		{name: "wrapped transport", faults: []error{azblob.ErrorFromError(transportError())}, wantCalls: 2},
+		{name: "condition not met", faults: []error{statusError(412, "ConditionNotMet")}, wantCalls: 1, wantErr: true},
+		{name: "already exists", faults: []error{statusError(409, "BlobAlreadyExists")}, wantCalls: 1, wantErr: true},
+		{name: "not found", faults: []error{statusError(404, "BlobNotFound")}, wantCalls: 1, wantErr: true},
+		{name: "other error", faults: []error{errors.New("bad request")}, wantCalls: 1, wantErr: true},
+		{
+			name:      "attempts exhausted",
+			faults:    []error{statusError(503, ""), statusError(503, ""), statusError(503, ""), statusError(503, ""), nil},
+			wantCalls: 4, wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &faultStore{faults: tt.faults}
+			s := NewRetryStore(fake, testRetryOptions())
+			_, err := s.List(t.Context())
+			assert.Equal(t, tt.wantCalls, fake.calls)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tt.faults[tt.wantCalls-1], err)
+		})
+	}
+}
+
+func TestRetryStore_Reader(t *testing.T) {
+	fake := &faultStore{faults: []error{errHang, statusError(500, "")}}
+	fake.data = []byte("0123456789")
+	fake.etag = "etag-1"
+	opts := testRetryOptions()
+	opts.AttemptTimeout = 20 * time.Millisecond
+	s := NewRetryStore(fake, opts)
+
+	// the hung attempt times out and is retried, the body of the response
+	// can be read after the attempt returns
+	rr, data, err := BlobRead(t.Context(), "blob", s)
+	require.NoError(t, err)
+	assert.Equal(t, fake.data, data)
+	assert.Equal(t, int64(len(data)), rr.ContentLength)
+	assert.Equal(t, 3, fake.calls)
+
+	// ranged reads use the decorated store, with retries
+	fake.faults = []error{statusError(503, "")}
+	_, data, err = BlobReadRange(t.Context(), "blob", s, 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), data)
+	assert.Equal(t, 5, fake.calls)
+	assert.Equal(t, [][2]int64{{2, 3}}, fake.ranges)
+}
+
+func TestRetryStore_Reader_released(t *testing.T) {
+	fake := &faultStore{}
+	fake.data = []byte("0123456789")
+	s := NewRetryStore(fake, testRetryOptions())
+
+	// without an attempt timeout, the attempt context is released once the
+	// response has been read
+	_, data, err := BlobRead(t.Context(), "blob", s)
+	require.NoError(t, err)
+	assert.Equal(t, fake.data, data)
+	require.NotNil(t, fake.readCtx)
+	assert.ErrorIs(t, fake.readCtx.Err(), context.Canceled)
+}
+
+func TestRetryStore_Reader_operationTimeout(t *testing.T) {
+	fake := &faultStore{faults: []error{statusError(503, "")}}
+	fake.data = []byte("0123456789")
+	opts := testRetryOptions()
+	opts.OperationTimeout = time.Minute
+	s := NewRetryStore(fake, opts)
+
+	// the operation context outlives the request, until the body is read
+	_, data, err := BlobRead(t.Context(), "blob", s)
+	require.NoError(t, err)
+	assert.Equal(t, fake.data, data)
+	require.NotNil(t, fake.readCtx)
+	assert.ErrorIs(t, fake.readCtx.Err(), context.Canceled)
+}
+
+func TestPutContent_retryConditional(t *testing.T) {
+	data := []byte("content")
+	tests := []struct {
+		name     string
+		opts     CommitOptions
+		fault    error
+		wantPuts int
+	}{
+		{name: "unconditional transport", fault: transportError(), wantPuts: 2},
+		{name: "conditional transport", opts: CommitOptions{IfNoneMatch: "*"}, fault: transportError(), wantPuts: 1},
+		{name: "conditional timeout", opts: CommitOptions{IfMatch: "etag-1"}, fault: errHang, wantPuts: 1},
+		{name: "conditional service unavailable", opts: CommitOptions{IfMatch: "etag-1"}, fault: statusError(503, ""), wantPuts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &faultStore{faults: []error{tt.fault}}
+			opts := testRetryOptions()
+			opts.AttemptTimeout = 20 * time.Millisecond
+			_, err := PutContent(t.Context(), NewRetryStore(fake, opts), "blob", data, tt.opts)
+			assert.Len(t, fake.puts, tt.wantPuts)
+			if tt.wantPuts == 1 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRetryStore_Put(t *testing.T) {
+	fake := &faultStore{faults: []error{statusError(503, ""), statusError(500, "")}}
+	s := NewRetryStore(fake, testRetryOptions())
+
+	// the source is re-wound for each attempt
+	data := []byte("content")
+	_, err := s.Put(t.Context(), "blob", azblob.NewBytesReaderCloser(data))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{data, data, data}, fake.puts)
+
+	_, err = NewRetryStore(&mockBytesReader{}, testRetryOptions()).Put(t.Context(), "blob", azblob.NewBytesReaderCloser(data))
+	assert.Error(t, err)
+}
+
+func TestRetryStore_Put_conditional(t *testing.T) {
+	data := []byte("content")
+	tests := []struct {
+		name     string
+		opts     []azblob.Option
+		fault    error
+		wantPuts int
+	}{
+		// the options are opaque, so every Put is treated as conditional
+		{name: "unconditional transport", opts: []azblob.Option{azblob.WithTags(map[string]string{"a": "b"})}, fault: transportError(), wantPuts: 1},
+		{name: "if match transport", opts: []azblob.Option{azblob.WithEtagMatch("etag-1")}, fault: transportError(), wantPuts: 1},
+		{name: "if none match timeout", opts: []azblob.Option{azblob.WithEtagNoneMatch("*")}, fault: errHang, wantPuts: 1},
+		{name: "if match service unavailable", opts: []azblob.Option{azblob.WithEtagMatch("etag-1")}, fault: statusError(503, ""), wantPuts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &faultStore{faults: []error{tt.fault}}
+			opts := testRetryOptions()
+			opts.AttemptTimeout = 20 * time.Millisecond
+			_, err := NewRetryStore(fake, opts).Put(t.Context(), "blob", azblob.NewBytesReaderCloser(data), tt.opts...)
+			assert.Len(t, fake.puts, tt.wantPuts)
+			if tt.wantPuts == 1 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRetryStore_RetryAfter(t *testing.T) {
+	throttled := &azcore.ResponseError{
+		StatusCode:  http.StatusServiceUnavailable,
+		RawResponse: &http.Response{Header: http.Header{"Retry-After": []string{"5"}}},
+	}
+	opts := testRetryOptions().withDefaults()
+	assert.Equal(t, 5*time.Second, retryWait(opts, 1, throttled))
+	assert.Equal(t, time.Millisecond, retryWait(opts, 1, statusError(503, "")))
+
+	// a wait which would exceed the operation deadline is not made
+	opts.OperationTimeout = 100 * time.Millisecond
+	fake := &faultStore{faults: []error{throttled}}
+	start := time.Now()
+	_, err := NewRetryStore(fake, opts).List(t.Context())
+	assert.Equal(t, throttled, err)
+	assert.Equal(t, 1, fake.calls)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryStore_cancelled(t *testing.T) {
+	opts := testRetryOptions()
+	opts.InitialBackoff = time.Hour
+	opts.MaxBackoff = time.Hour
+	fake := &faultStore{faults: []error{statusError(503, "")}}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := NewRetryStore(fake, opts).List(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, fake.calls)
+}
+
+func TestRetryOptions_backoff(t *testing.T) {
+	opts := RetryOptions{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	assert.Equal(t, 100*time.Millisecond, opts.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, opts.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, opts.backoff(4))
+	assert.Equal(t, time.Second, opts.backoff(5))
+
+	opts.Jitter = 0.5
+	for range 100 {
+		wait := opts.backoff(2)
+		assert.GreaterOrEqual(t, wait, 100*time.Millisecond)
+		assert.LessOrEqual(t, wait, 200*time.Millisecond)
+	}
+}
+
+func TestNewBlockWriter_retry(t *testing.T) {
+	_, ok := NewBlockWriter(NewRetryStore(&mockBytesReader{}, testRetryOptions()))
+	assert.False(t, ok)
+}
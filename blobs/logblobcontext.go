@@ -1,11 +1,13 @@
 package blobs
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"maps"
 	"net/http"
+	"slices"
 	"time"
 
 	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
@@ -13,6 +15,20 @@ import (
 	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
+// RefreshOverlap is the number of previously read bytes which RefreshData
+// reads again, so that most blobs which were re-written rather than appended
+// to are found without checking the whole content.
+const RefreshOverlap = 64
+
+// RefreshResult reports how RefreshData brought the data up to date
+type RefreshResult int
+
+const (
+	RefreshUnchanged RefreshResult = iota // The blob was not modified, nothing was read
+	RefreshAppended                       // Only the bytes appended to the blob were read
+	RefreshReplaced                       // The blob was re-written, or not previously read, and was read in full
+)
+
 // LogBlobContext provides a common context for reading & writing log blobs
 //
 // The log is comprised of a series of numbered blobs. With one blob per
@@ -28,6 +44,9 @@ type LogBlobContext struct {
 	LastModified  time.Time
 	Data          []byte
 	ContentLength int64
+	// Stale is true if the blob was last read from the secondary of a
+	// FailoverReader, which may not have all the changes made to the primary.
+	Stale bool
 }
 
 func NewLogBlobContext(blobPath string, rr *azblob.ReaderResponse) *LogBlobContext {
@@ -77,21 +96,190 @@ func (lc *LogBlobContext) CopyTags() map[string]string {
 func (lc *LogBlobContext) ReadData(
 	ctx context.Context, store Reader, opts ...azblob.Option,
 ) error {
-	var err error
-	var rr *azblob.ReaderResponse
-
-	rr, lc.Data, err = BlobRead(ctx, lc.BlobPath, store, opts...)
-	return lc.processResponse(rr, err)
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobRead(ctx, lc.BlobPath, store, opts...)
+	})
+	lc.Data = data
+	if err = lc.processResponse(rr, err); err != nil {
+		return err
+	}
+	lc.Stale = stale
+	return nil
 }
 
 func (lc *LogBlobContext) ReadDataN(
 	ctx context.Context, readNMax int, store Reader, opts ...azblob.Option,
 ) error {
-	var err error
-	var rr *azblob.ReaderResponse
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobReadN(ctx, readNMax, lc.BlobPath, store, opts...)
+	})
+	lc.Data = data
+	if err = lc.processResponse(rr, err); err != nil {
+		return err
+	}
+	lc.Stale = stale
+	return nil
+}
+
+// ReadDataIfModified reads the blob, as ReadData does, unless it still has the
+// ETag of the context. If it is not modified, false is returned and only
+// LastRead, and Stale, are updated.
+func (lc *LogBlobContext) ReadDataIfModified(
+	ctx context.Context, store Reader, opts ...azblob.Option,
+) (bool, error) {
+	if lc.ETag == "" {
+		return true, lc.ReadData(ctx, store, opts...)
+	}
+	opts = append(slices.Clip(opts), azblob.WithEtagNoneMatch(lc.ETag))
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobRead(ctx, lc.BlobPath, store, opts...)
+	})
+	if rr != nil && (rr.ConditionNotMet() || IsNotModified(rr)) {
+		lc.LastRead = time.Now()
+		lc.Stale = stale
+		return false, nil
+	}
+	lc.Data = data
+	if err = lc.processResponse(rr, err); err != nil {
+		return true, err
+	}
+	lc.Stale = stale
+	return true, nil
+}
+
+// ReadDataRange reads length bytes of the blob, starting at offset. On return,
+// the Data member contains the bytes read and ContentLength is the number of
+// bytes in the range response, not the size of the blob.
+func (lc *LogBlobContext) ReadDataRange(
+	ctx context.Context, offset, length int64, store Reader, opts ...RangeOption,
+) error {
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobReadRange(ctx, lc.BlobPath, store, offset, length, opts...)
+	})
+	lc.Data = data
+	if err = lc.processResponse(rr, err); err != nil {
+		return err
+	}
+	lc.Stale = stale
+	return nil
+}
+
+// ReadDataRangeIfModified reads the range, as ReadDataRange does, unless the
+// blob still has the ETag of the context. If it is not modified, false is
+// returned and only LastRead, and Stale, are updated.
+func (lc *LogBlobContext) ReadDataRangeIfModified(
+	ctx context.Context, offset, length int64, store Reader, opts ...RangeOption,
+) (bool, error) {
+	if lc.ETag == "" {
+		return true, lc.ReadDataRange(ctx, offset, length, store, opts...)
+	}
+	opts = append(slices.Clip(opts), WithRangeIfNoneMatch(lc.ETag))
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobReadRange(ctx, lc.BlobPath, store, offset, length, opts...)
+	})
+	if err == nil && IsNotModified(rr) {
+		lc.LastRead = time.Now()
+		lc.Stale = stale
+		return false, nil
+	}
+	lc.Data = data
+	if err = lc.processResponse(rr, err); err != nil {
+		return true, err
+	}
+	lc.Stale = stale
+	return true, nil
+}
+
+// RefreshData brings Data up to date with the blob, assuming that the blob is
+// only ever appended to. Only the bytes past the end of Data, and
+// RefreshOverlap bytes before it, are read, unless the blob was re-written, or
+// the refreshed Data does not match its ContentMD5Key metadata, when it is read
+// in full. Data is re-allocated, previously returned slices are not modified.
+func (lc *LogBlobContext) RefreshData(
+	ctx context.Context, store Reader, opts RefreshOptions,
+) (RefreshResult, error) {
+	return lc.RefreshDataPatched(ctx, store, nil, opts)
+}
+
+// RefreshOptions configure RefreshData
+type RefreshOptions struct {
+	GetTags bool // The blob index tags are read with the data
+}
+
+// readOptions returns the options for a full read of the blob
+func (o RefreshOptions) readOptions() []azblob.Option {
+	if o.GetTags {
+		return []azblob.Option{azblob.WithGetTags()}
+	}
+	return nil
+}
+
+// RefreshPatch applies the updates made in place, by the writer which appended
+// to the blob, to the refreshed data. The data is that of the blob version
+// identified by etag, the patch reads the updated bytes conditional on it.
+type RefreshPatch func(ctx context.Context, data []byte, etag string) error
+
+// RefreshDataPatched is RefreshData for blobs which are updated in place as
+// well as appended to. The patch is applied to the refreshed data before it is
+// checked against the ContentMD5Key metadata, if the patch fails, the blob is
+// read in full.
+func (lc *LogBlobContext) RefreshDataPatched(
+	ctx context.Context, store Reader, patch RefreshPatch, opts RefreshOptions,
+) (RefreshResult, error) {
+	if len(lc.Data) == 0 || lc.ETag == "" {
+		return RefreshReplaced, lc.ReadData(ctx, store, opts.readOptions()...)
+	}
+
+	overlap := min(RefreshOverlap, len(lc.Data))
+	offset := len(lc.Data) - overlap
+
+	rangeOpts := []RangeOption{WithRangeIfNoneMatch(lc.ETag)}
+	if opts.GetTags {
+		rangeOpts = append(rangeOpts, WithRangeGetTags())
+	}
+	tail := &LogBlobContext{BlobPath: lc.BlobPath}
+	rr, data, stale, err := failoverRead(store, func(store Reader) (*azblob.ReaderResponse, []byte, error) {
+		return BlobReadRange(ctx, lc.BlobPath, store, int64(offset), -1, rangeOpts...)
+	})
+	tail.Data = data
+	if err = tail.processResponse(rr, err); err != nil {
+		return RefreshUnchanged, err
+	}
+	if IsNotModified(rr) {
+		// The data is as current as the store which was read
+		lc.LastRead = tail.LastRead
+		lc.Stale = stale
+		return RefreshUnchanged, nil
+	}
+
+	if len(tail.Data) <= overlap || !bytes.Equal(tail.Data[:overlap], lc.Data[offset:]) {
+		return RefreshReplaced, lc.ReadData(ctx, store, opts.readOptions()...)
+	}
+	refreshed := append(slices.Clip(lc.Data), tail.Data[overlap:]...)
+	if patch != nil {
+		if err = patch(ctx, refreshed, tail.ETag); err != nil {
+			return RefreshReplaced, lc.ReadData(ctx, store, opts.readOptions()...)
+		}
+	}
+	if !contentMatches(rr, refreshed) {
+		return RefreshReplaced, lc.ReadData(ctx, store, opts.readOptions()...)
+	}
+
+	lc.Data = refreshed
+	lc.ContentLength = int64(len(lc.Data))
+	lc.ETag = tail.ETag
+	lc.LastModified = tail.LastModified
+	lc.LastRead = tail.LastRead
+	lc.Tags = tail.Tags
+	lc.Stale = stale
+	return RefreshAppended, nil
+}
 
-	rr, lc.Data, err = BlobReadN(ctx, readNMax, lc.BlobPath, store, opts...)
-	return lc.processResponse(rr, err)
+// contentMatches returns true if the blob MD5, from the metadata returned
+// with the response, is the hash of the data. It is false for blobs without it.
+func contentMatches(rr *azblob.ReaderResponse, data []byte) bool {
+	want, ok := metadataContentMD5(rr.Metadata)
+	return ok && bytes.Equal(ContentMD5(data), want)
 }
 
 func (lc *LogBlobContext) processResponse(rr *azblob.ReaderResponse, err error) error {
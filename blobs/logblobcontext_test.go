@@ -0,0 +1,126 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogBlobContext_RefreshData(t *testing.T) {
+	head := bytes.Repeat([]byte("a"), 2*RefreshOverlap)
+	store := &mockRangeReader{mockBytesReader{data: head, etag: "etag-1"}}
+
+	lc := &LogBlobContext{BlobPath: "blob"}
+	result, err := lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshReplaced, result)
+	assert.Equal(t, head, lc.Data)
+	assert.Empty(t, store.ranges)
+
+	result, err = lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshUnchanged, result)
+	assert.Equal(t, head, lc.Data)
+
+	// only the overlap and the appended bytes are read
+	previous := lc.Data
+	store.data = append(bytes.Clone(head), "bc"...)
+	store.etag = "etag-2"
+	store.metadata = map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(ContentMD5(store.data))}
+	result, err = lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshAppended, result)
+	assert.Equal(t, store.data, lc.Data)
+	assert.Equal(t, "etag-2", lc.ETag)
+	assert.Equal(t, int64(len(store.data)), lc.ContentLength)
+	assert.Equal(t, [2]int64{RefreshOverlap, -1}, store.ranges[len(store.ranges)-1])
+	assert.Equal(t, head, previous)
+
+	// the end of the previously read data changed, the blob is read in full
+	store.data = append(bytes.Repeat([]byte("x"), 2*RefreshOverlap), "bcd"...)
+	store.etag = "etag-3"
+	result, err = lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshReplaced, result)
+	assert.Equal(t, store.data, lc.Data)
+	assert.Equal(t, "etag-3", lc.ETag)
+
+	// without the MD5 a re-write can't be told from an append, the blob is
+	// read in full
+	store.data = append(bytes.Clone(store.data), "ef"...)
+	store.etag = "etag-4"
+	store.metadata = nil
+	ranges := len(store.ranges)
+	result, err = lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshReplaced, result)
+	assert.Equal(t, store.data, lc.Data)
+	assert.Len(t, store.ranges, ranges+1)
+}
+
+func TestLogBlobContext_RefreshData_prefix(t *testing.T) {
+	head := append(bytes.Repeat([]byte("a"), RefreshOverlap), bytes.Repeat([]byte("b"), RefreshOverlap)...)
+	store := &mockRangeReader{mockBytesReader{data: head, etag: "etag-1"}}
+	lc := &LogBlobContext{BlobPath: "blob"}
+	_, err := lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+
+	// the prefix was re-written before the overlap, and the blob grew
+	rewritten := append(bytes.Repeat([]byte("x"), RefreshOverlap), bytes.Repeat([]byte("b"), RefreshOverlap)...)
+	store.data = append(rewritten, "cd"...)
+	store.etag = "etag-2"
+	store.metadata = map[string]string{"Content_md5": base64.StdEncoding.EncodeToString(ContentMD5(store.data))}
+
+	result, err := lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshReplaced, result)
+	assert.Equal(t, store.data, lc.Data)
+
+	// appended, and the prefix is unchanged
+	store.data = append(bytes.Clone(store.data), "ef"...)
+	store.etag = "etag-3"
+	store.metadata = map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(ContentMD5(store.data))}
+	result, err = lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshAppended, result)
+	assert.Equal(t, store.data, lc.Data)
+}
+
+func TestLogBlobContext_RefreshDataPatched(t *testing.T) {
+	head := bytes.Repeat([]byte("a"), 2*RefreshOverlap)
+	store := &mockRangeReader{mockBytesReader{data: head, etag: "etag-1"}}
+	lc := &LogBlobContext{BlobPath: "blob"}
+	_, err := lc.RefreshData(t.Context(), store, RefreshOptions{})
+	require.NoError(t, err)
+
+	// appended, and the first byte updated in place, the MD5 is of the patched
+	// data
+	store.data = append([]byte("h"), append(bytes.Clone(head[1:]), "bc"...)...)
+	store.etag = "etag-2"
+	store.metadata = map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(ContentMD5(store.data))}
+	patch := func(ctx context.Context, data []byte, etag string) error {
+		assert.Equal(t, "etag-2", etag)
+		data[0] = 'h'
+		return nil
+	}
+	result, err := lc.RefreshDataPatched(t.Context(), store, patch, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshAppended, result)
+	assert.Equal(t, store.data, lc.Data)
+
+	// a failed patch reads the blob in full
+	store.data = append(bytes.Clone(store.data), "de"...)
+	store.etag = "etag-3"
+	store.metadata = map[string]string{ContentMD5Key: base64.StdEncoding.EncodeToString(ContentMD5(store.data))}
+	result, err = lc.RefreshDataPatched(t.Context(), store, func(context.Context, []byte, string) error {
+		return errors.New("changed again")
+	}, RefreshOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, RefreshReplaced, result)
+	assert.Equal(t, store.data, lc.Data)
+}
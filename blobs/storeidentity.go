@@ -0,0 +1,32 @@
+package blobs
+
+// StoreIdentifier is implemented by stores which can name the account and
+// container they access, so that state kept outside the store, such as a
+// disk cache, is not confused between stores.
+type StoreIdentifier interface {
+	StoreIdentity() string
+}
+
+// StoreIdentity returns a name for the account and container accessed by the
+// store, which is the same for every process. Stores which implement
+// StoreIdentifier name themselves, those which provide the azure sdk
+// container client, such as azblob.Storer, are named by the container URL.
+// RetryStore is named by the store it decorates, and FailoverReader by its
+// primary. The empty string is returned for any other store.
+func StoreIdentity(store any) string {
+	switch s := store.(type) {
+	case retrier:
+		return StoreIdentity(s.decorated())
+	case *FailoverReader:
+		return StoreIdentity(s.Primary)
+	case StoreIdentifier:
+		return s.StoreIdentity()
+	case containerClientProvider:
+		if client := s.GetContainerClient(); client != nil {
+			return client.URL()
+		}
+		return ""
+	default:
+		return ""
+	}
+}
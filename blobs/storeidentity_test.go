@@ -0,0 +1,28 @@
+package blobs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type identifiedStore struct {
+	mockBytesReader
+	name string
+}
+
+func (s *identifiedStore) StoreIdentity() string {
+	return s.name
+}
+
+func TestStoreIdentity(t *testing.T) {
+	primary := &identifiedStore{name: "primary"}
+	secondary := &identifiedStore{name: "secondary"}
+
+	assert.Equal(t, "primary", StoreIdentity(primary))
+	assert.Equal(t, "primary", StoreIdentity(NewRetryStore(primary, testRetryOptions())))
+	assert.Equal(t, "primary", StoreIdentity(NewFailoverReader(primary, secondary)))
+	assert.Equal(t, "primary", StoreIdentity(NewRetryStore(NewFailoverReader(primary, secondary), testRetryOptions())))
+	assert.Equal(t, "", StoreIdentity(&mockBytesReader{}))
+	assert.Equal(t, "", StoreIdentity(nil))
+}
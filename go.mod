@@ -10,7 +10,9 @@ require (
 	github.com/forestrie/go-merklelog-datatrails v0.0.0-00010101000000-000000000000
 	github.com/forestrie/go-merklelog-provider-testing v0.0.0-00010101000000-000000000000
 	github.com/forestrie/go-merklelog/massifs v0.0.2
+	github.com/forestrie/go-merklelog/mmr v0.0.2
 	github.com/stretchr/testify v1.11.1
+	github.com/veraison/go-cose v1.3.0
 )
 
 require (
@@ -41,7 +43,6 @@ require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/dimchansky/utfbom v1.1.1 // indirect
 	github.com/envoyproxy/protoc-gen-validate v1.2.1 // indirect
-	github.com/forestrie/go-merklelog/mmr v0.0.2 // indirect
 	github.com/fxamacker/cbor/v2 v2.7.0 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.8 // indirect
 	github.com/golang-jwt/jwt/v4 v4.5.2 // indirect
@@ -49,7 +50,6 @@ require (
 	github.com/ldclabs/cose/go v0.0.0-20221214142927-d22c1cfc2154 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	github.com/veraison/go-cose v1.3.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	github.com/zeebo/bencode v1.0.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
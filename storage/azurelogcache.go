@@ -1,25 +1,48 @@
 package storage
 
 import (
+	"fmt"
+	"sync"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
-	"github.com/forestrie/go-merklelog-azure/blobs"
 )
 
+// verifiedCheckpoint is a checkpoint verified by CheckpointRead, and the ETag
+// of the object it was decoded from
+type verifiedCheckpoint struct {
+	etag    string
+	checkpt *massifs.Checkpoint
+}
+
 type NativeContexts struct {
 	Massifs     map[uint32]*blobs.LogBlobContext
 	Checkpoints map[uint32]*blobs.LogBlobContext
 }
 
+// LogCache holds the cached state for a single log, the maps are guarded by an
+// internal lock so that it can be shared by any number of handles.
 type LogCache struct {
+	mu sync.RWMutex
+
 	LogID               storage.LogID // The log ID for this cache, used to restore the state
 	LastMassifIndex     uint32        // The last massif index read, used for lazy loading
 	LastCheckpointIndex uint32        // The last checkpoint index read, used for lazy loading
+	MassifHeight        uint8         // The massif height of the log, zero until it is known
 
 	Starts      map[uint32]*massifs.MassifStart // Cache for massif starts
 	Checkpoints map[uint32]*massifs.Checkpoint  // Cache for checkpoints
 
 	Az NativeContexts
+
+	verified *massifs.Checkpoint // The largest checkpoint verified by CheckpointRead
+	// The checkpoints verified by CheckpointRead. These are kept apart from
+	// Checkpoints, which callers may set without verification.
+	verifiedCheckpoints map[uint32]verifiedCheckpoint
+
+	ranges map[uint32]*massifRanges // Sparse ranges read from the massifs
+	blocks map[uint32]*massifBlocks // The blocks last committed for the massifs
 }
 
 func NewLogCache(logID storage.LogID) *LogCache {
@@ -33,5 +56,200 @@ func NewLogCache(logID storage.LogID) *LogCache {
 			Massifs:     make(map[uint32]*blobs.LogBlobContext),
 			Checkpoints: make(map[uint32]*blobs.LogBlobContext),
 		},
+		verifiedCheckpoints: make(map[uint32]verifiedCheckpoint),
+		ranges:              make(map[uint32]*massifRanges),
+		blocks:              make(map[uint32]*massifBlocks),
+	}
+}
+
+// native returns the native context cached for the object type and index
+func (c *LogCache) native(massifIndex uint32, otype storage.ObjectType) (*blobs.LogBlobContext, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var n *blobs.LogBlobContext
+	var ok bool
+
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData:
+		n, ok = c.Az.Massifs[massifIndex]
+	case storage.ObjectCheckpoint:
+		n, ok = c.Az.Checkpoints[massifIndex]
+	default:
+		return nil, false, fmt.Errorf("unsupported object type %v", otype)
+	}
+	return n, ok, nil
+}
+
+// setNative caches the native context for the object type and index
+func (c *LogCache) setNative(massifIndex uint32, native *blobs.LogBlobContext, otype storage.ObjectType) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData:
+		if etagChanged(c.Az.Massifs[massifIndex], native) {
+			delete(c.Starts, massifIndex)
+		}
+		c.Az.Massifs[massifIndex] = native
+	case storage.ObjectCheckpoint:
+		if etagChanged(c.Az.Checkpoints[massifIndex], native) {
+			delete(c.Checkpoints, massifIndex)
+		}
+		c.Az.Checkpoints[massifIndex] = native
+	default:
+		return fmt.Errorf("unsupported object type %v", otype)
+	}
+	return nil
+}
+
+// setHead caches the native context for the last object of the given type and
+// records its index as the head.
+func (c *LogCache) setHead(massifIndex uint32, native *blobs.LogBlobContext, otype storage.ObjectType) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData:
+		if etagChanged(c.Az.Massifs[massifIndex], native) {
+			delete(c.Starts, massifIndex)
+		}
+		c.Az.Massifs[massifIndex] = native
+		c.LastMassifIndex = massifIndex
+	case storage.ObjectCheckpoint:
+		if etagChanged(c.Az.Checkpoints[massifIndex], native) {
+			delete(c.Checkpoints, massifIndex)
+		}
+		c.Az.Checkpoints[massifIndex] = native
+		c.LastCheckpointIndex = massifIndex
+	default:
+		return fmt.Errorf("unsupported object type %v", otype)
+	}
+	return nil
+}
+
+// releaseMassifData drops the cached data for the massif, retaining the other
+// blob details so that the massif can be re-read or replaced.
+func (c *LogCache) releaseMassifData(massifIndex uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.Az.Massifs[massifIndex]
+	if !ok || n == nil || n.Data == nil {
+		return
+	}
+	c.Az.Massifs[massifIndex] = withData(n, nil)
+}
+
+// withData returns a copy of the cached context with the data replaced, readers
+// may hold the cached one.
+func withData(n *blobs.LogBlobContext, data []byte) *blobs.LogBlobContext {
+	updated := *n
+	updated.Data = data
+	return &updated
+}
+
+// lastMassifIndex returns the index of the last massif read, or
+// storage.HeadMassifIndex if the head has not been found
+func (c *LogCache) lastMassifIndex() uint32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.LastMassifIndex
+}
+
+// massifHeight returns the massif height of the log, or zero if it is not known
+func (c *LogCache) massifHeight() uint8 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.MassifHeight
+}
+
+func (c *LogCache) setMassifHeight(massifHeight uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MassifHeight = massifHeight
+}
+
+// start returns the decoded massif start cached for the index
+func (c *LogCache) start(massifIndex uint32) (*massifs.MassifStart, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	start, ok := c.Starts[massifIndex]
+	return start, ok
+}
+
+// setStart caches the decoded massif start for the index. It is dropped when
+// the native context for the massif is replaced with a different ETag.
+func (c *LogCache) setStart(massifIndex uint32, start *massifs.MassifStart) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Starts[massifIndex] = start
+}
+
+// checkpoint returns the decoded checkpoint cached for the index
+func (c *LogCache) checkpoint(massifIndex uint32) (*massifs.Checkpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	checkpt, ok := c.Checkpoints[massifIndex]
+	return checkpt, ok
+}
+
+// setCheckpoint caches the decoded checkpoint for the index. It is dropped
+// when the native context for the checkpoint is replaced with a different
+// ETag.
+func (c *LogCache) setCheckpoint(massifIndex uint32, checkpt *massifs.Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Checkpoints[massifIndex] = checkpt
+}
+
+// checkpointVerified returns the checkpoint verified for the index, provided
+// it was decoded from the object with the etag.
+func (c *LogCache) checkpointVerified(massifIndex uint32, etag string) (*massifs.Checkpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.verifiedCheckpoints[massifIndex]
+	if !ok || etag == "" || v.etag != etag {
+		return nil, false
+	}
+	return v.checkpt, true
+}
+
+// setCheckpointVerified records the checkpoint verified for the index and the
+// etag of the object it was decoded from. Only CheckpointRead sets it, once
+// the checkpoint has been verified.
+func (c *LogCache) setCheckpointVerified(massifIndex uint32, etag string, checkpt *massifs.Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verifiedCheckpoints[massifIndex] = verifiedCheckpoint{etag: etag, checkpt: checkpt}
+}
+
+// releaseCheckpointVerified drops the checkpoint verified for the index, it is
+// verified again when it is next read.
+func (c *LogCache) releaseCheckpointVerified(massifIndex uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.verifiedCheckpoints, massifIndex)
+}
+
+// lastVerifiedCheckpoint returns the largest checkpoint verified for the log
+func (c *LogCache) lastVerifiedCheckpoint() (*massifs.Checkpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.verified, c.verified != nil
+}
+
+func (c *LogCache) setLastVerifiedCheckpoint(checkpt *massifs.Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verified = checkpt
+}
+
+// etagChanged returns true if the decoded objects derived from prev can not be
+// trusted to also describe next
+func etagChanged(prev, next *blobs.LogBlobContext) bool {
+	if prev == nil || next == nil || prev.ETag == "" {
+		return true
 	}
+	return prev.ETag != next.ETag
 }
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"container/list"
+)
+
+// CacheStats reports the effectiveness and the memory use of the store cache
+type CacheStats struct {
+	Hits            uint64 // MassifData and CheckpointData calls satisfied from the cache
+	Misses          uint64 // MassifData and CheckpointData calls that found no cached data
+	ResidentBytes   int64  // The total size of the massif data, and the other per massif state, currently cached
+	ResidentMassifs int    // The number of massif data buffers, and other per massif state, currently cached
+	ResidentLogs    int    // The number of logs currently cached
+	MassifEvictions uint64 // The number of massif data buffers released to meet the budget
+	LogEvictions    uint64 // The number of idle logs dropped to meet the budget
+}
+
+// cacheKind identifies the state cached for a massif which is counted against
+// the budget
+type cacheKind uint8
+
+const (
+	cacheMassifData   cacheKind = iota // The massif data
+	cacheMassifRanges                  // The sparse ranges read from the massif
+	cacheMassifBlocks                  // The blocks last committed for the massif
+	cacheVerified                      // The checkpoint verified for the massif
+)
+
+type massifKey struct {
+	c           *LogCache
+	massifIndex uint32
+	kind        cacheKind
+}
+
+type massifEntry struct {
+	key  massifKey
+	size int64
+}
+
+// cacheLRU tracks the recency of use of the logs and massif data buffers held
+// by a CachingStore, and selects the least recently used for eviction. A log
+// dropped from the cache is detached, the state cached for it is released as
+// soon as it is accounted, until it is attached again by its next use. All
+// access is under the CachingStore lock.
+type cacheLRU struct {
+	maxBytes int64
+	maxLogs  int
+
+	logs        *list.List // *LogCache, most recently used at the front
+	logElems    map[*LogCache]*list.Element
+	massifs     *list.List                                // massifEntry, most recently used at the front
+	massifElems map[*LogCache]map[massifKey]*list.Element // The massif entries of each log
+
+	stats CacheStats
+}
+
+func newCacheLRU(maxBytes int64, maxLogs int) *cacheLRU {
+	return &cacheLRU{
+		maxBytes:    maxBytes,
+		maxLogs:     maxLogs,
+		logs:        list.New(),
+		logElems:    make(map[*LogCache]*list.Element),
+		massifs:     list.New(),
+		massifElems: make(map[*LogCache]map[massifKey]*list.Element),
+	}
+}
+
+// touchLog records a use of the log, and returns the logs which must be dropped
+// to bring the number of logs within budget, and their cached state. The
+// touched and pinned logs are never returned.
+func (l *cacheLRU) touchLog(c *LogCache, pinned *LogCache) ([]*LogCache, []massifKey) {
+	if e, ok := l.logElems[c]; ok {
+		l.logs.MoveToFront(e)
+	} else {
+		l.logElems[c] = l.logs.PushFront(c)
+	}
+
+	var evicted []*LogCache
+	var released []massifKey
+	for e := l.logs.Back(); e != nil && l.maxLogs > 0 && l.logs.Len() > l.maxLogs; {
+		prev := e.Prev()
+		victim := e.Value.(*LogCache)
+		if victim != c && victim != pinned {
+			released = append(released, l.removeLog(victim)...)
+			l.stats.LogEvictions++
+			evicted = append(evicted, victim)
+		}
+		e = prev
+	}
+	if l.maxLogs > 0 || l.maxBytes <= 0 {
+		return evicted, released
+	}
+
+	// With only a byte budget, the logs holding no state are limited to one
+	// more than those which do
+	holding := len(l.massifElems)
+	empty := l.logs.Len() - holding
+	for e := l.logs.Back(); e != nil && empty > holding+1; {
+		prev := e.Prev()
+		victim := e.Value.(*LogCache)
+		if _, ok := l.massifElems[victim]; !ok && victim != c && victim != pinned {
+			l.removeLog(victim)
+			l.stats.LogEvictions++
+			evicted = append(evicted, victim)
+			empty--
+		}
+		e = prev
+	}
+	return evicted, released
+}
+
+// useLog marks the log as the most recently used, if it is tracked
+func (l *cacheLRU) useLog(c *LogCache) {
+	if e, ok := l.logElems[c]; ok {
+		l.logs.MoveToFront(e)
+	}
+}
+
+// removeLog detaches the log, and returns the keys of its cached state, which
+// is no longer accounted and must be released.
+func (l *cacheLRU) removeLog(c *LogCache) []massifKey {
+	if e, ok := l.logElems[c]; ok {
+		l.logs.Remove(e)
+		delete(l.logElems, c)
+	}
+	var released []massifKey
+	for key, e := range l.massifElems[c] {
+		l.removeMassif(e)
+		released = append(released, key)
+	}
+	return released
+}
+
+// touchMassif records a use of the massif state, and its current size, and
+// returns the massif state which must be released to bring the resident bytes
+// within budget.
+func (l *cacheLRU) touchMassif(key massifKey, size int64) []massifKey {
+	if _, ok := l.logElems[key.c]; !ok {
+		return []massifKey{key}
+	}
+	l.useLog(key.c)
+
+	if e, ok := l.massifElems[key.c][key]; ok {
+		entry := e.Value.(massifEntry)
+		l.stats.ResidentBytes += size - entry.size
+		entry.size = size
+		e.Value = entry
+		l.massifs.MoveToFront(e)
+	} else {
+		elems := l.massifElems[key.c]
+		if elems == nil {
+			elems = make(map[massifKey]*list.Element)
+			l.massifElems[key.c] = elems
+		}
+		elems[key] = l.massifs.PushFront(massifEntry{key: key, size: size})
+		l.stats.ResidentBytes += size
+	}
+
+	var evicted []massifKey
+	for l.maxBytes > 0 && l.stats.ResidentBytes > l.maxBytes && l.massifs.Len() > 1 {
+		oldest := l.massifs.Back()
+		victim := oldest.Value.(massifEntry)
+		l.removeMassif(oldest)
+		l.stats.MassifEvictions++
+		evicted = append(evicted, victim.key)
+	}
+	return evicted
+}
+
+// useMassif marks the massif state as the most recently used, if it is tracked
+func (l *cacheLRU) useMassif(key massifKey) {
+	l.useLog(key.c)
+	if e, ok := l.massifElems[key.c][key]; ok {
+		l.massifs.MoveToFront(e)
+	}
+}
+
+// forgetMassif stops accounting the massif state, which has been released
+func (l *cacheLRU) forgetMassif(key massifKey) {
+	if e, ok := l.massifElems[key.c][key]; ok {
+		l.removeMassif(e)
+	}
+}
+
+func (l *cacheLRU) removeMassif(e *list.Element) {
+	entry := e.Value.(massifEntry)
+	l.massifs.Remove(e)
+	if elems := l.massifElems[entry.key.c]; len(elems) > 1 {
+		delete(elems, entry.key)
+	} else {
+		delete(l.massifElems, entry.key.c)
+	}
+	l.stats.ResidentBytes -= entry.size
+}
+
+func (l *cacheLRU) snapshot() CacheStats {
+	stats := l.stats
+	stats.ResidentMassifs = l.massifs.Len()
+	stats.ResidentLogs = l.logs.Len()
+	return stats
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingStore_MaxCacheBytes(t *testing.T) {
+	// start header + 100 bytes per massif, and a budget for two and a half massifs
+	const massifSize = massifs.StartHeaderSize + 100
+
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, MaxCacheBytes: massifSize*2 + massifSize/2}, 3)
+	require.NoError(t, err)
+
+	logID := newTestLogID()
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+
+	for i := range uint32(3) {
+		require.NoError(t, r.Put(t.Context(), i, storage.ObjectMassifData, newTestMassif(3, i, make([]byte, 100)...), true))
+	}
+	for i := range uint32(3) {
+		_, err = r.MassifReadN(t.Context(), i, -1)
+		require.NoError(t, err)
+	}
+
+	stats := r.Stats()
+	assert.Equal(t, int64(massifSize*2), stats.ResidentBytes)
+	assert.Equal(t, 2, stats.ResidentMassifs)
+	assert.Equal(t, uint64(1), stats.MassifEvictions)
+
+	// The least recently used massif data was released, but its blob details are retained
+	data, ok, err := r.MassifData(0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, data)
+	n, ok, err := r.Native(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotEmpty(t, n.ETag)
+
+	data, ok, err = r.MassifData(2)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, data, massifSize)
+
+	stats = r.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	// touching massif 1 makes massif 2 the next to go
+	_, _, err = r.MassifData(1)
+	require.NoError(t, err)
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	data, _, err = r.MassifData(2)
+	require.NoError(t, err)
+	assert.Nil(t, data)
+	data, _, err = r.MassifData(1)
+	require.NoError(t, err)
+	assert.Len(t, data, massifSize)
+}
+
+func TestCachingStore_MaxCacheLogs(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, MaxCacheLogs: 2}, 3)
+	require.NoError(t, err)
+
+	selected := newTestLogID()
+	require.NoError(t, r.SelectLog(t.Context(), selected))
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	a, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	b, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+
+	// the selected log is the least recently used, but it is never evicted
+	stats := r.Stats()
+	assert.Equal(t, 2, stats.ResidentLogs)
+	assert.Equal(t, uint64(1), stats.LogEvictions)
+	assert.Contains(t, r.LogCache, string(selected))
+	assert.NotContains(t, r.LogCache, string(a.LogID()))
+	assert.Contains(t, r.LogCache, string(b.LogID()))
+	assert.Equal(t, int64(massifs.StartHeaderSize), stats.ResidentBytes)
+
+	// using the handle of the evicted log attaches it again, and what it reads
+	// is cached
+	require.NoError(t, a.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	_, err = a.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	_, ok, err := a.MassifData(0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, r.LogCache, string(a.LogID()))
+	assert.NotContains(t, r.LogCache, string(b.LogID()))
+
+	// dropping a log releases its accounted data
+	r.DropLog(selected)
+	stats = r.Stats()
+	assert.Equal(t, 1, stats.ResidentLogs)
+	assert.Equal(t, int64(0), stats.ResidentBytes)
+}
+
+func TestCachingStore_MaxCacheLogs_handles(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, MaxCacheLogs: 2}, 3)
+	require.NoError(t, err)
+
+	a, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	b, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+
+	// a handle in use keeps its log from being evicted as idle
+	_, _, err = a.MassifData(0)
+	require.NoError(t, err)
+	_, err = r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	assert.Contains(t, r.LogCache, string(a.LogID()))
+	assert.NotContains(t, r.LogCache, string(b.LogID()))
+
+	// the data of a massif which is written over is released, not left
+	// accounted with no size
+	require.NoError(t, a.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	_, err = a.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.Stats().ResidentMassifs)
+	require.NoError(t, a.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0, 1), false))
+	stats := r.Stats()
+	assert.Equal(t, 0, stats.ResidentMassifs)
+	assert.Equal(t, int64(0), stats.ResidentBytes)
+}
+
+func TestCachingStore_MaxCacheBytes_logs(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, MaxCacheBytes: 1024}, 3)
+	require.NoError(t, err)
+
+	selected := newTestLogID()
+	require.NoError(t, r.SelectLog(t.Context(), selected))
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// the logs holding no state are limited to one more than those which do
+	a, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	b, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	_, err = r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	stats := r.Stats()
+	assert.Equal(t, 3, stats.ResidentLogs)
+	assert.Equal(t, uint64(1), stats.LogEvictions)
+	assert.NotContains(t, r.LogCache, string(a.LogID()))
+
+	// the evicted log is attached again, rather than replaced, when it is
+	// next obtained, and what its handles read is cached again
+	again, err := r.Log(t.Context(), a.LogID())
+	require.NoError(t, err)
+	assert.Same(t, a.Cache(), again.Cache())
+	assert.Contains(t, r.LogCache, string(a.LogID()))
+	assert.NotContains(t, r.LogCache, string(b.LogID()))
+	require.NoError(t, a.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	_, err = a.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	_, ok, err := a.MassifData(0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// a dropped log is replaced
+	r.DropLog(a.LogID())
+	again, err = r.Log(t.Context(), a.LogID())
+	require.NoError(t, err)
+	assert.NotSame(t, a.Cache(), again.Cache())
+}
+
+func TestCachingStore_MaxCacheBytes_state(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+
+	// the blocks committed for a massif are counted
+	w, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true}, 3)
+	require.NoError(t, err)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc := putTestMassifs(t, w, 1)
+	n, ok, err := w.Native(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	require.True(t, ok)
+	mb, ok := w.Selected.massifBlocks(0, n.ETag)
+	require.True(t, ok)
+	stats := w.Stats()
+	assert.Equal(t, 1, stats.ResidentMassifs)
+	assert.Equal(t, mb.size(), stats.ResidentBytes)
+
+	data := newTestSignedCheckpoint(t, key, "key-1", &mc, 7)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectCheckpoint, data, true))
+
+	// the verified checkpoints are counted, and released to meet the budget
+	r, err := NewStore(t.Context(), Options{
+		Store:          store,
+		CheckpointKeys: CheckpointKeySet{Logs: map[string]crypto.PublicKey{string(logID): &key.PublicKey}},
+		MaxCacheBytes:  int64(len(data)),
+	}, 3)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	stats = r.Stats()
+	assert.Equal(t, 1, stats.ResidentMassifs)
+	assert.Equal(t, int64(len(data)), stats.ResidentBytes)
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	stats = r.Stats()
+	assert.Equal(t, 1, stats.ResidentMassifs)
+	assert.Positive(t, stats.MassifEvictions)
+
+	n, ok, err = r.Native(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, ok = r.Selected.checkpointVerified(0, n.ETag)
+	assert.False(t, ok)
+	// the reference for the consistency checks is kept with the log
+	_, ok = r.Selected.lastVerifiedCheckpoint()
+	assert.True(t, ok)
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/forestrie/go-merklelog/mmr"
+)
+
+var ErrEquivocation = errors.New("the log has signed checkpoints which are not consistent")
+
+// EquivocationError is returned by CheckpointRead when a verified checkpoint
+// is not consistent with the checkpoint previously verified for the log. Both
+// are correctly signed, so the log has forked, or the store has been tampered
+// with. errors.Is(err, ErrEquivocation) is true for it.
+type EquivocationError struct {
+	LogID    storage.LogID
+	Previous massifs.MMRState // The earlier of the two states
+	Current  massifs.MMRState
+	Err      error // The error from the consistency check
+}
+
+func (e *EquivocationError) Error() string {
+	return fmt.Sprintf("%v: log %x, mmr size %d to %d: %v",
+		ErrEquivocation, []byte(e.LogID), e.Previous.MMRSize, e.Current.MMRSize, e.Err)
+}
+
+func (e *EquivocationError) Unwrap() []error {
+	return []error{ErrEquivocation, e.Err}
+}
+
+// checkCheckpointConsistency checks the newly verified checkpoint is
+// consistent with the last checkpoint verified for the log, using a
+// consistency proof between their sizes. The nodes for the proof are read
+// through the store. The larger of the two is remembered for the next check.
+func (r *CachingStore) checkCheckpointConsistency(
+	ctx context.Context, c *LogCache, checkpt *massifs.Checkpoint,
+) error {
+	prev, ok := c.lastVerifiedCheckpoint()
+	if !ok {
+		c.setLastVerifiedCheckpoint(checkpt)
+		return nil
+	}
+	from, to := prev.MMRState, checkpt.MMRState
+	if from.MMRSize > to.MMRSize {
+		from, to = to, from
+	}
+
+	getter := &massifNodeGetter{ctx: ctx, r: r, c: c}
+	cp, err := mmr.IndexConsistencyProof(getter, from.MMRSize-1, to.MMRSize-1)
+	if err != nil {
+		return fmt.Errorf("failed to read the consistency proof from %d to %d: %w", from.MMRSize, to.MMRSize, err)
+	}
+	if ok, _, err = mmr.VerifyConsistency(sha256.New(), cp, from.Peaks, to.Peaks); !ok {
+		if err == nil {
+			err = mmr.ErrConsistencyCheck
+		}
+		return &EquivocationError{LogID: c.LogID, Previous: from, Current: to, Err: err}
+	}
+	if checkpt.MMRState.MMRSize > prev.MMRState.MMRSize {
+		c.setLastVerifiedCheckpoint(checkpt)
+	}
+	return nil
+}
+
+// massifNodeGetter reads mmr nodes from the massifs of the log, reading or
+// refreshing the massifs through the store as needed.
+type massifNodeGetter struct {
+	ctx context.Context
+	r   *CachingStore
+	c   *LogCache
+}
+
+func (g *massifNodeGetter) Get(i uint64) ([]byte, error) {
+	massifIndex := uint32(massifs.MassifIndexFromMMRIndex(g.r.logMassifHeight(g.c), i))
+	mc, err := g.r.verifyMassifContext(g.ctx, g.c, massifIndex, i+1)
+	if err != nil {
+		return nil, err
+	}
+	return mc.Get(i)
+}
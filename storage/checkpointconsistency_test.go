@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingStore_CheckpointRead_consistency(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys := CheckpointKeySet{KIDs: map[string]crypto.PublicKey{"key-1": &key.PublicKey}}
+
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 3)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc := putTestMassifs(t, w, 2)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectCheckpoint, newTestSignedCheckpoint(t, key, "key-1", &mc, 7), true))
+	require.NoError(t, w.Put(t.Context(), 1, storage.ObjectCheckpoint, newTestSignedCheckpoint(t, key, "key-1", &mc, 15), true))
+
+	t.Run("consistent", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, keys)
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 1)
+		require.NoError(t, err)
+		// the older checkpoint is checked against the newer one
+		_, err = r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+
+		checkpt, ok := r.Selected.lastVerifiedCheckpoint()
+		require.True(t, ok)
+		assert.Equal(t, uint64(15), checkpt.MMRState.MMRSize)
+	})
+
+	t.Run("forked", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, keys)
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+
+		// the log is re-written from the first leaf, and signed again
+		fork, err := massifs.CreateFirstMassifContext(t.Context(), 1, 3)
+		require.NoError(t, err)
+		value := sha256.Sum256([]byte("fork"))
+		_, err = fork.AddHashedLeaf(sha256.New(), 1, nil, []byte("log"), []byte("app"), value[:])
+		require.NoError(t, err)
+		massifPaths := make([]string, 2)
+		for i := range massifPaths {
+			massifPaths[i], err = r.ObjectPath(uint32(i), storage.ObjectMassifData)
+			require.NoError(t, err)
+		}
+		store.setBlob(massifPaths[0], addTestLeaves(t, &fork, 3))
+		require.NoError(t, fork.StartNextMassif())
+		require.NoError(t, fork.CreatePeakStackMap())
+		store.setBlob(massifPaths[1], addTestLeaves(t, &fork, 4))
+		storagePath, err := r.ObjectPath(1, storage.ObjectCheckpoint)
+		require.NoError(t, err)
+		store.setBlob(storagePath, newTestSignedCheckpoint(t, key, "key-1", &fork, 15))
+
+		_, err = r.CheckpointRead(t.Context(), 1)
+		var equivocation *EquivocationError
+		require.ErrorAs(t, err, &equivocation)
+		assert.ErrorIs(t, err, ErrEquivocation)
+		assert.Equal(t, uint64(7), equivocation.Previous.MMRSize)
+		assert.Equal(t, uint64(15), equivocation.Current.MMRSize)
+
+		_, ok, err := r.Checkpoint(1)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
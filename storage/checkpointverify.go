@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	commoncose "github.com/forestrie/go-merklelog/massifs/cose"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/veraison/go-cose"
+)
+
+var ErrCheckpointKeyNotFound = errors.New("no key is known for the checkpoint signer")
+
+// CheckpointKeyResolver provides the public keys trusted to sign the
+// checkpoints of each log. The kid is the key identifier from the checkpoint
+// protected header, or its cwt confirmation key, and may be empty.
+// Implementations return ErrCheckpointKeyNotFound if no key is trusted.
+type CheckpointKeyResolver interface {
+	CheckpointKey(ctx context.Context, logID storage.LogID, kid string) (crypto.PublicKey, error)
+}
+
+// CheckpointKeySet is a fixed set of trusted checkpoint keys. A key
+// registered for the log is used in preference to a key registered for the
+// kid.
+type CheckpointKeySet struct {
+	Logs map[string]crypto.PublicKey // Keyed by string(logID)
+	KIDs map[string]crypto.PublicKey
+}
+
+func (s CheckpointKeySet) CheckpointKey(_ context.Context, logID storage.LogID, kid string) (crypto.PublicKey, error) {
+	if key, ok := s.Logs[string(logID)]; ok {
+		return key, nil
+	}
+	if key, ok := s.KIDs[kid]; ok && kid != "" {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: log %x, kid %q", ErrCheckpointKeyNotFound, []byte(logID), kid)
+}
+
+// checkpointKID returns the key identifier of the checkpoint signer, or the
+// empty string if the checkpoint does not identify one.
+func checkpointKID(msg *commoncose.CoseSign1Message) string {
+	if kid, err := msg.KidFromProtectedHeader(); err == nil {
+		return kid
+	}
+	claims, err := msg.CWTClaimsFromProtectedHeader()
+	if err != nil || claims.ConfirmationMethod == nil {
+		return ""
+	}
+	return string(claims.ConfirmationMethod.KeyID())
+}
+
+// checkpointVerifier returns a verifier for the checkpoint using key. The
+// algorithm is taken from the protected header, checkpoints which do not
+// include it are assumed to use the algorithm matching the ecdsa key curve.
+func checkpointVerifier(msg *commoncose.CoseSign1Message, key crypto.PublicKey) (cose.Verifier, error) {
+	alg, err := msg.Headers.Protected.Algorithm()
+	if err != nil {
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, err
+		}
+		if alg, err = commoncose.CoseAlgForEC(*ecKey); err != nil {
+			return nil, err
+		}
+	}
+	return cose.NewVerifier(alg, key)
+}
+
+// verifyCheckpoint decodes the checkpoint and verifies its signature over the
+// peaks of the massif it was read for. The massif is read, or refreshed, if
+// the cached data does not include all of the checkpointed state.
+func (r *CachingStore) verifyCheckpoint(
+	ctx context.Context, c *LogCache, massifIndex uint32, data []byte,
+) (*massifs.Checkpoint, error) {
+	msg, state, err := massifs.DecodeSignedRoot(*r.codec, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint for massif %d: %w", massifIndex, err)
+	}
+	key, err := r.checkpointKeys.CheckpointKey(ctx, c.LogID, checkpointKID(msg))
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := checkpointVerifier(msg, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: massif %d: %v", massifs.ErrSealVerifyFailed, massifIndex, err)
+	}
+
+	mc, err := r.verifyMassifContext(ctx, c, massifIndex, state.MMRSize)
+	if err != nil {
+		return nil, err
+	}
+	vc, err := mc.VerifyContext(ctx, massifs.VerifyOptions{
+		Check:        &massifs.Checkpoint{Sign1Message: *msg, MMRState: state},
+		CBORCodec:    r.codec,
+		COSEVerifier: verifier,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &massifs.Checkpoint{Sign1Message: vc.Sign1Message, MMRState: vc.MMRState}, nil
+}
+
+// verifyMassifContext returns a context for the massif which includes at
+// least mmrSize nodes, if the store has them.
+func (r *CachingStore) verifyMassifContext(
+	ctx context.Context, c *LogCache, massifIndex uint32, mmrSize uint64,
+) (*massifs.MassifContext, error) {
+	mc := &massifs.MassifContext{}
+	data, ok, err := r.massifData(c, massifIndex)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		mc.Data = data
+		ok = mc.Start.UnmarshalBinary(data) == nil &&
+			uint64(len(data)) >= mc.LogStart() && mc.RangeCount() >= mmrSize
+	}
+	if !ok {
+		if data, err = r.massifRefresh(ctx, c, massifIndex); err != nil {
+			return nil, err
+		}
+		mc.Data = data
+		if err = mc.Start.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed to decode start for massif %d: %w", massifIndex, err)
+		}
+	}
+	if err = mc.CreatePeakStackMap(); err != nil {
+		return nil, err
+	}
+	return mc, nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	commoncose "github.com/forestrie/go-merklelog/massifs/cose"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSignedCheckpoint signs a checkpoint for the first mmrSize nodes of
+// the massif, which must have a single peak.
+func newTestSignedCheckpoint(
+	t *testing.T, key *ecdsa.PrivateKey, kid string, mc *massifs.MassifContext, mmrSize uint64,
+) []byte {
+	t.Helper()
+	peak, err := mc.Get(mmrSize - 1)
+	require.NoError(t, err)
+	codec, err := massifs.NewCBORCodec()
+	require.NoError(t, err)
+	state := massifs.MMRState{
+		Version:     int(massifs.MMRStateVersion2),
+		MMRSize:     mmrSize,
+		Peaks:       [][]byte{peak},
+		IDTimestamp: mc.GetLastIDTimestamp(),
+	}
+	signer := massifs.NewRootSigner("https://example.com/issuer", codec)
+	data, err := signer.Sign1(commoncose.NewTestCoseSigner(t, *key), kid, &key.PublicKey, "test", state, nil)
+	require.NoError(t, err)
+	return data
+}
+
+func newTestCheckpointKeyStore(t *testing.T, store *testBlobStore, keys CheckpointKeyResolver) *CachingStore {
+	t.Helper()
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, CheckpointKeys: keys}, 3)
+	require.NoError(t, err)
+	return r
+}
+
+func TestCachingStore_CheckpointRead_verify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 3)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc := putTestMassifs(t, w, 1)
+	data := newTestSignedCheckpoint(t, key, "key-1", &mc, 7)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectCheckpoint, data, true))
+
+	t.Run("by log", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, CheckpointKeySet{
+			Logs: map[string]crypto.PublicKey{string(logID): &key.PublicKey},
+		})
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		got, err := r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		checkpt, ok, err := r.Checkpoint(0)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, uint64(7), checkpt.MMRState.MMRSize)
+		assert.Len(t, checkpt.MMRState.Peaks, 1)
+
+		// unchanged, it is not verified again
+		reads := store.readCount
+		_, err = r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+		assert.Equal(t, reads+1, store.readCount)
+	})
+
+	t.Run("cached without verification", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, CheckpointKeySet{
+			Logs: map[string]crypto.PublicKey{string(logID): &key.PublicKey},
+		})
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+
+		// a checkpoint set by the caller is not taken as verified, though the
+		// object is unchanged
+		require.NoError(t, r.SetCheckpoint(0, &massifs.Checkpoint{MMRState: massifs.MMRState{MMRSize: 3}}))
+		_, err = r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+		checkpt, ok, err := r.Checkpoint(0)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, uint64(7), checkpt.MMRState.MMRSize)
+	})
+
+	t.Run("by kid", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, CheckpointKeySet{
+			KIDs: map[string]crypto.PublicKey{"key-1": &key.PublicKey},
+		})
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 0)
+		require.NoError(t, err)
+		_, ok, err := r.Checkpoint(0)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, CheckpointKeySet{
+			Logs: map[string]crypto.PublicKey{string(logID): &other.PublicKey},
+		})
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 0)
+		assert.ErrorIs(t, err, massifs.ErrSealVerifyFailed)
+		_, ok, err := r.Checkpoint(0)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		_, ok, err = r.CheckpointData(0)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		r := newTestCheckpointKeyStore(t, store, CheckpointKeySet{
+			KIDs: map[string]crypto.PublicKey{"key-2": &key.PublicKey},
+		})
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.CheckpointRead(t.Context(), 0)
+		assert.ErrorIs(t, err, ErrCheckpointKeyNotFound)
+	})
+}
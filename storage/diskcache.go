@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+)
+
+const (
+	diskCacheExt   = ".blob"
+	diskCacheMagic = "mlblob01"
+)
+
+var ErrDiskCacheCorrupt = errors.New("disk cache entry is corrupt")
+
+// DiskCache is a persistent, local, cache of massif and checkpoint blobs, see
+// Options.DiskCache. Each blob is kept in a single file, keyed by the store
+// identity and the blob path, with a sha256 of its content which is checked
+// when it is loaded.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // *diskEntry, most recently used at the front
+	elems map[string]*list.Element
+}
+
+type diskEntry struct {
+	name string // The file name, derived from the store and the blob path
+	size int64
+}
+
+// diskEntryHeader precedes the blob content in each entry file
+type diskEntryHeader struct {
+	Store        string            `json:"store,omitempty"`
+	BlobPath     string            `json:"path"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"lastModified"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	SHA256       []byte            `json:"sha256"`
+}
+
+// NewDiskCache opens, or creates, the cache in dir. The total size of the
+// cached blobs is limited to maxBytes, which must be positive.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("the disk cache size must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &DiskCache{dir: dir, maxBytes: maxBytes, lru: list.New(), elems: map[string]*list.Element{}}
+
+	// Recover the entries from a previous process, the most recently modified
+	// are considered the most recently used.
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		diskEntry
+		modTime time.Time
+	}
+	var found []existing
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(de.Name(), diskCacheExt) {
+			// Left by a write which did not complete
+			if strings.HasSuffix(de.Name(), ".tmp") {
+				_ = os.Remove(filepath.Join(dir, de.Name()))
+			}
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{diskEntry{name: de.Name(), size: info.Size()}, info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b existing) int { return a.modTime.Compare(b.modTime) })
+	for _, e := range found {
+		entry := e.diskEntry
+		d.elems[entry.name] = d.lru.PushFront(&entry)
+		d.size += entry.size
+	}
+	d.evict()
+	return d, nil
+}
+
+// Size returns the total size of the cache entries
+func (d *DiskCache) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+func diskCacheName(store, blobPath string) string {
+	sum := sha256.Sum256([]byte(store + "\x00" + blobPath))
+	return hex.EncodeToString(sum[:]) + diskCacheExt
+}
+
+// get returns the blob cached for the store and path, checking its integrity. The
+// returned context is not shared, the caller may modify it.
+//
+// The lock guards only the LRU bookkeeping, the entry file is read without
+// it. Entry files are replaced by rename, so a concurrent put is seen either
+// before or after it completes.
+func (d *DiskCache) get(store, blobPath string) (*blobs.LogBlobContext, bool) {
+	name := diskCacheName(store, blobPath)
+
+	d.mu.Lock()
+	e, ok := d.elems[name]
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	content, err := os.ReadFile(filepath.Join(d.dir, name))
+	var bc *blobs.LogBlobContext
+	if err == nil {
+		bc, err = decodeDiskEntry(store, blobPath, content)
+	}
+
+	d.mu.Lock()
+	// The entry may have been evicted, or replaced, while it was read
+	current, ok := d.elems[name]
+	if err != nil {
+		if ok && current == e {
+			d.removeEntry(e)
+		}
+		d.mu.Unlock()
+		return nil, false
+	}
+	if ok {
+		d.lru.MoveToFront(current)
+	}
+	d.mu.Unlock()
+
+	now := time.Now()
+	_ = os.Chtimes(filepath.Join(d.dir, name), now, now)
+	return bc, true
+}
+
+// put caches the data of the context read from the store. The cache is best effort, an entry
+// which can't be written is simply not cached. The entry file is written
+// without the lock, and renamed into place with it.
+func (d *DiskCache) put(store string, bc *blobs.LogBlobContext) error {
+	content, err := encodeDiskEntry(store, bc)
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > d.maxBytes {
+		return nil
+	}
+	name := diskCacheName(store, bc.BlobPath)
+
+	f, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err = os.Rename(f.Name(), filepath.Join(d.dir, name)); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if e, ok := d.elems[name]; ok {
+		entry := e.Value.(*diskEntry)
+		d.size += int64(len(content)) - entry.size
+		entry.size = int64(len(content))
+		d.lru.MoveToFront(e)
+	} else {
+		d.elems[name] = d.lru.PushFront(&diskEntry{name: name, size: int64(len(content))})
+		d.size += int64(len(content))
+	}
+	d.evict()
+	return nil
+}
+
+// evict removes the least recently used entries until the cache is within
+// its size cap. The caller must hold the lock.
+func (d *DiskCache) evict() {
+	for d.size > d.maxBytes {
+		e := d.lru.Back()
+		if e == nil {
+			return
+		}
+		d.removeEntry(e)
+	}
+}
+
+// remove deletes the blob cached for the store and path, if there is one
+func (d *DiskCache) remove(store, blobPath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.elems[diskCacheName(store, blobPath)]; ok {
+		d.removeEntry(e)
+	}
+}
+
+// removeEntry deletes the entry. The caller must hold the lock.
+//
+// The entry is forgotten even if its file can't be removed, otherwise evict
+// would select it again indefinitely. A file left behind is picked up again
+// by the next NewDiskCache for the directory.
+func (d *DiskCache) removeEntry(e *list.Element) {
+	entry := e.Value.(*diskEntry)
+	_ = os.Remove(filepath.Join(d.dir, entry.name))
+	d.lru.Remove(e)
+	delete(d.elems, entry.name)
+	d.size -= entry.size
+}
+
+// encodeDiskEntry encodes the context as the magic, the length of the header,
+// the header, and the data.
+func encodeDiskEntry(store string, bc *blobs.LogBlobContext) ([]byte, error) {
+	sum := sha256.Sum256(bc.Data)
+	header, err := json.Marshal(diskEntryHeader{
+		Store:        store,
+		BlobPath:     bc.BlobPath,
+		ETag:         bc.ETag,
+		LastModified: bc.LastModified,
+		Tags:         bc.Tags,
+		SHA256:       sum[:],
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, 0, len(diskCacheMagic)+4+len(header)+len(bc.Data))
+	content = append(content, diskCacheMagic...)
+	content = binary.BigEndian.AppendUint32(content, uint32(len(header)))
+	content = append(content, header...)
+	return append(content, bc.Data...), nil
+}
+
+func decodeDiskEntry(store, blobPath string, content []byte) (*blobs.LogBlobContext, error) {
+	if len(content) < len(diskCacheMagic)+4 || string(content[:len(diskCacheMagic)]) != diskCacheMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrDiskCacheCorrupt)
+	}
+	content = content[len(diskCacheMagic):]
+	headerLen := int(binary.BigEndian.Uint32(content))
+	content = content[4:]
+	if headerLen > len(content) {
+		return nil, fmt.Errorf("%w: truncated header", ErrDiskCacheCorrupt)
+	}
+	var header diskEntryHeader
+	if err := json.Unmarshal(content[:headerLen], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiskCacheCorrupt, err)
+	}
+	if header.Store != store || header.BlobPath != blobPath {
+		return nil, fmt.Errorf("%w: entry is for %s %s", ErrDiskCacheCorrupt, header.Store, header.BlobPath)
+	}
+	data := content[headerLen:]
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], header.SHA256) {
+		return nil, fmt.Errorf("%w: content hash mismatch", ErrDiskCacheCorrupt)
+	}
+	return &blobs.LogBlobContext{
+		BlobPath:      blobPath,
+		ETag:          header.ETag,
+		Tags:          header.Tags,
+		LastModified:  header.LastModified,
+		Data:          data,
+		ContentLength: int64(len(data)),
+	}, nil
+}
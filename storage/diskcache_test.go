@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDiskCacheTestStore(t *testing.T, store *testBlobStore, dir string, logID storage.LogID) *CachingStore {
+	t.Helper()
+	if store.name == "" {
+		store.name = "https://mock.blob.core.windows.net/merklelogs"
+	}
+	d, err := NewDiskCache(dir, 1<<20)
+	require.NoError(t, err)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, DiskCache: d}, 3)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	return r
+}
+
+func TestCachingStore_DiskCache_massifs(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	dir := t.TempDir()
+
+	r := newDiskCacheTestStore(t, store, dir, logID)
+	mc := putTestMassifs(t, r, 3)
+	complete := slices.Clone(mc.Data)
+	require.NoError(t, mc.StartNextMassif())
+	require.NoError(t, mc.CreatePeakStackMap())
+	require.NoError(t, r.Put(t.Context(), 3, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	headPath, err := r.ObjectPath(3, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	for i := range uint32(4) {
+		_, err := r.MassifReadN(t.Context(), i, -1)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 4, store.readCount)
+
+	// after a restart, the complete massifs are read from disk, and the head
+	// is revalidated with a conditional request
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	got, err := r.MassifReadN(t.Context(), 2, -1)
+	require.NoError(t, err)
+	assert.Equal(t, complete, got)
+	got, err = r.MassifReadN(t.Context(), 2, massifs.StartHeaderSize)
+	require.NoError(t, err)
+	assert.Equal(t, complete[:massifs.StartHeaderSize], got)
+	start, ok, err := r.Start(2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, uint32(2), start.MassifIndex)
+	assert.Equal(t, 4, store.readCount)
+	assert.Equal(t, 0, store.rangeCount)
+
+	got, err = r.MassifReadN(t.Context(), 3, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 4, store.readCount)
+	assert.Equal(t, 1, store.rangeCount)
+
+	// the head has grown, the refreshed data is cached on disk
+	store.setBlob(headPath, addTestLeaves(t, &mc, 1))
+	got, err = r.MassifReadN(t.Context(), 3, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	got, err = r.MassifReadN(t.Context(), 3, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 4, store.readCount)
+}
+
+func TestCachingStore_DiskCache_corrupt(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	dir := t.TempDir()
+
+	r := newDiskCacheTestStore(t, store, dir, logID)
+	mc := putTestMassifs(t, r, 1)
+	_, err := r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.readCount)
+
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	fileName := filepath.Join(dir, diskCacheName(blobs.StoreIdentity(store), storagePath))
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	content[len(content)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(fileName, content, 0o644))
+
+	// the corrupt entry is discarded and the massif is read from the store
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	got, err := r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 2, store.readCount)
+
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, store.readCount)
+}
+
+func TestCachingStore_DiskCache_checkpoint(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	dir := t.TempDir()
+
+	r := newDiskCacheTestStore(t, store, dir, logID)
+	data := newTestCheckpoint(t, massifs.MMRState{MMRSize: 7})
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectCheckpoint, data, true))
+	_, err := r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+
+	// the checkpoint is unchanged, it is revalidated but not transferred
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	got, err := r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	native, ok, err := r.Native(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.NotEmpty(t, native.ETag)
+	assert.NotEmpty(t, native.Tags)
+
+	storagePath, err := r.ObjectPath(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	data = newTestCheckpoint(t, massifs.MMRState{MMRSize: 11})
+	store.setBlob(storagePath, data)
+	r = newDiskCacheTestStore(t, store, dir, logID)
+	got, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestCachingStore_DiskCache_stores(t *testing.T) {
+	logID := newTestLogID()
+	dir := t.TempDir()
+
+	// the same log path in two accounts, sharing the disk cache
+	storeA, storeB := newTestBlobStore(t), newTestBlobStore(t)
+	storeA.name, storeB.name = "https://a.blob.core.windows.net/merklelogs", "https://b.blob.core.windows.net/merklelogs"
+	a := newDiskCacheTestStore(t, storeA, dir, logID)
+	putTestMassifs(t, a, 1)
+	b := newDiskCacheTestStore(t, storeB, dir, logID)
+	mc := putTestMassifs(t, b, 1)
+
+	_, err := a.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, storeA.readCount)
+
+	// the entry for the first store is not used for the second
+	got, err := b.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 1, storeB.readCount)
+
+	// each store finds its own entry after a restart
+	a = newDiskCacheTestStore(t, storeA, dir, logID)
+	_, err = a.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	b = newDiskCacheTestStore(t, storeB, dir, logID)
+	_, err = b.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, storeA.readCount)
+	assert.Equal(t, 1, storeB.readCount)
+}
+
+func TestCachingStore_DiskCache_unidentified(t *testing.T) {
+	d, err := NewDiskCache(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+
+	// a store without an identity would share the entries of every other
+	store := newTestBlobStore(t)
+	_, err = NewStore(t.Context(), Options{Store: store, StoreWriter: store, DiskCache: d}, 3)
+	assert.Error(t, err)
+
+	store.name = "https://mock.blob.core.windows.net/merklelogs"
+	_, err = NewStore(t.Context(), Options{Store: store, StoreWriter: store, DiskCache: d}, 3)
+	assert.NoError(t, err)
+}
+
+func TestDiskCache_evict(t *testing.T) {
+	dir := t.TempDir()
+	blob := func(name string) *blobs.LogBlobContext {
+		return &blobs.LogBlobContext{BlobPath: name, ETag: "etag-" + name, Data: make([]byte, 400)}
+	}
+	d, err := NewDiskCache(dir, 1500)
+	require.NoError(t, err)
+	require.NoError(t, d.put("", blob("a")))
+	require.NoError(t, d.put("", blob("b")))
+	_, ok := d.get("", "a")
+	require.True(t, ok)
+
+	// b is the least recently used
+	require.NoError(t, d.put("", blob("c")))
+	assert.LessOrEqual(t, d.Size(), int64(1500))
+	_, ok = d.get("", "b")
+	assert.False(t, ok)
+	bc, ok := d.get("", "a")
+	require.True(t, ok)
+	assert.Equal(t, "etag-a", bc.ETag)
+
+	// the entries are recovered on restart
+	d, err = NewDiskCache(dir, 1500)
+	require.NoError(t, err)
+	_, ok = d.get("", "c")
+	assert.True(t, ok)
+
+	// larger than the cache, not cached
+	require.NoError(t, d.put("", &blobs.LogBlobContext{BlobPath: "d", Data: make([]byte, 2000)}))
+	_, ok = d.get("", "d")
+	assert.False(t, ok)
+
+	_, err = NewDiskCache(dir, 0)
+	assert.Error(t, err)
+}
+
+func TestDiskCache_evictUndeletable(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, 1000)
+	require.NoError(t, err)
+	require.NoError(t, d.put("", &blobs.LogBlobContext{BlobPath: "a", Data: make([]byte, 400)}))
+
+	// replace the entry file with a non empty directory, which can't be
+	// removed, even by root
+	name := filepath.Join(dir, diskCacheName("", "a"))
+	require.NoError(t, os.Remove(name))
+	require.NoError(t, os.MkdirAll(filepath.Join(name, "pinned"), 0o755))
+
+	// a is evicted, though its file remains
+	require.NoError(t, d.put("", &blobs.LogBlobContext{BlobPath: "b", Data: make([]byte, 400)}))
+	assert.LessOrEqual(t, d.Size(), int64(1000))
+	_, ok := d.get("", "a")
+	assert.False(t, ok)
+	_, ok = d.get("", "b")
+	assert.True(t, ok)
+	assert.DirExists(t, name)
+}
+
+func TestDiskCache_concurrent(t *testing.T) {
+	d, err := NewDiskCache(t.TempDir(), 4000)
+	require.NoError(t, err)
+
+	// the writers replace and evict the entries while they are read
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				name := fmt.Sprintf("blob-%d", j%4)
+				if i%2 == 0 {
+					etag := fmt.Sprintf("%d-%d", i, j)
+					assert.NoError(t, d.put("", &blobs.LogBlobContext{BlobPath: name, ETag: etag, Data: []byte(etag)}))
+					continue
+				}
+				if bc, ok := d.get("", name); ok {
+					assert.Equal(t, bc.ETag, string(bc.Data))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, d.Size(), int64(4000))
+}
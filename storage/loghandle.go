@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// LogHandle provides the object reader and writer methods for a single log,
+// using a shared CachingStore. Obtain one using CachingStore.Log.
+type LogHandle struct {
+	store *CachingStore
+	cache *LogCache
+}
+
+// LogID returns the id of the log the handle is bound to
+func (h *LogHandle) LogID() storage.LogID {
+	return h.cache.LogID
+}
+
+// Cache returns the log cache shared by all handles for this log
+func (h *LogHandle) Cache() *LogCache {
+	return h.cache
+}
+
+// log records the use of the log, so that it is not evicted as idle while
+// the handle is in use, and returns its cache.
+func (h *LogHandle) log() *LogCache {
+	h.store.useLog(h.cache)
+	return h.cache
+}
+
+func (h *LogHandle) HasCapability(feature storage.StorageFeature) bool {
+	return h.store.HasCapability(feature)
+}
+
+// HeadIndex finds the last object and returns it's index without reading the
+// data.
+func (h *LogHandle) HeadIndex(ctx context.Context, otype storage.ObjectType) (uint32, error) {
+	return h.store.headIndex(ctx, h.log(), otype)
+}
+
+func (h *LogHandle) MassifData(massifIndex uint32) ([]byte, bool, error) {
+	return h.store.massifData(h.log(), massifIndex)
+}
+
+func (h *LogHandle) CheckpointData(massifIndex uint32) ([]byte, bool, error) {
+	return h.store.checkpointData(h.log(), massifIndex)
+}
+
+func (h *LogHandle) ObjectPath(massifIndex uint32, otype storage.ObjectType) (string, error) {
+	return h.store.objectPath(h.log(), massifIndex, otype)
+}
+
+func (h *LogHandle) MassifReadN(ctx context.Context, massifIndex uint32, n int) ([]byte, error) {
+	return h.store.massifReadN(ctx, h.log(), massifIndex, n)
+}
+
+func (h *LogHandle) MassifReadRange(ctx context.Context, massifIndex uint32, offset, n int64) ([]byte, error) {
+	return h.store.massifReadRange(ctx, h.log(), massifIndex, offset, n)
+}
+
+func (h *LogHandle) MassifRefresh(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	return h.store.massifRefresh(ctx, h.log(), massifIndex)
+}
+
+func (h *LogHandle) MassifIndexForIDTimestamp(ctx context.Context, id uint64) (uint32, error) {
+	return h.store.massifIndexForIDTimestamp(ctx, h.log(), id)
+}
+
+func (h *LogHandle) CheckpointRead(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	return h.store.checkpointRead(ctx, h.log(), massifIndex)
+}
+
+func (h *LogHandle) Put(
+	ctx context.Context, massifIndex uint32, ty storage.ObjectType, data []byte, failIfExists bool) error {
+	return h.store.put(ctx, h.log(), massifIndex, ty, data, failIfExists)
+}
+
+// ReplaceVerifiedContext replaces the massif data and the checkpoint for the
+// massif, see CachingStore.ReplaceVerifiedContext
+func (h *LogHandle) ReplaceVerifiedContext(ctx context.Context, vc *massifs.VerifiedContext) error {
+	return h.store.replaceVerifiedContext(ctx, h.log(), vc)
+}
+
+func (h *LogHandle) Native(massifIndex uint32, otype storage.ObjectType) (*blobs.LogBlobContext, bool, error) {
+	return h.log().native(massifIndex, otype)
+}
+
+func (h *LogHandle) SetNative(massifIndex uint32, native *blobs.LogBlobContext, ty storage.ObjectType) error {
+	return h.log().setNative(massifIndex, native, ty)
+}
+
+func (h *LogHandle) Start(massifIndex uint32) (*massifs.MassifStart, bool, error) {
+	start, ok := h.log().start(massifIndex)
+	return start, ok, nil
+}
+
+func (h *LogHandle) SetStart(massifIndex uint32, start *massifs.MassifStart) error {
+	h.log().setStart(massifIndex, start)
+	return nil
+}
+
+func (h *LogHandle) Checkpoint(massifIndex uint32) (*massifs.Checkpoint, bool, error) {
+	checkpt, ok := h.log().checkpoint(massifIndex)
+	return checkpt, ok, nil
+}
+
+func (h *LogHandle) SetCheckpoint(massifIndex uint32, checkpt *massifs.Checkpoint) error {
+	h.log().setCheckpoint(massifIndex, checkpt)
+	return nil
+}
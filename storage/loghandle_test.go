@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	commoncose "github.com/forestrie/go-merklelog/massifs/cose"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veraison/go-cose"
+)
+
+func newTestStore(t *testing.T, store *testBlobStore, massifHeight uint8) *CachingStore {
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store}, massifHeight)
+	require.NoError(t, err)
+	return r
+}
+
+func newTestLogID() storage.LogID {
+	id := uuid.New()
+	return storage.LogID(id[:])
+}
+
+func newTestMassif(massifHeight uint8, massifIndex uint32, extra ...byte) []byte {
+	data := massifs.EncodeMassifStart(0, massifs.MassifCurrentVersion, 1, massifHeight, massifIndex)
+	return append(data, extra...)
+}
+
+// newTestSign1Message returns an unsigned message for the state, it can be
+// decoded but it does not verify.
+func newTestSign1Message(t *testing.T, state massifs.MMRState) commoncose.CoseSign1Message {
+	codec, err := massifs.NewCBORCodec()
+	require.NoError(t, err)
+	payload, err := codec.MarshalCBOR(state)
+	require.NoError(t, err)
+	return commoncose.CoseSign1Message{
+		Sign1Message: &cose.Sign1Message{Payload: payload, Signature: []byte("signature")},
+	}
+}
+
+func newTestCheckpoint(t *testing.T, state massifs.MMRState) []byte {
+	msg := newTestSign1Message(t, state)
+	data, err := msg.MarshalCBOR()
+	require.NoError(t, err)
+	return data
+}
+
+func TestCachingStore_Log(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+
+	logID := newTestLogID()
+	a, err := r.Log(t.Context(), logID)
+	require.NoError(t, err)
+	b, err := r.Log(t.Context(), logID)
+	require.NoError(t, err)
+
+	// handles for the same log share the cache
+	assert.Same(t, a.Cache(), b.Cache())
+	assert.Equal(t, logID, a.LogID())
+
+	// and handles do not select the log
+	assert.Nil(t, r.Selected)
+	_, _, err = r.MassifData(0)
+	assert.ErrorIs(t, err, storage.ErrLogNotSelected)
+
+	_, err = r.Log(t.Context(), nil)
+	assert.Error(t, err)
+}
+
+func TestLogHandle_concurrentLogs(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+
+	const logCount = 8
+	const massifCount = 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, logCount)
+	for range logCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- func() error {
+				h, err := r.Log(t.Context(), newTestLogID())
+				if err != nil {
+					return err
+				}
+				for i := range uint32(massifCount) {
+					want := newTestMassif(3, i, byte(i))
+					if err = h.Put(t.Context(), i, storage.ObjectMassifData, want, true); err != nil {
+						return err
+					}
+					got, err := h.MassifReadN(t.Context(), i, -1)
+					if err != nil {
+						return err
+					}
+					if string(got) != string(want) {
+						return fmt.Errorf("massif %d: data mismatch", i)
+					}
+					cached, ok, err := h.MassifData(i)
+					if err != nil {
+						return err
+					}
+					if !ok || string(cached) != string(want) {
+						return fmt.Errorf("massif %d: cached data mismatch", i)
+					}
+				}
+				return nil
+			}()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Len(t, r.LogCache, logCount)
+}
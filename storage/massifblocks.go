@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+)
+
+// DefaultAppendBlockSize is the default size of the blocks new massif data is
+// staged in.
+const DefaultAppendBlockSize = 4096
+
+// massifBlocks is the block list last committed for a massif, with the digest
+// of each block so that unchanged blocks can be found without retaining a copy
+// of the data.
+type massifBlocks struct {
+	etag    string
+	blocks  []blobs.Block
+	digests [][sha256.Size]byte
+}
+
+// massifBlocks returns the blocks committed for the version of the massif
+// identified by etag, if they are known.
+func (c *LogCache) massifBlocks(massifIndex uint32, etag string) (*massifBlocks, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	mb, ok := c.blocks[massifIndex]
+	if !ok || mb.etag != etag {
+		return nil, false
+	}
+	return mb, true
+}
+
+func (c *LogCache) setMassifBlocks(massifIndex uint32, mb *massifBlocks) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[massifIndex] = mb
+}
+
+// releaseMassifBlocks drops the blocks cached for the massif, the next append
+// reads the block list if the massif data is cached.
+func (c *LogCache) releaseMassifBlocks(massifIndex uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blocks, massifIndex)
+}
+
+// size returns the memory held by the block list, less the fixed overheads
+func (mb *massifBlocks) size() int64 {
+	size := int64(len(mb.blocks)) * (8 + sha256.Size)
+	for _, b := range mb.blocks {
+		size += int64(len(b.ID))
+	}
+	return size
+}
+
+func (r *CachingStore) initAppendWrites() error {
+	if !r.appendWrites || r.StoreWriter == nil {
+		return nil
+	}
+	bw, ok := blobs.NewBlockWriter(r.StoreWriter)
+	if !ok {
+		return fmt.Errorf("append writes require a store writer which supports block staging")
+	}
+	r.blockWriter = bw
+	if r.appendBlockSize == 0 {
+		r.appendBlockSize = DefaultAppendBlockSize
+	}
+	return nil
+}
+
+// putBlocks writes the massif data by staging only the blocks which differ
+// from those committed for the cached version of the massif, n, which may be
+// nil. If they are not known the massif is written in a single put instead.
+func (r *CachingStore) putBlocks(
+	ctx context.Context, c *LogCache, massifIndex uint32, storagePath string,
+	n *blobs.LogBlobContext, data []byte, opts blobs.CommitOptions,
+) (*azblob.WriteResponse, error) {
+	var committed []blobs.Block
+	var unchanged func(i int, content []byte) bool
+
+	if n != nil && n.ETag != "" {
+		if mb, ok := c.massifBlocks(massifIndex, n.ETag); ok {
+			committed = mb.blocks
+			unchanged = func(i int, content []byte) bool {
+				return sha256.Sum256(content) == mb.digests[i]
+			}
+		} else if n.Data != nil {
+			// Written by another writer, or before the store was created. The
+			// cached data is for this version of the massif, so it can be used
+			// to find the unchanged blocks.
+			var err error
+			if committed, err = r.blockWriter.BlockList(ctx, storagePath); err != nil {
+				return nil, err
+			}
+			var size int64
+			for _, b := range committed {
+				size += b.Size
+			}
+			if size != int64(len(n.Data)) {
+				committed = nil
+			}
+			offsets := make([]int64, len(committed))
+			for i := 1; i < len(committed); i++ {
+				offsets[i] = offsets[i-1] + committed[i-1].Size
+			}
+			unchanged = func(i int, content []byte) bool {
+				return bytes.Equal(content, n.Data[offsets[i]:offsets[i]+committed[i].Size])
+			}
+		} else {
+			// Nothing is known of the committed prefix, staging all of the
+			// data would cost a request for each block.
+			return blobs.PutContent(ctx, r.StoreWriter, storagePath, data, opts)
+		}
+	}
+
+	blocks, err := blobs.StageChanges(
+		ctx, r.blockWriter, storagePath, committed, unchanged, data, blobs.StageOptions{BlockSize: r.appendBlockSize})
+	if errors.Is(err, blobs.ErrTooManyBlocks) {
+		return blobs.PutContent(ctx, r.StoreWriter, storagePath, data, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(blocks))
+	digests := make([][sha256.Size]byte, len(blocks))
+	var offset int64
+	for i, b := range blocks {
+		ids[i] = b.ID
+		digests[i] = sha256.Sum256(data[offset : offset+b.Size])
+		offset += b.Size
+	}
+
+	wr, err := r.blockWriter.CommitBlockList(ctx, storagePath, ids, opts)
+	if err != nil {
+		return nil, err
+	}
+	wr.Size = int64(len(data))
+	if wr.ETag != nil {
+		mb := &massifBlocks{etag: *wr.ETag, blocks: blocks, digests: digests}
+		c.setMassifBlocks(massifIndex, mb)
+		r.cacheBlocks(c, massifIndex, mb.size())
+	}
+	return wr, nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingStore_AppendWrites(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 8)
+	require.NoError(t, err)
+	data := addTestLeaves(t, &mc, 2)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, true))
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, len(data), store.stagedBytes)
+	assert.Equal(t, 0, store.putCount)
+
+	// the start header and the new trie entries are in the first block, the
+	// rest of the pre-allocated trie data is not staged again
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	staged := store.stagedBytes
+	previous := len(data)
+	data = addTestLeaves(t, &mc, 3)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, DefaultAppendBlockSize+len(data)-previous, store.stagedBytes-staged)
+
+	// the blocks committed by the store are known without reading the massif again
+	staged = store.stagedBytes
+	previous = len(data)
+	data = addTestLeaves(t, &mc, 1)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, DefaultAppendBlockSize+len(data)-previous, store.stagedBytes-staged)
+
+	got, err := r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+
+	// without the committed blocks, or the data, of the cached version the
+	// massif is written in a single put
+	r.Selected.releaseMassifBlocks(0)
+	r.Selected.releaseMassifData(0)
+	staged = store.stagedBytes
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false))
+	assert.Equal(t, mc.Data, store.stored(storagePath).data)
+	assert.Equal(t, staged, store.stagedBytes)
+	assert.Equal(t, 1, store.putCount)
+
+	// the commit is conditional on the ETag of the cached massif
+	got, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	store.setBlob(storagePath, got)
+	err = r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false)
+	assert.ErrorIs(t, err, storage.ErrContentOC)
+}
+
+func TestCachingStore_AppendBlockSize(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true, AppendBlockSize: 512}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	for _, b := range store.stored(storagePath).blocks {
+		assert.LessOrEqual(t, b.Size, int64(512))
+	}
+
+	// only the changed block of the configured size is staged again
+	staged := store.stagedBytes
+	previous := len(mc.Data)
+	data := addTestLeaves(t, &mc, 1)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, 512+len(data)-previous, store.stagedBytes-staged)
+
+	_, err = NewStore(t.Context(), Options{
+		Store: store, StoreWriter: store, AppendWrites: true, AppendBlockSize: blobs.MaxBlockSize + 1,
+	}, 8)
+	assert.Error(t, err)
+}
+
+func TestCachingStore_AppendWrites_fromFullWrite(t *testing.T) {
+	store := newTestBlobStore(t)
+	full := newTestStore(t, store, 8)
+	logID := newTestLogID()
+	require.NoError(t, full.SelectLog(t.Context(), logID))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 8)
+	require.NoError(t, err)
+	require.NoError(t, full.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// a blob written in a single put has no blocks to re-use
+	data := addTestLeaves(t, &mc, 2)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, len(data), store.stagedBytes)
+
+	// once it is written as blocks, a store which learns the committed blocks
+	// from storage stages only the changes
+	previous := len(data)
+	data = addTestLeaves(t, &mc, 1)
+	r2, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r2.SelectLog(t.Context(), logID))
+	_, err = r2.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	staged := store.stagedBytes
+	require.NoError(t, r2.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	assert.Equal(t, data, store.stored(storagePath).data)
+	assert.Equal(t, DefaultAppendBlockSize+len(data)-previous, store.stagedBytes-staged)
+}
+
+func TestCachingStore_AppendWrites_retry(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{
+		Store: store, StoreWriter: store, AppendWrites: true, Retry: &blobs.RetryOptions{},
+	}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 8)
+	require.NoError(t, err)
+	data := addTestLeaves(t, &mc, 2)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, true))
+	assert.Equal(t, len(data), store.stagedBytes)
+
+	got, err := r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestCachingStore_AppendWrites_mergeBlocks(t *testing.T) {
+	store := newTestBlobStore(t)
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: true}, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 8)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), true))
+
+	// each put appends a small block, the small blocks are merged rather than
+	// accumulating for every leaf in the massif
+	for range blobs.DefaultMergeThreshold + 32 {
+		require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false))
+	}
+	assert.Equal(t, mc.Data, store.stored(storagePath).data)
+	fullBlocks := len(mc.Data) / DefaultAppendBlockSize
+	assert.LessOrEqual(t, len(store.stored(storagePath).blocks), fullBlocks+blobs.DefaultMergeThreshold+1)
+
+	got, err := r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// massifRanges is a sparse cache of the byte ranges read from a single version
+// of a massif blob.
+type massifRanges struct {
+	etag   string
+	ranges []byteRange // Ordered by offset, neither overlapping nor adjacent
+}
+
+type byteRange struct {
+	offset int64
+	data   []byte
+}
+
+func (br byteRange) end() int64 {
+	return br.offset + int64(len(br.data))
+}
+
+// get returns the n bytes at offset if a single cached range covers them
+func (m *massifRanges) get(offset, n int64) ([]byte, bool) {
+	for _, br := range m.ranges {
+		if br.offset > offset {
+			break
+		}
+		if offset+n <= br.end() {
+			return br.data[offset-br.offset : offset-br.offset+n], true
+		}
+	}
+	return nil, false
+}
+
+// add caches the data read at offset, merging it with any cached ranges it
+// overlaps or adjoins.
+func (m *massifRanges) add(offset int64, data []byte) {
+	merged := byteRange{offset: offset, data: data}
+	var ranges []byteRange
+	var overlapped []byteRange
+	for _, br := range m.ranges {
+		if br.end() < merged.offset || br.offset > merged.end() {
+			ranges = append(ranges, br)
+			continue
+		}
+		overlapped = append(overlapped, br)
+	}
+	if len(overlapped) > 0 {
+		start := min(merged.offset, overlapped[0].offset)
+		end := max(merged.end(), overlapped[len(overlapped)-1].end())
+		buf := make([]byte, end-start)
+		for _, br := range overlapped {
+			copy(buf[br.offset-start:], br.data)
+		}
+		// The new data is the most recent read, so it wins
+		copy(buf[merged.offset-start:], merged.data)
+		merged = byteRange{offset: start, data: buf}
+	}
+
+	i := 0
+	for i < len(ranges) && ranges[i].offset < merged.offset {
+		i++
+	}
+	m.ranges = append(ranges[:i], append([]byteRange{merged}, ranges[i:]...)...)
+}
+
+func (m *massifRanges) size() int64 {
+	var size int64
+	for _, br := range m.ranges {
+		size += int64(len(br.data))
+	}
+	return size
+}
+
+// cachedRange returns the n bytes at offset from the cached massif data, or
+// from the sparse ranges read from the massif. Ranges which can't be matched
+// against a cached blob context may be stale, for those revalidate is the ETag
+// they were read from, which the caller must check.
+func (c *LogCache) cachedRange(
+	massifIndex uint32, offset, n int64) (data []byte, fromRanges bool, revalidate string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	native := c.Az.Massifs[massifIndex]
+	if native != nil && native.Data != nil && offset+n <= int64(len(native.Data)) {
+		return native.Data[offset : offset+n], false, "", true
+	}
+	m := c.ranges[massifIndex]
+	if m == nil {
+		return nil, false, "", false
+	}
+	if native == nil || native.ETag == "" {
+		revalidate = m.etag
+	} else if native.ETag != m.etag {
+		return nil, false, "", false
+	}
+	data, ok = m.get(offset, n)
+	if !ok {
+		return nil, false, "", false
+	}
+	return data, true, revalidate, true
+}
+
+// addRange caches the data read at offset from the version of the massif
+// identified by etag, and returns the total size of the ranges now cached for
+// the massif. Ranges cached for other versions of the massif are discarded.
+func (c *LogCache) addRange(massifIndex uint32, etag string, offset int64, data []byte) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.ranges[massifIndex]
+	if m == nil || m.etag != etag {
+		m = &massifRanges{etag: etag}
+		c.ranges[massifIndex] = m
+	}
+	m.add(offset, data)
+	return m.size()
+}
+
+// releaseMassifRanges drops the sparse ranges cached for the massif
+func (c *LogCache) releaseMassifRanges(massifIndex uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ranges, massifIndex)
+}
+
+// MassifReadRange returns n bytes of the massif data, starting at offset, or
+// fewer if the massif ends first. Only the requested range is read from
+// storage, unless it is already cached.
+func (r *CachingStore) MassifReadRange(ctx context.Context, massifIndex uint32, offset, n int64) ([]byte, error) {
+	c := r.Selected
+	if c == nil {
+		return nil, storage.ErrLogNotSelected
+	}
+	return r.massifReadRange(ctx, c, massifIndex, offset, n)
+}
+
+func (r *CachingStore) massifReadRange(
+	ctx context.Context, c *LogCache, massifIndex uint32, offset, n int64) ([]byte, error) {
+	if offset < 0 || n <= 0 {
+		return nil, fmt.Errorf("invalid range for massif %d, offset %d, length %d", massifIndex, offset, n)
+	}
+
+	cached, fromRanges, revalidate, ok := c.cachedRange(massifIndex, offset, n)
+	key := massifKey{c: c, massifIndex: massifIndex}
+	if fromRanges {
+		key.kind = cacheMassifRanges
+	}
+	if ok && revalidate == "" {
+		r.rangeLookup(key, true)
+		return cached, nil
+	}
+
+	storagePath, err := r.objectPath(c, massifIndex, storage.ObjectMassifData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
+	}
+
+	// If the ranges need revalidating, the range is read only if the massif
+	// has changed since they were.
+	bc := &blobs.LogBlobContext{BlobPath: storagePath, ETag: revalidate}
+	modified, err := bc.ReadDataRangeIfModified(ctx, offset, n, r.Store)
+	if err != nil {
+		return nil, err
+	}
+	r.rangeLookup(key, !modified)
+	if !modified {
+		return cached, nil
+	}
+	if len(bc.Data) == 0 || bc.ETag == "" || !blobs.SupportsRangeReads(r.Store) {
+		// Nothing at, or beyond, the offset, or the whole prefix was read
+		return bc.Data, nil
+	}
+	size := c.addRange(massifIndex, bc.ETag, offset, bc.Data)
+	r.cacheRanges(c, massifIndex, size)
+	return bc.Data, nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMassifRanges_add(t *testing.T) {
+	type add struct {
+		offset int64
+		data   string
+	}
+	tests := []struct {
+		name string
+		adds []add
+		want []byteRange
+	}{
+		{
+			name: "disjoint ranges are ordered",
+			adds: []add{{10, "cd"}, {0, "ab"}},
+			want: []byteRange{{0, []byte("ab")}, {10, []byte("cd")}},
+		},
+		{
+			name: "adjacent ranges merge",
+			adds: []add{{0, "ab"}, {2, "cd"}},
+			want: []byteRange{{0, []byte("abcd")}},
+		},
+		{
+			name: "overlapping ranges merge, the latest wins",
+			adds: []add{{0, "abc"}, {2, "XY"}},
+			want: []byteRange{{0, []byte("abXY")}},
+		},
+		{
+			name: "a range bridging two merges all three",
+			adds: []add{{0, "ab"}, {4, "ef"}, {20, "z"}, {2, "cd"}},
+			want: []byteRange{{0, []byte("abcdef")}, {20, []byte("z")}},
+		},
+		{
+			name: "a contained range leaves the extent unchanged",
+			adds: []add{{0, "abcdef"}, {2, "X"}},
+			want: []byteRange{{0, []byte("abXdef")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &massifRanges{}
+			for _, a := range tt.adds {
+				m.add(a.offset, []byte(a.data))
+			}
+			assert.Equal(t, tt.want, m.ranges)
+
+			var size int64
+			for _, br := range tt.want {
+				size += int64(len(br.data))
+			}
+			assert.Equal(t, size, m.size())
+		})
+	}
+}
+
+func TestCachingStore_MassifReadRange(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	massif := newTestMassif(3, 0, []byte("0123456789abcdef")...)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, massif, true))
+	tail := int64(len(massif) - 16)
+
+	data, err := r.MassifReadRange(t.Context(), 0, tail+4, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4567"), data)
+	assert.Equal(t, 1, store.rangeCount)
+
+	// a range within the cached range is served without a request
+	data, err = r.MassifReadRange(t.Context(), 0, tail+5, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("56"), data)
+	assert.Equal(t, 1, store.rangeCount)
+
+	// an adjacent range is read, and merged, so the combined range is cached
+	_, err = r.MassifReadRange(t.Context(), 0, tail+8, 4)
+	require.NoError(t, err)
+	data, err = r.MassifReadRange(t.Context(), 0, tail+4, 8)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("456789ab"), data)
+	assert.Equal(t, 2, store.rangeCount)
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, int64(8), stats.ResidentBytes)
+
+	// reading beyond the end returns what there is
+	data, err = r.MassifReadRange(t.Context(), 0, tail+12, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("cdef"), data)
+	data, err = r.MassifReadRange(t.Context(), 0, tail+100, 1)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	// once the massif is re-read and found to have changed, the ranges read
+	// from the previous version are not used
+	path, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	store.setBlob(path, newTestMassif(3, 0, []byte("0123XXXX89abcdef")...))
+	_, err = r.MassifReadN(t.Context(), 0, 1)
+	require.NoError(t, err)
+	rangeCount := store.rangeCount
+	data, err = r.MassifReadRange(t.Context(), 0, tail+4, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("XXXX"), data)
+	assert.Equal(t, rangeCount+1, store.rangeCount)
+
+	// the complete massif data is used when it is cached
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	data, err = r.MassifReadRange(t.Context(), 0, tail, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123"), data)
+	assert.Equal(t, rangeCount+1, store.rangeCount)
+
+	_, err = r.MassifReadRange(t.Context(), 0, -1, 4)
+	assert.Error(t, err)
+}
+
+func TestCachingStore_MassifReadRange_revalidate(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 3)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	massif := newTestMassif(3, 0, []byte("0123456789abcdef")...)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, massif, true))
+	tail := int64(len(massif) - 16)
+
+	// the reader has no blob context for the massif, so the ranges it reads
+	// are revalidated, and not transferred again if they are unchanged
+	r := newTestStore(t, store, 3)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	data, err := r.MassifReadRange(t.Context(), 0, tail+4, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4567"), data)
+	data, err = r.MassifReadRange(t.Context(), 0, tail+4, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4567"), data)
+	assert.Equal(t, 2, store.rangeCount)
+	assert.Equal(t, uint64(1), r.Stats().Hits)
+
+	// the massif is updated in place, the stale range is not served
+	path, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	store.setBlob(path, newTestMassif(3, 0, []byte("0123XXXX89abcdef")...))
+	data, err = r.MassifReadRange(t.Context(), 0, tail+4, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("XXXX"), data)
+	assert.Equal(t, 3, store.rangeCount)
+}
+
+// plainReader hides the range reads of the store it wraps
+type plainReader struct {
+	azureReader
+}
+
+func TestCachingStore_MassifReadRange_unsupported(t *testing.T) {
+	store := newTestBlobStore(t)
+	w := newTestStore(t, store, 3)
+	logID := newTestLogID()
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	massif := newTestMassif(3, 0, []byte("0123456789abcdef")...)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, massif, true))
+	tail := int64(len(massif) - 16)
+
+	// the store can only read from the start of the blob, so the ranges are
+	// not cached
+	r, err := NewStore(t.Context(), Options{Store: plainReader{store}}, 3)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	for range 2 {
+		data, err := r.MassifReadRange(t.Context(), 0, tail+4, 4)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("4567"), data)
+	}
+	assert.Equal(t, 0, store.rangeCount)
+	assert.Equal(t, 2, store.readCount)
+	assert.Equal(t, int64(0), r.Stats().ResidentBytes)
+}
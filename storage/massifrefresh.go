@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// MassifRefresh brings the cached data for the massif up to date with
+// storage, and returns it. Only the log entries appended since the massif was
+// last read are transferred, along with the parts updated in place, unless the
+// massif was re-written, when it is read in full.
+func (r *CachingStore) MassifRefresh(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	c := r.Selected
+	if c == nil {
+		return nil, storage.ErrLogNotSelected
+	}
+	return r.massifRefresh(ctx, c, massifIndex)
+}
+
+func (r *CachingStore) massifRefresh(ctx context.Context, c *LogCache, massifIndex uint32) ([]byte, error) {
+	n, ok, err := c.native(massifIndex, storage.ObjectMassifData)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || n.Data == nil {
+		r.cacheLookup(c, massifIndex, storage.ObjectMassifData, false)
+		return r.massifReadN(ctx, c, massifIndex, -1)
+	}
+	// The fallbacks below read from the store, not the disk cache, as the
+	// cached data may have come from it.
+	storagePath := n.BlobPath
+
+	prev := massifs.MassifContext{}
+	prev.Data = n.Data
+	if err = prev.Start.UnmarshalBinary(n.Data); err != nil || uint64(len(n.Data)) < prev.LogStart() {
+		// A partial read, which may not include all of the trie data, or a
+		// corrupt one.
+		r.cacheLookup(c, massifIndex, storage.ObjectMassifData, false)
+		return r.massifReadBlob(ctx, c, massifIndex, storagePath, -1)
+	}
+
+	// The updates in place are applied before the refreshed data is checked
+	// against the content MD5 of the massif.
+	bc := *n
+	patch := func(ctx context.Context, data []byte, etag string) error {
+		return r.refreshMassifUpdates(ctx, storagePath, etag, data, prev)
+	}
+	result, err := bc.RefreshDataPatched(ctx, r.Store, patch, blobs.RefreshOptions{GetTags: true})
+	if err != nil {
+		return nil, err
+	}
+	r.cacheLookup(c, massifIndex, storage.ObjectMassifData, result == blobs.RefreshUnchanged)
+	if r.validateTags && result != blobs.RefreshUnchanged && len(bc.Data) >= massifs.StartHeaderSize {
+		read := func() error {
+			return bc.ReadData(ctx, r.Store, azblob.WithGetTags())
+		}
+		if err = r.checkTagsReread(c, massifIndex, storage.ObjectMassifData, &bc, read); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = c.setNative(massifIndex, &bc, storage.ObjectMassifData); err != nil {
+		return nil, err
+	}
+	r.cacheMassif(c, massifIndex, len(bc.Data))
+	if result != blobs.RefreshUnchanged {
+		r.diskPut(&bc)
+	}
+
+	if _, ok := c.start(massifIndex); !ok {
+		start := &massifs.MassifStart{}
+		if err = start.UnmarshalBinary(bc.Data); err != nil {
+			return nil, fmt.Errorf("failed to decode start for massif %d: %w", massifIndex, err)
+		}
+		c.setStart(massifIndex, start)
+	}
+	return bc.Data, nil
+}
+
+// refreshMassifUpdates reads the parts of the massif which were updated in
+// place by the leaves appended since prev was read, and applies them to the
+// refreshed data. The reads are conditional on the refreshed ETag, an error is
+// returned if the massif has changed again, or if the start header differs by
+// more than the last id.
+func (r *CachingStore) refreshMassifUpdates(
+	ctx context.Context, storagePath string, etag string, data []byte, prev massifs.MassifContext,
+) error {
+	header := &blobs.LogBlobContext{BlobPath: storagePath}
+	err := header.ReadDataRange(ctx, 0, massifs.StartHeaderSize, r.Store, blobs.WithRangeIfMatch(etag))
+	if err != nil {
+		return err
+	}
+	if len(header.Data) != massifs.StartHeaderSize {
+		return fmt.Errorf("%w: short start header", storage.ErrContentOC)
+	}
+	if !bytes.Equal(header.Data[:massifs.MassifStartKeyLastIDFirstByte], prev.Data[:massifs.MassifStartKeyLastIDFirstByte]) ||
+		!bytes.Equal(header.Data[massifs.MassifStartKeyLastIDEnd:], prev.Data[massifs.MassifStartKeyLastIDEnd:massifs.StartHeaderSize]) {
+		return fmt.Errorf("%w: start header re-written", storage.ErrContentOC)
+	}
+	copy(data, header.Data)
+
+	next := massifs.MassifContext{Start: prev.Start}
+	next.Data = data
+	oldLeaves, newLeaves := prev.MassifLeafCount(), next.MassifLeafCount()
+	if newLeaves <= oldLeaves {
+		return nil
+	}
+	from := massifs.TrieEntryOffset(next.IndexStart(), oldLeaves)
+	to := massifs.TrieEntryOffset(next.IndexStart(), newLeaves)
+
+	trie := &blobs.LogBlobContext{BlobPath: storagePath}
+	err = trie.ReadDataRange(ctx, int64(from), int64(to-from), r.Store, blobs.WithRangeIfMatch(etag))
+	if err != nil {
+		return err
+	}
+	if uint64(len(trie.Data)) != to-from {
+		return fmt.Errorf("%w: short trie data", storage.ErrContentOC)
+	}
+	copy(data[from:to], trie.Data)
+	return nil
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"slices"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addTestLeaves adds count leaves to the massif, with ids following on from
+// the last id in the massif, and returns a copy of the resulting data.
+func addTestLeaves(t *testing.T, mc *massifs.MassifContext, count int) []byte {
+	t.Helper()
+	for range count {
+		id := mc.GetLastIDTimestamp() + 1
+		value := sha256.Sum256([]byte{byte(id)})
+		_, err := mc.AddHashedLeaf(sha256.New(), id, nil, []byte("log"), []byte("app"), value[:])
+		require.NoError(t, err)
+	}
+	return slices.Clone(mc.Data)
+}
+
+func TestCachingStore_MassifRefresh(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 4)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	// nothing cached, the massif is read in full
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 1, store.readCount)
+
+	// unchanged, the conditional read transfers nothing
+	got, err = r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 1, store.readCount)
+	assert.Equal(t, 1, store.rangeCount)
+
+	// appended, the tail, the start header and the new trie entries are read
+	previous, before := got, slices.Clone(got)
+	store.setBlob(storagePath, addTestLeaves(t, &mc, 3))
+	got, err = r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, 1, store.readCount)
+	assert.Equal(t, 4, store.rangeCount)
+	refreshed := massifs.MassifContext{}
+	refreshed.Data = got
+	assert.Equal(t, mc.GetLastIDTimestamp(), refreshed.GetLastIDTimestamp())
+	assert.Equal(t, before, previous, "previously returned data must not be modified")
+
+	cached, ok, err := r.MassifData(0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, mc.Data, cached)
+	start, ok, err := r.Start(0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, mc.Start.LastID, start.LastID)
+
+	// re-written, rather than appended to, the massif is read in full
+	rewritten, err := massifs.CreateFirstMassifContext(t.Context(), 2, 4)
+	require.NoError(t, err)
+	store.setBlob(storagePath, addTestLeaves(t, &rewritten, 6))
+	got, err = r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, rewritten.Data, got)
+	assert.Equal(t, 2, store.readCount)
+}
+
+func TestCachingStore_MassifRefresh_headerRewritten(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 4)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// the log entries are appended to, but the epoch in the header changes
+	data := addTestLeaves(t, &mc, 1)
+	data[massifs.MassifStartKeyEpochFirstByte] ^= 0xff
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	store.setBlob(storagePath, data)
+
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, 2, store.readCount)
+}
+
+func TestCachingStore_MassifRefresh_afterPut(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 4)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// the data read before the put is not served with the ETag of the put
+	data := addTestLeaves(t, &mc, 3)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, data, false))
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false))
+	got, err = r.MassifReadRange(t.Context(), 0, 0, int64(len(mc.Data)))
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+}
+
+func TestCachingStore_MassifRefresh_contentMD5(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 4)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	storagePath, err := w.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	r := newTestStore(t, store, 4)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	reads := store.readCount
+
+	// appended by a writer which stores the content MD5, the header and the
+	// trie entries are updated in place, only the changes are read
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 3), false))
+	require.NotEmpty(t, store.stored(storagePath).metadata)
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, reads, store.readCount)
+	assert.Equal(t, 3, store.rangeCount)
+
+	// a change to the previously read data, which the refresh reads none of,
+	// is found by the content MD5 and the massif is read in full
+	mc.Data[mc.LogStart()] ^= 0xff
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false))
+	got, err = r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, reads+1, store.readCount)
+}
+
+func TestCachingStore_MassifRefresh_noContentMD5(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 4)
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	storagePath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	reads := store.readCount
+
+	// appended by a writer which doesn't store the content MD5, the previously
+	// read data can't be checked, so the massif is read in full
+	store.setRawBlob(storagePath, addTestLeaves(t, &mc, 3), nil)
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, reads+1, store.readCount)
+}
+
+func TestCachingStore_MassifRefresh_validateTags(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 4)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 4)
+	require.NoError(t, err)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	storagePath, err := w.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+
+	newReader := func() *CachingStore {
+		r, err := NewStore(t.Context(), Options{Store: store, ValidateTags: true}, 4)
+		require.NoError(t, err)
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err = r.MassifReadN(t.Context(), 0, -1)
+		require.NoError(t, err)
+		return r
+	}
+
+	// tags read from before the append are read again, with the massif
+	r := newReader()
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 3), false))
+	tags := store.stored(storagePath).tags
+	store.staleTags = map[string]map[string]string{storagePath: {
+		TagKeyFirstIndex: tags[TagKeyFirstIndex], TagKeyLastID: EncodeTagHex64(1),
+	}}
+	reads := store.readCount
+	got, err := r.MassifRefresh(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, mc.Data, got)
+	assert.Equal(t, reads+1, store.readCount)
+
+	// a refreshed massif with incorrect tags is not cached
+	r = newReader()
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), false))
+	store.setTags(storagePath, map[string]string{TagKeyLastID: store.stored(storagePath).tags[TagKeyLastID]})
+	_, err = r.MassifRefresh(t.Context(), 0)
+	assert.ErrorIs(t, err, ErrMissingFirstIndexTag)
+	cached, ok, err := r.MassifData(0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.NotEqual(t, mc.Data, cached)
+}
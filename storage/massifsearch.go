@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+)
+
+// MassifIndexForIDTimestamp returns the index of the massif containing the
+// leaf with the idtimestamp id, or, if there is no such leaf, the first massif
+// with a later leaf. Only the lastid tags of the massifs are consulted, the
+// head is checked first, then the blob index is queried, and failing that the
+// massifs are binary searched. storage.ErrDoesNotExist is returned if id is
+// after the last leaf of the log.
+func (r *CachingStore) MassifIndexForIDTimestamp(ctx context.Context, id uint64) (uint32, error) {
+	c := r.Selected
+	if c == nil {
+		return 0, storage.ErrLogNotSelected
+	}
+	return r.massifIndexForIDTimestamp(ctx, c, id)
+}
+
+func (r *CachingStore) massifIndexForIDTimestamp(ctx context.Context, c *LogCache, id uint64) (uint32, error) {
+	head := c.lastMassifIndex()
+	if head == storage.HeadMassifIndex {
+		var err error
+		if head, err = r.headIndex(ctx, c, storage.ObjectMassifData); err != nil {
+			return 0, err
+		}
+	}
+
+	// The head may still be growing, so its lastid is always listed. The
+	// lastids listed are kept for the rest of the search.
+	lastIDs := map[uint32]uint64{}
+	lastID, err := r.listMassifLastID(ctx, c, head, lastIDs)
+	if err != nil {
+		return 0, err
+	}
+	if lastID < id {
+		// The cached head may be stale, and so may the lastid listed for it
+		clear(lastIDs)
+		if head, err = r.headIndex(ctx, c, storage.ObjectMassifData); err != nil {
+			return 0, err
+		}
+		if lastID, err = r.listMassifLastID(ctx, c, head, lastIDs); err != nil {
+			return 0, err
+		}
+		if lastID < id {
+			return 0, fmt.Errorf("%w: idtimestamp %x is after the last leaf of the log", storage.ErrDoesNotExist, id)
+		}
+	}
+	if head == 0 {
+		return 0, nil
+	}
+	found, err := r.precedesID(ctx, c, head, id, lastIDs)
+	if err != nil || found {
+		return head, err
+	}
+
+	last := head - 1
+	candidate, found, err := r.filteredMassifIndex(ctx, c, id, last)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		first, err := r.precedesID(ctx, c, candidate, id, lastIDs)
+		if err != nil || first {
+			return candidate, err
+		}
+		last = candidate - 1
+	}
+	return r.searchMassifIndex(ctx, c, id, last, lastIDs)
+}
+
+// precedesID returns true if massifIndex is the first massif with a lastid at
+// or after id, given that its own lastid is.
+func (r *CachingStore) precedesID(
+	ctx context.Context, c *LogCache, massifIndex uint32, id uint64, lastIDs map[uint32]uint64) (bool, error) {
+	if massifIndex == 0 {
+		return true, nil
+	}
+	lastID, err := r.massifLastID(ctx, c, massifIndex-1, lastIDs)
+	if err != nil {
+		return false, err
+	}
+	return lastID < id, nil
+}
+
+// filteredMassifIndex queries the blob index for a massif of the log, up to
+// and including last, whose lastid is at or after id. The query is scoped to
+// the log by its logid tag, and paging stops at the first page with such a
+// massif, the earliest on that page is returned.
+func (r *CachingStore) filteredMassifIndex(
+	ctx context.Context, c *LogCache, id uint64, last uint32) (uint32, bool, error) {
+	tagsFilter := fmt.Sprintf(`"%s"='%s' AND "%s">='%s'`,
+		TagKeyLogID, EncodeTagLogID(c.LogID), TagKeyLastID, EncodeTagHex64(id))
+
+	var marker azblob.ListMarker
+	for {
+		var opts []azblob.Option
+		if marker != nil && *marker != "" {
+			opts = append(opts, azblob.WithListMarker(marker))
+		}
+		filtered, err := r.Store.FilteredList(ctx, tagsFilter, opts...)
+		if err != nil {
+			return 0, false, translateAzureError(err, err)
+		}
+		var candidate uint32
+		var found bool
+		for _, it := range filtered.Items {
+			if it.Name == nil {
+				continue
+			}
+			info, err := r.layout.ParsePath(*it.Name)
+			if err != nil || info.Type != storage.ObjectMassifData || !bytes.Equal(info.LogID, c.LogID) {
+				continue
+			}
+			if info.MassifIndex <= last && (!found || info.MassifIndex < candidate) {
+				candidate, found = info.MassifIndex, true
+			}
+		}
+		if found {
+			return candidate, true, nil
+		}
+		marker = filtered.Marker
+		if marker == nil || *marker == "" {
+			return 0, false, nil
+		}
+	}
+}
+
+// searchMassifIndex finds the first massif, up to and including last, whose
+// lastid is at or after id by a binary search over the massif tags. The lastid
+// of last must be at or after id.
+func (r *CachingStore) searchMassifIndex(
+	ctx context.Context, c *LogCache, id uint64, last uint32, lastIDs map[uint32]uint64) (uint32, error) {
+	lo, hi := uint32(0), last
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		lastID, err := r.massifLastID(ctx, c, mid, lastIDs)
+		if err != nil {
+			return 0, err
+		}
+		if lastID < id {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// massifLastID returns the lastid tag of the massif, from lastIDs or the cache
+// if it is known, otherwise by listing the blob with its tags.
+func (r *CachingStore) massifLastID(
+	ctx context.Context, c *LogCache, massifIndex uint32, lastIDs map[uint32]uint64) (uint64, error) {
+	if lastID, ok := lastIDs[massifIndex]; ok {
+		return lastID, nil
+	}
+	n, ok, err := c.native(massifIndex, storage.ObjectMassifData)
+	if err != nil {
+		return 0, err
+	}
+	if ok && GetLastIDHex(n.Tags) != "" {
+		return DecodeTagHex64(GetLastIDHex(n.Tags))
+	}
+	return r.listMassifLastID(ctx, c, massifIndex, lastIDs)
+}
+
+// listMassifLastID lists the blob of the massif with its tags, and returns its
+// lastid tag, which is also added to lastIDs.
+func (r *CachingStore) listMassifLastID(
+	ctx context.Context, c *LogCache, massifIndex uint32, lastIDs map[uint32]uint64) (uint64, error) {
+	storagePath, err := r.objectPath(c, massifIndex, storage.ObjectMassifData)
+	if err != nil {
+		return 0, err
+	}
+	bc, err := blobs.FirstPrefixedBlob(ctx, r.Store, storagePath, azblob.WithListTags())
+	if errors.Is(err, blobs.ErrBlobNotFound) || (err == nil && bc.BlobPath != storagePath) {
+		return 0, fmt.Errorf("%w: massif %d", storage.ErrDoesNotExist, massifIndex)
+	}
+	if err != nil {
+		return 0, translateAzureError(err, err)
+	}
+	lastIDHex := GetLastIDHex(bc.Tags)
+	if lastIDHex == "" {
+		return 0, fmt.Errorf("%s: %w", storagePath, ErrMissingLastIDTag)
+	}
+	lastID, err := DecodeTagHex64(lastIDHex)
+	if err != nil {
+		return 0, err
+	}
+	lastIDs[massifIndex] = lastID
+	return lastID, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putTestMassifs writes count full massifs of height 3, each of 4 leaves, to
+// the selected log. The idtimestamps of the leaves are 1, 2, 3 and so on. The
+// context for the last massif is returned.
+func putTestMassifs(t *testing.T, r *CachingStore, count int) massifs.MassifContext {
+	t.Helper()
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 3)
+	require.NoError(t, err)
+	for i := range count {
+		if i > 0 {
+			require.NoError(t, mc.StartNextMassif())
+			require.NoError(t, mc.CreatePeakStackMap())
+		}
+		data := addTestLeaves(t, &mc, 4)
+		require.NoError(t, r.Put(t.Context(), uint32(i), storage.ObjectMassifData, data, true))
+	}
+	return mc
+}
+
+func TestCachingStore_MassifIndexForIDTimestamp(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 3)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	mc := putTestMassifs(t, w, 5)
+
+	// another log, sharing the container, with later idtimestamps
+	other := newTestStore(t, store, 3)
+	require.NoError(t, other.SelectLog(t.Context(), newTestLogID()))
+	putTestMassifs(t, other, 6)
+
+	tests := []struct {
+		name string
+		id   uint64
+		want uint32
+	}{
+		{"first leaf", 1, 0},
+		{"last leaf of first massif", 4, 0},
+		{"first leaf of second massif", 5, 1},
+		{"middle", 10, 2},
+		{"before head", 16, 3},
+		{"head", 17, 4},
+		{"last leaf", 20, 4},
+		{"before first leaf", 0, 0},
+	}
+	for _, filterLag := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store.filterLag = filterLag
+				r := newTestStore(t, store, 3)
+				require.NoError(t, r.SelectLog(t.Context(), logID))
+
+				got, err := r.MassifIndexForIDTimestamp(t.Context(), tt.id)
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			})
+		}
+	}
+	store.filterLag = false
+	assert.Positive(t, store.filterCount)
+	// the blob index query is scoped to the log
+	for _, filter := range store.filters {
+		assert.Contains(t, filter, fmt.Sprintf(`"%s"='%s'`, TagKeyLogID, EncodeTagLogID(logID)))
+	}
+	assert.Equal(t, 0, store.readCount)
+	assert.Equal(t, 0, store.rangeCount)
+
+	r := newTestStore(t, store, 3)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	_, err := r.MassifIndexForIDTimestamp(t.Context(), 21)
+	assert.ErrorIs(t, err, storage.ErrDoesNotExist)
+
+	// the head is cached, a later massif is found by refreshing it
+	_, err = r.MassifIndexForIDTimestamp(t.Context(), 3)
+	require.NoError(t, err)
+	require.NoError(t, mc.StartNextMassif())
+	require.NoError(t, mc.CreatePeakStackMap())
+	require.NoError(t, w.Put(t.Context(), 5, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), true))
+	got, err := r.MassifIndexForIDTimestamp(t.Context(), 21)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), got)
+
+	// the lastid of the head is listed, rather than taken from the cache, as
+	// the head may have grown since it was read
+	_, err = r.MassifReadN(t.Context(), 5, -1)
+	require.NoError(t, err)
+	require.NoError(t, w.Put(t.Context(), 5, storage.ObjectMassifData, addTestLeaves(t, &mc, 1), true))
+	got, err = r.MassifIndexForIDTimestamp(t.Context(), 22)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), got)
+}
+
+func TestCachingStore_MassifIndexForIDTimestamp_listsOnce(t *testing.T) {
+	store := newTestBlobStore(t)
+	logID := newTestLogID()
+	w := newTestStore(t, store, 3)
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+	putTestMassifs(t, w, 16)
+
+	// without the blob index the binary search covers every massif before the
+	// head, each is listed at most once
+	store.filterLag = true
+	for id := uint64(1); id <= 64; id += 4 {
+		r := newTestStore(t, store, 3)
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		_, err := r.HeadIndex(t.Context(), storage.ObjectMassifData)
+		require.NoError(t, err)
+		listCount := store.listCount
+		got, err := r.MassifIndexForIDTimestamp(t.Context(), id)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(id/4), got)
+		// the head, the massif before it, and the 4 probes of a binary search
+		// over the 15 massifs before the head
+		assert.LessOrEqual(t, store.listCount-listCount, 6)
+	}
+}
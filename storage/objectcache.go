@@ -1,17 +1,19 @@
 package storage
 
-/*
 import (
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
+// Start returns the decoded massif start cached for the selected log. The
+// start is cached whenever a read of the massif includes the start header, and
+// is dropped when a put or a re-read changes the massif ETag.
 func (r *CachingStore) Start(massifIndex uint32) (*massifs.MassifStart, bool, error) {
 	c := r.Selected
 	if c == nil {
 		return nil, false, storage.ErrLogNotSelected
 	}
-	start, ok := c.Starts[massifIndex]
+	start, ok := c.start(massifIndex)
 	return start, ok, nil
 }
 
@@ -20,16 +22,18 @@ func (r *CachingStore) SetStart(massifIndex uint32, start *massifs.MassifStart)
 	if c == nil {
 		return storage.ErrLogNotSelected
 	}
-	c.Starts[massifIndex] = start
+	c.setStart(massifIndex, start)
 	return nil
 }
 
+// Checkpoint returns the decoded checkpoint cached for the selected log. The
+// checkpoint is dropped when a put or a re-read changes the checkpoint ETag.
 func (r *CachingStore) Checkpoint(massifIndex uint32) (*massifs.Checkpoint, bool, error) {
 	c := r.Selected
 	if c == nil {
 		return nil, false, storage.ErrLogNotSelected
 	}
-	checkpt, ok := c.Checkpoints[massifIndex]
+	checkpt, ok := c.checkpoint(massifIndex)
 	return checkpt, ok, nil
 }
 
@@ -38,6 +42,6 @@ func (r *CachingStore) SetCheckpoint(massifIndex uint32, checkpt *massifs.Checkp
 	if c == nil {
 		return storage.ErrLogNotSelected
 	}
-	c.Checkpoints[massifIndex] = checkpt
+	c.setCheckpoint(massifIndex, checkpt)
 	return nil
-}*/
+}
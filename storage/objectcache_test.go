@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingStore_Start(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+
+	_, _, err := r.Start(0)
+	assert.ErrorIs(t, err, storage.ErrLogNotSelected)
+
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	require.NoError(t, r.Put(t.Context(), 1, storage.ObjectMassifData, newTestMassif(3, 1), true))
+
+	_, ok, err := r.Start(1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// reading the massif caches the decoded start
+	_, err = r.MassifReadN(t.Context(), 1, -1)
+	require.NoError(t, err)
+	start, ok, err := r.Start(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, uint32(1), start.MassifIndex)
+	assert.Equal(t, uint8(3), start.MassifHeight)
+
+	// a re-read which does not change the etag retains it
+	require.NoError(t, r.SetStart(1, &massifs.MassifStart{MassifIndex: 42}))
+	_, err = r.MassifReadN(t.Context(), 1, -1)
+	require.NoError(t, err)
+	start, _, err = r.Start(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), start.MassifIndex)
+
+	// a put changes the etag and so drops it
+	require.NoError(t, r.Put(t.Context(), 1, storage.ObjectMassifData, newTestMassif(3, 1, 1), false))
+	_, ok, err = r.Start(1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCachingStore_Checkpoint(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+
+	require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectCheckpoint, newTestCheckpoint(t, massifs.MMRState{MMRSize: 1}), true))
+	_, err := r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+
+	checkpt := &massifs.Checkpoint{MMRState: massifs.MMRState{MMRSize: 7}}
+	require.NoError(t, r.SetCheckpoint(0, checkpt))
+
+	// a re-read which does not change the etag retains it
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	cached, ok, err := r.Checkpoint(0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Same(t, checkpt, cached)
+
+	// a re-read which finds a different etag drops it
+	path, err := r.ObjectPath(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	store.setBlob(path, []byte("resealed"))
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	_, ok, err = r.Checkpoint(0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
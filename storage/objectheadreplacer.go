@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/datatrails/go-datatrails-common/azblob"
@@ -10,9 +11,26 @@ import (
 	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
+// VerifiedContextReplace is reported by HasCapability for stores which can
+// replace a verified context, see VerifiedContextReplacer. The massifs storage
+// package does not define it, so it is kept clear of the features it does.
+const VerifiedContextReplace = storage.BulkOperations + 1000
+
+// VerifiedContextReplacer is implemented by stores which can replace a massif
+// and its checkpoint from a verified context. Stores without a writer fail
+// with storage.ErrUnsupportedCap, and do not report VerifiedContextReplace.
+type VerifiedContextReplacer interface {
+	ReplaceVerifiedContext(ctx context.Context, vc *massifs.VerifiedContext) error
+}
+
+var (
+	_ VerifiedContextReplacer = (*CachingStore)(nil)
+	_ VerifiedContextReplacer = (*LogHandle)(nil)
+)
+
 func (r *CachingStore) HasCapability(feature storage.StorageFeature) bool {
 	switch feature {
-	case storage.OptimisticWrite:
+	case storage.OptimisticWrite, VerifiedContextReplace:
 		return r.StoreWriter != nil
 	default:
 		return false
@@ -21,11 +39,135 @@ func (r *CachingStore) HasCapability(feature storage.StorageFeature) bool {
 
 func (r *CachingStore) Put(
 	ctx context.Context, massifIndex uint32, ty storage.ObjectType, data []byte, failIfExists bool) error {
+	c := r.Selected
+	if c == nil {
+		return storage.ErrLogNotSelected
+	}
+	return r.put(ctx, c, massifIndex, ty, data, failIfExists)
+}
+
+// ReplaceVerifiedContext replaces the massif data and the checkpoint for the
+// massif with the content of the verified context. Each object is replaced
+// only if its ETag is the one cached by this store, otherwise
+// storage.ErrContentOC is returned. The two blobs are not replaced atomically,
+// the massif is written first.
+func (r *CachingStore) ReplaceVerifiedContext(ctx context.Context, vc *massifs.VerifiedContext) error {
+	c := r.Selected
+	if c == nil {
+		return storage.ErrLogNotSelected
+	}
+	return r.replaceVerifiedContext(ctx, c, vc)
+}
+
+func (r *CachingStore) replaceVerifiedContext(ctx context.Context, c *LogCache, vc *massifs.VerifiedContext) error {
+	if r.StoreWriter == nil {
+		return storage.ErrUnsupportedCap
+	}
+	if vc == nil || len(vc.MassifContext.Data) == 0 {
+		return fmt.Errorf("verified context with massif data is required")
+	}
+	massifIndex := vc.MassifContext.Start.MassifIndex
+
+	checkpt, err := vc.Sign1Message.MarshalCBOR()
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint message: %w", err)
+	}
+
+	if err = r.checkUnchanged(ctx, c, massifIndex, storage.ObjectCheckpoint); err != nil {
+		return fmt.Errorf("failed to replace checkpoint %d: %w", massifIndex, err)
+	}
+	if err = r.replace(ctx, c, massifIndex, storage.ObjectMassifData, vc.MassifContext.Data); err != nil {
+		return fmt.Errorf("failed to replace massif %d: %w", massifIndex, err)
+	}
+	if err = r.replace(ctx, c, massifIndex, storage.ObjectCheckpoint, checkpt); err != nil {
+		return fmt.Errorf("failed to replace checkpoint %d: %w", massifIndex, err)
+	}
+	return nil
+}
+
+// checkUnchanged fails with storage.ErrContentOC unless the object is as it
+// was last read, or written, by this store: its ETag must match the cached
+// one, or, if it was never read, it must not exist.
+func (r *CachingStore) checkUnchanged(
+	ctx context.Context, c *LogCache, massifIndex uint32, ty storage.ObjectType) error {
+
+	n, ok, err := c.native(massifIndex, ty)
+	if err != nil {
+		return err
+	}
+	storagePath, err := r.objectPath(c, massifIndex, ty)
+	if err != nil {
+		return err
+	}
+	if ok {
+		storagePath = n.BlobPath
+	}
+
+	// A conditional read of the first byte from the store written to, the
+	// Store may fail over to a secondary which is behind it.
+	var opts []blobs.RangeOption
+	if ok {
+		opts = append(opts, blobs.WithRangeIfNoneMatch(n.ETag))
+	}
+	rr, _, err := blobs.BlobReadRange(ctx, storagePath, r.primaryReader(), 0, 1, opts...)
+	if err != nil {
+		if err = translateAzureError(err, err); !errors.Is(err, storage.ErrDoesNotExist) {
+			return err
+		}
+	}
+	exists := err == nil
+	if exists != ok || (ok && !blobs.IsNotModified(rr)) {
+		return fmt.Errorf("%w: %s changed since it was read", storage.ErrContentOC, storagePath)
+	}
+	return nil
+}
+
+// primaryReader returns the StoreWriter, if it can be read, otherwise the Store
+func (r *CachingStore) primaryReader() blobs.Reader {
+	if reader, ok := r.StoreWriter.(blobs.Reader); ok {
+		return reader
+	}
+	return r.Store
+}
+
+// replace puts the object, conditional on the cached ETag, and caches the data
+// written so that the cache is consistent with storage.
+func (r *CachingStore) replace(
+	ctx context.Context, c *LogCache, massifIndex uint32, ty storage.ObjectType, data []byte) error {
+
+	err := r.put(ctx, c, massifIndex, ty, data, false)
+	if errors.Is(err, storage.ErrExistsOC) {
+		// The object was not cached, so it was required not to exist, and it
+		// was created by someone else since we looked.
+		return fmt.Errorf("%w: %v", storage.ErrContentOC, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, ok, err := c.native(massifIndex, ty)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("object index %d missing from cache after replace", massifIndex)
+	}
+	if err = c.setNative(massifIndex, withData(n, data), ty); err != nil {
+		return err
+	}
+	if ty == storage.ObjectMassifData {
+		r.cacheMassif(c, massifIndex, len(data))
+	}
+	return nil
+}
+
+func (r *CachingStore) put(
+	ctx context.Context, c *LogCache, massifIndex uint32, ty storage.ObjectType, data []byte, failIfExists bool) error {
 	if r.StoreWriter == nil {
 		return fmt.Errorf("store writer is required for put operations")
 	}
 
-	n, ok, err := r.Native(massifIndex, ty)
+	n, ok, err := c.native(massifIndex, ty)
 	if err != nil {
 		return err
 	}
@@ -38,8 +180,8 @@ func (r *CachingStore) Put(
 	if ok {
 		storagePath = n.BlobPath
 	} else {
-		// Determine massifHeight to use for v2 path format
-		var massifHeight uint8 = r.massifHeight // Default to stored massifHeight
+		// Determine massifHeight to use for the path layout
+		massifHeight := r.logMassifHeight(c) // Default to the log, or the stored, massifHeight
 
 		// For massifs, try to extract massifHeight from MassifStart header
 		if ty == storage.ObjectMassifStart || ty == storage.ObjectMassifData {
@@ -47,34 +189,28 @@ func (r *CachingStore) Put(
 				massifHeight = data[massifs.MassifStartKeyMassifHeightFirstByte]
 			}
 		}
-		// For checkpoints, use stored massifHeight (checkpoints don't have massifHeight in their data)
+		// For checkpoints, use the log massifHeight (checkpoints don't have massifHeight in their data)
 
-		// Use v2 format with determined massifHeight
-		basePrefix, err := storage.StorageObjectPrefixWithHeight(r.Selected.LogID, massifHeight, ty)
+		storagePath, err = r.layout.ObjectPath(c.LogID, massifHeight, ty, massifIndex)
 		if err != nil {
-			return fmt.Errorf("failed to get prefix path for type %v: %w", ty, err)
-		}
-
-		// Add Arbor service prefix (Azure may use different prefix in production)
-		var servicePrefix string
-		switch ty {
-		case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
-			servicePrefix = storage.V2MerklelogMassifsPrefix + "/"
-		case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
-			servicePrefix = storage.V2MerklelogCheckpointsPrefix + "/"
-		default:
-			return fmt.Errorf("unsupported object type: %v", ty)
+			return err
 		}
+	}
 
-		fullPrefix := servicePrefix + basePrefix
-		storagePath, err = storage.ObjectPath(fullPrefix, r.Selected.LogID, massifIndex, ty)
+	// The index tags are written with the data, so they are never stale. A
+	// massif shorter than its start header has nothing to derive them from,
+	// and is written without them, as all objects were before the tags.
+	var tags map[string]string
+	if ty == storage.ObjectCheckpoint || len(data) >= massifs.StartHeaderSize {
+		tags, err = r.objectTags(c, massifIndex, ty, data)
 		if err != nil {
-			return fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
+			return err
 		}
 	}
 
-	// Build Azure-specific options for optimistic concurrency control
-	var azureOpts []azblob.Option
+	// Build Azure-specific options for optimistic concurrency control. The MD5
+	// of the content is stored with it, so that readers can check it.
+	commitOpts := blobs.CommitOptions{Tags: tags, ContentMD5: blobs.ContentMD5(data)}
 
 	// Handle optimistic concurrency control
 	if failIfExists || !ok {
@@ -82,18 +218,23 @@ func (r *CachingStore) Put(
 		// For new blobs, ensure they don't already exist Note that in the !ok
 		// case, the caller should have read the blob first if replacing it and
 		// this enforces that.
-		azureOpts = append(azureOpts, azblob.WithEtagNoneMatch("*"))
+		commitOpts.IfNoneMatch = "*"
 	} else {
 		// For updates, use ETag for optimistic concurrency
 		if n.ETag != "" {
-			azureOpts = append(azureOpts, azblob.WithEtagMatch(n.ETag))
+			commitOpts.IfMatch = n.ETag
 		} else {
 			return fmt.Errorf("ETag required for non-creating put operations")
 		}
 	}
 
 	// Perform the write
-	wr, err := r.StoreWriter.Put(ctx, storagePath, azblob.NewBytesReaderCloser(data), azureOpts...)
+	var wr *azblob.WriteResponse
+	if r.blockWriter != nil && ty == storage.ObjectMassifData {
+		wr, err = r.putBlocks(ctx, c, massifIndex, storagePath, n, data, commitOpts)
+	} else {
+		wr, err = blobs.PutContent(ctx, r.StoreWriter, storagePath, data, commitOpts)
+	}
 	if err != nil {
 		return translateAzurePutError(err)
 	}
@@ -105,12 +246,60 @@ func (r *CachingStore) Put(
 	if wr.LastModified == nil {
 		return fmt.Errorf("LastModified is required for all writes but was nil")
 	}
-	if n == nil {
-		n = &blobs.LogBlobContext{
-			BlobPath: storagePath,
+	// The data previously read is not the data for the new ETag
+	updated := &blobs.LogBlobContext{BlobPath: storagePath}
+	if n != nil {
+		updated = withData(n, nil)
+	}
+	updated.WriteUpdate(wr)
+	updated.Tags = tags
+	updated.Stale = false
+
+	// The first massif written for a log establishes its height
+	if (ty == storage.ObjectMassifStart || ty == storage.ObjectMassifData) && c.massifHeight() == 0 &&
+		len(data) >= int(massifs.MassifStartKeyMassifHeightFirstByte+1) {
+		c.setMassifHeight(data[massifs.MassifStartKeyMassifHeightFirstByte])
+	}
+	if err = c.setNative(massifIndex, updated, ty); err != nil {
+		return err
+	}
+	if n != nil && n.Data != nil && ty != storage.ObjectCheckpoint {
+		r.uncacheMassif(c, massifIndex)
+	}
+	return nil
+}
+
+// objectTags returns the blob index tags written with an object. Massifs are
+// tagged with the firstindex and the lastid from the massif start, the lastid
+// is updated there as each leaf is added. Checkpoints are tagged with the
+// firstindex of the massif they seal and the lastid of the leaf which produced
+// the signed state. Both are tagged with the logid.
+func (r *CachingStore) objectTags(
+	c *LogCache, massifIndex uint32, ty storage.ObjectType, data []byte) (map[string]string, error) {
+	tags := map[string]string{}
+
+	switch ty {
+	case storage.ObjectMassifStart, storage.ObjectMassifData:
+		if len(data) < massifs.StartHeaderSize {
+			return nil, fmt.Errorf("massif %d is too short for its tags: %d bytes", massifIndex, len(data))
+		}
+		start := massifs.MassifStart{}
+		if err := start.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed to decode start for massif %d tags: %w", massifIndex, err)
 		}
+		SetFirstIndex(start.FirstIndex, tags)
+		tags[TagKeyLastID] = EncodeTagHex64(start.LastID)
+
+	case storage.ObjectCheckpoint:
+		_, state, err := massifs.DecodeSignedRoot(*r.codec, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode checkpoint %d tags: %w", massifIndex, err)
+		}
+		SetFirstIndex(massifs.MassifFirstLeaf(r.logMassifHeight(c), massifIndex), tags)
+		tags[TagKeyLastID] = EncodeTagHex64(state.IDTimestamp)
+	}
+	if len(c.LogID) > 0 {
+		SetLogID(c.LogID, tags)
 	}
-	// n is a pointer
-	n.WriteUpdate(wr)
-	return r.SetNative(massifIndex, n, ty)
+	return tags, nil
 }
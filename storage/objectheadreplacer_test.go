@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestVerifiedContext(t *testing.T, massifHeight uint8, massifIndex uint32, extra ...byte) *massifs.VerifiedContext {
+	data := newTestMassif(massifHeight, massifIndex, extra...)
+	vc := &massifs.VerifiedContext{
+		Sign1Message: newTestSign1Message(t, massifs.MMRState{MMRSize: 1}),
+	}
+	vc.MassifContext.Data = data
+	require.NoError(t, vc.MassifContext.Start.UnmarshalBinary(data))
+	return vc
+}
+
+func TestCachingStore_ReplaceVerifiedContext(t *testing.T) {
+	store := newTestBlobStore(t)
+	r := newTestStore(t, store, 3)
+	assert.Implements(t, (*VerifiedContextReplacer)(nil), r)
+	assert.True(t, r.HasCapability(VerifiedContextReplace))
+
+	logID := newTestLogID()
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(3, 0), true))
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectCheckpoint, newTestCheckpoint(t, massifs.MMRState{MMRSize: 1}), true))
+
+	vc := newTestVerifiedContext(t, 3, 0, 1, 2, 3)
+	require.NoError(t, r.ReplaceVerifiedContext(t.Context(), vc))
+
+	// the replaced data is cached, and written to storage
+	data, ok, err := r.MassifData(0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, vc.MassifContext.Data, data)
+	massifPath, err := r.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, vc.MassifContext.Data, store.stored(massifPath).data)
+	checkptPath, err := r.ObjectPath(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	checkpt, err := vc.Sign1Message.MarshalCBOR()
+	require.NoError(t, err)
+	assert.Equal(t, checkpt, store.stored(checkptPath).data)
+
+	// the cached etags are updated, so the context can be replaced again
+	require.NoError(t, r.ReplaceVerifiedContext(t.Context(), newTestVerifiedContext(t, 3, 0, 4)))
+
+	// a racing checkpoint write is detected before the massif is replaced
+	store.setBlob(checkptPath, newTestCheckpoint(t, massifs.MMRState{MMRSize: 3}))
+	err = r.ReplaceVerifiedContext(t.Context(), newTestVerifiedContext(t, 3, 0, 9))
+	assert.ErrorIs(t, err, storage.ErrContentOC)
+	assert.Equal(t, newTestMassif(3, 0, 4), store.stored(massifPath).data)
+
+	// a racing massif write is detected
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	store.setBlob(massifPath, newTestMassif(3, 0, 5))
+	err = r.ReplaceVerifiedContext(t.Context(), newTestVerifiedContext(t, 3, 0, 6))
+	assert.ErrorIs(t, err, storage.ErrContentOC)
+	assert.Equal(t, newTestMassif(3, 0, 5), store.stored(massifPath).data)
+
+	// a store which has not read the objects may not replace them
+	other, err := newTestStore(t, store, 3).Log(t.Context(), logID)
+	require.NoError(t, err)
+	err = other.ReplaceVerifiedContext(t.Context(), newTestVerifiedContext(t, 3, 0, 7))
+	assert.ErrorIs(t, err, storage.ErrContentOC)
+
+	// without a writer the operation is not supported
+	reader, err := NewStore(t.Context(), Options{Store: store}, 3)
+	require.NoError(t, err)
+	assert.False(t, reader.HasCapability(VerifiedContextReplace))
+	require.NoError(t, reader.SelectLog(t.Context(), logID))
+	err = reader.ReplaceVerifiedContext(t.Context(), newTestVerifiedContext(t, 3, 0, 8))
+	assert.ErrorIs(t, err, storage.ErrUnsupportedCap)
+}
+
+func TestCachingStore_PutTags(t *testing.T) {
+	for _, appendWrites := range []bool{false, true} {
+		t.Run(fmt.Sprintf("appendWrites=%v", appendWrites), func(t *testing.T) {
+			store := newTestBlobStore(t)
+			r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, AppendWrites: appendWrites}, 3)
+			require.NoError(t, err)
+			require.NoError(t, r.SelectLog(t.Context(), newTestLogID()))
+
+			// fill the first massif, so that the second starts part way into the log
+			mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 3)
+			require.NoError(t, err)
+			addTestLeaves(t, &mc, 4)
+			require.NoError(t, mc.StartNextMassif())
+			data := addTestLeaves(t, &mc, 1)
+			require.NoError(t, r.Put(t.Context(), 1, storage.ObjectMassifData, data, true))
+
+			massifPath, err := r.ObjectPath(1, storage.ObjectMassifData)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{
+				TagKeyFirstIndex: "0000000000000007",
+				TagKeyLastID:     EncodeTagHex64(mc.GetLastIDTimestamp()),
+				TagKeyLogID:      EncodeTagLogID(r.Selected.LogID),
+			}, store.stored(massifPath).tags)
+			n, ok, err := r.Native(1, storage.ObjectMassifData)
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, store.stored(massifPath).tags, n.Tags)
+
+			// the tags are replaced with the data
+			_, err = r.MassifReadN(t.Context(), 1, -1)
+			require.NoError(t, err)
+			addTestLeaves(t, &mc, 1)
+			require.NoError(t, r.Put(t.Context(), 1, storage.ObjectMassifData, mc.Data, false))
+			assert.Equal(t, EncodeTagHex64(mc.GetLastIDTimestamp()), GetLastIDHex(store.stored(massifPath).tags))
+
+			checkpt := newTestCheckpoint(t, massifs.MMRState{MMRSize: mc.RangeCount(), IDTimestamp: mc.GetLastIDTimestamp()})
+			require.NoError(t, r.Put(t.Context(), 1, storage.ObjectCheckpoint, checkpt, true))
+			checkptPath, err := r.ObjectPath(1, storage.ObjectCheckpoint)
+			require.NoError(t, err)
+			firstIndex, err := GetFirstIndex(store.stored(checkptPath).tags)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(7), firstIndex)
+			assert.Equal(t, EncodeTagHex64(mc.GetLastIDTimestamp()), GetLastIDHex(store.stored(checkptPath).tags))
+
+			// checkpoints which can not be tagged are not written
+			err = r.Put(t.Context(), 2, storage.ObjectCheckpoint, []byte("checkpoint"), true)
+			assert.Error(t, err)
+			checkptPath, err = r.ObjectPath(2, storage.ObjectCheckpoint)
+			require.NoError(t, err)
+			assert.NotContains(t, store.blobs, checkptPath)
+
+			// a massif shorter than its start header is written without them
+			require.NoError(t, r.Put(t.Context(), 2, storage.ObjectMassifData, data[:massifs.StartHeaderSize-1], true))
+			massifPath, err = r.ObjectPath(2, storage.ObjectMassifData)
+			require.NoError(t, err)
+			assert.Nil(t, store.stored(massifPath).tags)
+		})
+	}
+}
@@ -2,22 +2,24 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/datatrails/go-datatrails-common/azblob"
 	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
 // HeadIndex finds the last object and returns it's index without reading the
-// data. Uses the v2 path format with the massifHeight stored in the CachingStore instance.
+// data. Uses the store path layout with the massifHeight of the log, if it is
+// known, and otherwise the massifHeight stored in the CachingStore instance.
 func (r *CachingStore) HeadIndex(ctx context.Context, otype storage.ObjectType) (uint32, error) {
 	c := r.Selected
 	if c == nil {
 		return 0, storage.ErrLogNotSelected
 	}
-
-	return r.lastObjectWithHeight(ctx, c, r.massifHeight, otype)
+	return r.headIndex(ctx, c, otype)
 }
 
 func (r *CachingStore) MassifData(massifIndex uint32) ([]byte, bool, error) {
@@ -25,11 +27,7 @@ func (r *CachingStore) MassifData(massifIndex uint32) ([]byte, bool, error) {
 	if c == nil {
 		return nil, false, storage.ErrLogNotSelected
 	}
-	n, ok := c.Az.Massifs[massifIndex]
-	if !ok {
-		return nil, false, nil
-	}
-	return n.Data, true, nil
+	return r.massifData(c, massifIndex)
 }
 
 func (r *CachingStore) CheckpointData(massifIndex uint32) ([]byte, bool, error) {
@@ -37,95 +35,296 @@ func (r *CachingStore) CheckpointData(massifIndex uint32) ([]byte, bool, error)
 	if c == nil {
 		return nil, false, storage.ErrLogNotSelected
 	}
-	n, ok := c.Az.Checkpoints[massifIndex]
-	if !ok {
-		return nil, false, nil
-	}
-
-	return n.Data, true, nil
+	return r.checkpointData(c, massifIndex)
 }
 
-// ObjectPath constructs the storage path using the v2 path format with the massifHeight stored in the CachingStore instance.
+// ObjectPath constructs the storage path using the store path layout with the
+// massifHeight of the log, if it is known, and otherwise the massifHeight
+// stored in the CachingStore instance.
 func (r *CachingStore) ObjectPath(massifIndex uint32, otype storage.ObjectType) (string, error) {
 	c := r.Selected
 	if c == nil {
 		return "", storage.ErrLogNotSelected
 	}
+	return r.objectPath(c, massifIndex, otype)
+}
 
-	// Get base prefix from core function using stored massifHeight
-	basePrefix, err := storage.StorageObjectPrefixWithHeight(c.LogID, r.massifHeight, otype)
-	if err != nil {
-		return "", fmt.Errorf("failed to get prefix path for type %v: %w", otype, err)
+func (r *CachingStore) MassifReadN(ctx context.Context, massifIndex uint32, n int) ([]byte, error) {
+	c := r.Selected
+	if c == nil {
+		return nil, storage.ErrLogNotSelected
 	}
+	return r.massifReadN(ctx, c, massifIndex, n)
+}
 
-	// Add Arbor service prefix (Azure may use different prefix in production)
-	var servicePrefix string
-	switch otype {
-	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
-		servicePrefix = storage.V2MerklelogMassifsPrefix + "/"
-	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
-		servicePrefix = storage.V2MerklelogCheckpointsPrefix + "/"
-	default:
-		return "", fmt.Errorf("unsupported object type: %v", otype)
+func (r *CachingStore) CheckpointRead(ctx context.Context, massifIndex uint32) ([]byte, error) {
+	c := r.Selected
+	if c == nil {
+		return nil, storage.ErrLogNotSelected
 	}
+	return r.checkpointRead(ctx, c, massifIndex)
+}
 
-	// Combine service prefix with base format
-	fullPrefix := servicePrefix + basePrefix
+func (r *CachingStore) headIndex(ctx context.Context, c *LogCache, otype storage.ObjectType) (uint32, error) {
+	return r.lastObjectWithHeight(ctx, c, r.logMassifHeight(c), otype)
+}
 
-	storagePath, err := storage.ObjectPath(fullPrefix, c.LogID, massifIndex, otype)
+func (r *CachingStore) massifData(c *LogCache, massifIndex uint32) ([]byte, bool, error) {
+	n, ok, err := c.native(massifIndex, storage.ObjectMassifData)
 	if err != nil {
-		return "", fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
+		return nil, false, err
+	}
+	// The native context is kept when the massif data is released
+	ok = ok && n.Data != nil
+	r.cacheLookup(c, massifIndex, storage.ObjectMassifData, ok)
+	if !ok {
+		return nil, false, nil
 	}
-	return storagePath, nil
+	return n.Data, true, nil
 }
 
-func (r *CachingStore) MassifReadN(ctx context.Context, massifIndex uint32, n int) ([]byte, error) {
-	var err error
-	var storagePath string
-
-	c := r.Selected
-	if c == nil {
-		return nil, storage.ErrLogNotSelected
+func (r *CachingStore) checkpointData(c *LogCache, massifIndex uint32) ([]byte, bool, error) {
+	n, ok, err := c.native(massifIndex, storage.ObjectCheckpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	r.cacheLookup(c, massifIndex, storage.ObjectCheckpoint, ok && n.Data != nil)
+	if !ok {
+		return nil, false, nil
 	}
+	return n.Data, true, nil
+}
 
-	storagePath, err = r.ObjectPath(massifIndex, storage.ObjectMassifData)
+func (r *CachingStore) objectPath(c *LogCache, massifIndex uint32, otype storage.ObjectType) (string, error) {
+	return r.layout.ObjectPath(c.LogID, r.logMassifHeight(c), otype, massifIndex)
+}
+
+func (r *CachingStore) massifReadN(ctx context.Context, c *LogCache, massifIndex uint32, n int) ([]byte, error) {
+	storagePath, err := r.objectPath(c, massifIndex, storage.ObjectMassifData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
 	}
+	if data, ok, err := r.massifReadDisk(ctx, c, massifIndex, storagePath, n); ok || err != nil {
+		return data, err
+	}
+	return r.massifReadBlob(ctx, c, massifIndex, storagePath, n)
+}
 
+// massifReadBlob reads the massif from the store, bypassing the disk cache.
+// Full reads are written to the disk cache.
+func (r *CachingStore) massifReadBlob(
+	ctx context.Context, c *LogCache, massifIndex uint32, storagePath string, n int,
+) ([]byte, error) {
 	bc := &blobs.LogBlobContext{BlobPath: storagePath}
-	if n < 0 {
-		err = bc.ReadData(ctx, r.Store, azblob.WithGetTags())
-	} else {
-		err = bc.ReadDataN(ctx, n, r.Store, azblob.WithGetTags())
+	read := func() error {
+		if n < 0 {
+			return bc.ReadData(ctx, r.Store, azblob.WithGetTags())
+		}
+		return bc.ReadDataN(ctx, n, r.Store, azblob.WithGetTags())
 	}
+	err := read()
 	if err != nil {
 		return nil, err
 	}
+	// The tags are derived from the start header, shorter reads can't be checked
+	if r.validateTags && len(bc.Data) >= massifs.StartHeaderSize {
+		if err = r.checkTagsReread(c, massifIndex, storage.ObjectMassifData, bc, read); err != nil {
+			return nil, err
+		}
+	}
 	// Note: we store the data in the massif place because any reference to the massif will read the rest of the data,
 	// but the start is guaranteed to be available after this call.
-	c.Az.Massifs[massifIndex] = bc
+	if err = c.setNative(massifIndex, bc, storage.ObjectMassifData); err != nil {
+		return nil, err
+	}
+	r.cacheMassif(c, massifIndex, len(bc.Data))
+	if n < 0 {
+		r.diskPut(bc)
+	}
+
+	// The start header is always first, so it is available for any complete
+	// read and for most partial reads.
+	if _, ok := c.start(massifIndex); !ok && len(bc.Data) >= massifs.StartHeaderSize {
+		start := &massifs.MassifStart{}
+		if err = start.UnmarshalBinary(bc.Data); err != nil {
+			return nil, fmt.Errorf("failed to decode start for massif %d: %w", massifIndex, err)
+		}
+		c.setStart(massifIndex, start)
+	}
 	return bc.Data, nil
 }
 
-func (r *CachingStore) CheckpointRead(ctx context.Context, massifIndex uint32) ([]byte, error) {
+// massifReadDisk reads the massif from the disk cache, returning false if it
+// is not cached. A complete massif can not change, so it is returned without
+// a request. An incomplete massif, the head of the log, is refreshed from the
+// store, unless only the first n bytes are required.
+func (r *CachingStore) massifReadDisk(
+	ctx context.Context, c *LogCache, massifIndex uint32, storagePath string, n int,
+) ([]byte, bool, error) {
+	if r.diskCache == nil {
+		return nil, false, nil
+	}
+	bc, ok := r.diskCache.get(r.diskCacheStore, storagePath)
+	if !ok {
+		return nil, false, nil
+	}
+
+	mc := massifs.MassifContext{}
+	mc.Data = bc.Data
+	if err := mc.Start.UnmarshalBinary(bc.Data); err != nil || uint64(len(bc.Data)) < mc.LogStart() {
+		r.diskCache.remove(r.diskCacheStore, storagePath)
+		return nil, false, nil
+	}
+	complete := mc.Start.MassifHeight > 0 && mc.MassifLeafCount() >= uint64(1)<<(mc.Start.MassifHeight-1)
+	if !complete && n >= 0 {
+		return nil, false, nil
+	}
+	if complete && r.validateTags {
+		if err := r.checkTags(c, massifIndex, storage.ObjectMassifData, bc); err != nil {
+			r.diskCache.remove(r.diskCacheStore, storagePath)
+			return nil, false, nil
+		}
+	}
+
+	if err := c.setNative(massifIndex, bc, storage.ObjectMassifData); err != nil {
+		return nil, true, err
+	}
+	if !complete {
+		data, err := r.massifRefresh(ctx, c, massifIndex)
+		return data, true, err
+	}
+	r.cacheMassif(c, massifIndex, len(bc.Data))
+	if _, ok := c.start(massifIndex); !ok {
+		start := mc.Start
+		c.setStart(massifIndex, &start)
+	}
+	if n >= 0 && n < len(bc.Data) {
+		return bc.Data[:n], true, nil
+	}
+	return bc.Data, true, nil
+}
+
+// diskPut writes the blob to the disk cache, if there is one. The cache is
+// an optimization, failures to write it are ignored.
+func (r *CachingStore) diskPut(bc *blobs.LogBlobContext) {
+	if r.diskCache == nil {
+		return
+	}
+	_ = r.diskCache.put(r.diskCacheStore, bc)
+}
+
+func (r *CachingStore) checkpointRead(ctx context.Context, c *LogCache, massifIndex uint32) ([]byte, error) {
 	var err error
 	var storagePath string
 
-	c := r.Selected
-	if c == nil {
-		return nil, storage.ErrLogNotSelected
-	}
-	storagePath, err = r.ObjectPath(massifIndex, storage.ObjectCheckpoint)
+	storagePath, err = r.objectPath(c, massifIndex, storage.ObjectCheckpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
 	}
 
+	// A checkpoint from the disk cache is only read again if it has changed
 	bc := &blobs.LogBlobContext{BlobPath: storagePath}
-	err = bc.ReadData(ctx, r.Store, azblob.WithGetTags())
+	if r.diskCache != nil {
+		if cached, ok := r.diskCache.get(r.diskCacheStore, storagePath); ok {
+			bc = cached
+		}
+	}
+	modified, err := bc.ReadDataIfModified(ctx, r.Store, azblob.WithGetTags())
 	if err != nil {
 		return nil, err
 	}
-	c.Az.Checkpoints[massifIndex] = bc
+	if modified && r.validateTags {
+		read := func() error { return bc.ReadData(ctx, r.Store, azblob.WithGetTags()) }
+		if err = r.checkTagsReread(c, massifIndex, storage.ObjectCheckpoint, bc, read); err != nil {
+			return nil, err
+		}
+	}
+	// The checkpoint is verified again only if it has changed since it was
+	// last verified.
+	var checkpt *massifs.Checkpoint
+	if r.checkpointKeys != nil {
+		var ok bool
+		if checkpt, ok = c.checkpointVerified(massifIndex, bc.ETag); !ok {
+			if checkpt, err = r.verifyCheckpoint(ctx, c, massifIndex, bc.Data); err != nil {
+				return nil, err
+			}
+			if err = r.checkCheckpointConsistency(ctx, c, checkpt); err != nil {
+				return nil, err
+			}
+			c.setCheckpointVerified(massifIndex, bc.ETag, checkpt)
+			r.cacheVerified(c, massifIndex, len(bc.Data))
+		}
+	}
+	if modified {
+		r.diskPut(bc)
+	}
+	if err = c.setNative(massifIndex, bc, storage.ObjectCheckpoint); err != nil {
+		return nil, err
+	}
+	if checkpt != nil {
+		c.setCheckpoint(massifIndex, checkpt)
+	}
 	return bc.Data, nil
 }
+
+// checkTagsReread checks the tags read with an object, reading it once more
+// if the lastid tag doesn't match. The tags are not read in the same request
+// as the content, so an object which is being updated, such as the head
+// massif of an active log, can be read with the tags of another version.
+func (r *CachingStore) checkTagsReread(
+	c *LogCache, massifIndex uint32, ty storage.ObjectType, bc *blobs.LogBlobContext, read func() error) error {
+	err := r.checkTags(c, massifIndex, ty, bc)
+	if !errors.Is(err, ErrIncorrectLastIDTag) {
+		return err
+	}
+	if err = read(); err != nil {
+		return err
+	}
+	return r.checkTags(c, massifIndex, ty, bc)
+}
+
+// checkTags checks the index tags read with an object match those which Put
+// derives from its content.
+func (r *CachingStore) checkTags(
+	c *LogCache, massifIndex uint32, ty storage.ObjectType, bc *blobs.LogBlobContext) error {
+	want, err := r.objectTags(c, massifIndex, ty, bc.Data)
+	if err != nil {
+		return err
+	}
+
+	firstIndex, err := GetFirstIndex(bc.Tags)
+	if err != nil {
+		return fmt.Errorf("%s: %w", bc.BlobPath, err)
+	}
+	wantFirstIndex, err := GetFirstIndex(want)
+	if err != nil {
+		return err
+	}
+	if firstIndex != wantFirstIndex {
+		return fmt.Errorf("%w: %s has %d, expected %d", ErrIncorrectFirstIndexTag, bc.BlobPath, firstIndex, wantFirstIndex)
+	}
+
+	lastIDHex := GetLastIDHex(bc.Tags)
+	if lastIDHex == "" {
+		return fmt.Errorf("%s: %w", bc.BlobPath, ErrMissingLastIDTag)
+	}
+	lastID, err := DecodeTagHex64(lastIDHex)
+	if err != nil {
+		return fmt.Errorf("%s: %w", bc.BlobPath, err)
+	}
+	wantLastID, err := DecodeTagHex64(GetLastIDHex(want))
+	if err != nil {
+		return err
+	}
+	if lastID != wantLastID {
+		return fmt.Errorf("%w: %s has %x, expected %x", ErrIncorrectLastIDTag, bc.BlobPath, lastID, wantLastID)
+	}
+
+	// The logid tag is optional, objects written before it was introduced
+	// don't have it.
+	logIDHex := GetLogIDHex(bc.Tags)
+	if wantLogIDHex := GetLogIDHex(want); logIDHex != "" && logIDHex != wantLogIDHex {
+		return fmt.Errorf("%w: %s has %s, expected %s", ErrIncorrectLogIDTag, bc.BlobPath, logIDHex, wantLogIDHex)
+	}
+	return nil
+}
@@ -6,9 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"weak"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
 	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	commoncbor "github.com/forestrie/go-merklelog/massifs/cbor"
 	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
@@ -16,15 +22,88 @@ import (
 type Options struct {
 	Store       azureReader // This is the native interface for the storage provider, Azure Blob Storage
 	StoreWriter azureWriter
+
+	// MaxCacheBytes limits the total size of the state cached for the massifs.
+	// When exceeded, the least recently used is released. Zero means unlimited.
+	MaxCacheBytes int64
+	// MaxCacheLogs limits the number of logs cached. When exceeded, the least
+	// recently used logs are dropped. Zero means unlimited.
+	MaxCacheLogs int
+
+	// DiscoverMassifHeight causes SelectLog and Log to discover the massif
+	// height of each log from storage, rather than assume the massifHeight the
+	// store was created with. The store massifHeight is tried first, and is
+	// used for logs which do not exist yet.
+	DiscoverMassifHeight bool
+
+	// PathLayout determines the blob paths for the log objects. Defaults to
+	// V2PathLayout, use V1PathLayout to read legacy datatrails tenant logs.
+	PathLayout PathLayout
+
+	// AppendWrites causes each Put of massif data to stage only the blocks
+	// which differ from the cached massif data. The StoreWriter must implement
+	// blobs.BlockWriter or provide the azure sdk container client.
+	AppendWrites bool
+	// AppendBlockSize is the most bytes staged in each new block, at most
+	// blobs.MaxBlockSize. Defaults to DefaultAppendBlockSize. Massifs which
+	// would need more than blobs.MaxCommittedBlocks are written in a single put.
+	AppendBlockSize int
+
+	// ValidateTags causes MassifReadN and CheckpointRead to check the
+	// firstindex and lastid index tags read with each object against its
+	// content. Objects whose tags do not match are not cached, and the read
+	// fails with ErrMissingFirstIndexTag, ErrIncorrectFirstIndexTag,
+	// ErrMissingLastIDTag or ErrIncorrectLastIDTag.
+	ValidateTags bool
+
+	// Retry, if set, decorates the Store and the StoreWriter with
+	// blobs.RetryStore, so that operations which fail with a transient error
+	// are retried with exponential backoff.
+	Retry *blobs.RetryOptions
+
+	// DiskCache, if set, keeps the massif and checkpoint blobs read by the
+	// store on local disk. Complete massifs are served from it without a
+	// request. The Store must have a blobs.StoreIdentity.
+	DiskCache *DiskCache
+
+	// CheckpointKeys, if set, causes CheckpointRead to verify the signature of
+	// each checkpoint it reads, and its consistency with the largest
+	// checkpoint previously verified for the log.
+	CheckpointKeys CheckpointKeyResolver
 }
 
+// CachingStore reads and writes merklelog objects in azure blob storage and
+// caches the native blob contexts for each log it has seen. The Selected log is
+// not safe for concurrent use, use a LogHandle for each log instead.
 type CachingStore struct {
-	Store        azureReader
-	StoreWriter  azureWriter
-	massifHeight uint8
-
+	Store         azureReader
+	StoreWriter   azureWriter
+	massifHeight  uint8
+	maxCacheBytes int64
+	maxCacheLogs  int
+
+	discoverMassifHeight bool
+	layout               PathLayout
+	appendWrites         bool
+	appendBlockSize      int
+	validateTags         bool
+	blockWriter          blobs.BlockWriter // Set only for appendWrites
+	diskCache            *DiskCache
+	diskCacheStore       string // The identity of the Store in the diskCache
+	checkpointKeys       CheckpointKeyResolver
+	codec                *commoncbor.CBORCodec
+
+	// mu guards LogCache, lru and detached
+	mu       sync.Mutex
+	lru      *cacheLRU
 	LogCache map[string]*LogCache
 	Selected *LogCache
+
+	// detached holds the logs evicted from the cache, so that a log still held
+	// by a handle is attached again, rather than replaced, when it is next
+	// obtained. liveDetached is the number of entries at the last pruning.
+	detached     map[string]weak.Pointer[LogCache]
+	liveDetached int
 }
 
 func NewStore(
@@ -39,37 +118,51 @@ func NewStore(
 
 func MakeCachingStore(
 	ctx context.Context, opts Options, massifHeight uint8,
-) (CachingStore, error) {
+) (cachingReader CachingStore, err error) {
+
+	if opts.Retry != nil {
+		if opts.Store != nil {
+			opts.Store = blobs.NewRetryStore(opts.Store, *opts.Retry)
+		}
+		if opts.StoreWriter != nil {
+			opts.StoreWriter = blobs.NewRetryStore(opts.StoreWriter, *opts.Retry)
+		}
+	}
 
-	cachingReader := CachingStore{
-		Store:        opts.Store,
-		StoreWriter:  opts.StoreWriter,
-		massifHeight: massifHeight,
+	cachingReader = CachingStore{
+		Store:         opts.Store,
+		StoreWriter:   opts.StoreWriter,
+		massifHeight:  massifHeight,
+		maxCacheBytes: opts.MaxCacheBytes,
+		maxCacheLogs:  opts.MaxCacheLogs,
+
+		discoverMassifHeight: opts.DiscoverMassifHeight,
+		layout:               opts.PathLayout,
+		appendWrites:         opts.AppendWrites,
+		appendBlockSize:      opts.AppendBlockSize,
+		validateTags:         opts.ValidateTags,
+		diskCache:            opts.DiskCache,
+		diskCacheStore:       blobs.StoreIdentity(opts.Store),
+		checkpointKeys:       opts.CheckpointKeys,
 	}
 
-	if err := cachingReader.Init(ctx); err != nil {
+	if err = cachingReader.Init(ctx); err != nil {
 		return CachingStore{}, err
 	}
-	return cachingReader, nil
+	// The store is unlocked, returning the named result avoids copying its
+	// mutex explicitly.
+	return
 }
 
-/*
-// ReplaceVerifiedContext implements verified context replacement for Azure storage
-// For Azure blob storage, this operation is not currently supported as it would require
-// complex blob replacement logic with optimistic concurrency control
-func (r *CachingStore) ReplaceVerifiedContext(ctx context.Context, vc *massifs.VerifiedContext) error {
-	// Azure blob storage doesn't support atomic verified context replacement
-	// This would require:
-	// 1. Encoding the verified context back to blob format
-	// 2. Replacing the blob with proper ETag handling
-	// 3. Updating any associated metadata/checkpoints
-	//
-	// For now, return unsupported error - this can be implemented if needed
-	return storage.ErrUnsupportedCap
-}*/
-
 func (r *CachingStore) DropLog(logID storage.LogID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.LogCache[string(logID)]; ok {
+		releaseCached(r.cache().removeLog(c))
+	}
 	delete(r.LogCache, string(logID))
+	delete(r.detached, string(logID))
 	// if we are currently selected, drop the selected log cache
 	if r.Selected != nil && bytes.Equal(r.Selected.LogID, logID) {
 		r.Selected = nil // drop the selected log cache
@@ -85,36 +178,34 @@ func (r *CachingStore) SelectLog(ctx context.Context, logId storage.LogID) error
 		return nil // already selected
 	}
 
-	// if we don't have a log cache, create one
-	if r.LogCache == nil {
-		r.LogCache = make(map[string]*LogCache)
-	}
-
-	c, ok := r.LogCache[string(logId)]
-	if !ok {
-		c = r.newLogCache(logId)
-		r.LogCache[string(logId)] = c
+	c := r.logCache(logId)
+	if err := r.discoverLogMassifHeight(ctx, c); err != nil {
+		return err
 	}
 	r.Selected = c
 
 	return nil
 }
 
+// Log returns a handle for reading and writing the identified log, it does not
+// depend on, or change, the selected log.
+func (r *CachingStore) Log(ctx context.Context, logID storage.LogID) (*LogHandle, error) {
+	if logID == nil {
+		return nil, fmt.Errorf("logId cannot be nil")
+	}
+	c := r.logCache(logID)
+	if err := r.discoverLogMassifHeight(ctx, c); err != nil {
+		return nil, err
+	}
+	return &LogHandle{store: r, cache: c}, nil
+}
+
 func (r *CachingStore) SetNative(massifIndex uint32, native *blobs.LogBlobContext, ty storage.ObjectType) error {
 	c := r.Selected
 	if c == nil {
 		return storage.ErrLogNotSelected
 	}
-
-	switch ty {
-	case storage.ObjectMassifStart, storage.ObjectMassifData:
-		c.Az.Massifs[massifIndex] = native
-	case storage.ObjectCheckpoint:
-		c.Az.Checkpoints[massifIndex] = native
-	default:
-		return fmt.Errorf("unsupported object type %v", ty)
-	}
-	return nil
+	return c.setNative(massifIndex, native, ty)
 }
 
 func (r *CachingStore) Native(massifIndex uint32, otype storage.ObjectType) (*blobs.LogBlobContext, bool, error) {
@@ -123,26 +214,26 @@ func (r *CachingStore) Native(massifIndex uint32, otype storage.ObjectType) (*bl
 	if c == nil {
 		return nil, false, storage.ErrLogNotSelected
 	}
-
-	var n *blobs.LogBlobContext
-	var ok bool
-
-	switch otype {
-	case storage.ObjectMassifStart, storage.ObjectMassifData:
-		n, ok = c.Az.Massifs[massifIndex]
-
-	case storage.ObjectCheckpoint:
-		n, ok = c.Az.Checkpoints[massifIndex]
-	default:
-		return nil, false, fmt.Errorf("unsupported object type %v", otype)
-	}
-	return n, ok, nil
+	return c.native(massifIndex, otype)
 }
 
 func (r *CachingStore) Init(ctx context.Context) error {
 	if err := r.checkOptions(); err != nil {
 		return err
 	}
+	if r.layout == nil {
+		r.layout = V2PathLayout{}
+	}
+	if err := r.initAppendWrites(); err != nil {
+		return err
+	}
+	if r.codec == nil {
+		codec, err := massifs.NewCBORCodec()
+		if err != nil {
+			return err
+		}
+		r.codec = &codec
+	}
 	r.reset()
 
 	return nil
@@ -151,20 +242,213 @@ func (r *CachingStore) newLogCache(logID storage.LogID) *LogCache {
 	return NewLogCache(logID)
 }
 
+// logCache returns the cache for the log, creating it if necessary
+func (r *CachingStore) logCache(logID storage.LogID) *LogCache {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// if we don't have a log cache, create one
+	if r.LogCache == nil {
+		r.LogCache = make(map[string]*LogCache)
+	}
+
+	c, ok := r.LogCache[string(logID)]
+	if !ok {
+		if c = r.detached[string(logID)].Value(); c != nil {
+			delete(r.detached, string(logID))
+		} else {
+			c = r.newLogCache(logID)
+		}
+	}
+	r.attach(c)
+	return c
+}
+
+// useLog records a use of the log through a handle. A log which was evicted
+// while the handle held it is attached again, one which was dropped is not.
+func (r *CachingStore) useLog(c *LogCache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cur, ok := r.LogCache[string(c.LogID)]; ok {
+		if cur == c {
+			r.attach(c)
+		}
+		return
+	}
+	if r.detached[string(c.LogID)].Value() == c {
+		delete(r.detached, string(c.LogID))
+		r.attach(c)
+	}
+}
+
+// attach marks the log as the most recently used, adding it to the cache if
+// it is not there, and drops the logs evicted to make room. r.mu must be held.
+func (r *CachingStore) attach(c *LogCache) {
+	if r.LogCache == nil {
+		r.LogCache = make(map[string]*LogCache)
+	}
+	r.LogCache[string(c.LogID)] = c
+
+	// The selected log is in use by definition, so it is never evicted.
+	evicted, released := r.cache().touchLog(c, r.Selected)
+	for _, victim := range evicted {
+		r.detach(victim)
+	}
+	releaseCached(released)
+}
+
+// detach drops the evicted log from the cache, remembering it until it is no
+// longer referenced. r.mu must be held.
+func (r *CachingStore) detach(c *LogCache) {
+	delete(r.LogCache, string(c.LogID))
+	if r.detached == nil {
+		r.detached = make(map[string]weak.Pointer[LogCache])
+	}
+	r.detached[string(c.LogID)] = weak.Make(c)
+
+	// Prune the logs which have been collected once the entries have doubled
+	if len(r.detached) <= 2*r.liveDetached {
+		return
+	}
+	for logID, p := range r.detached {
+		if p.Value() == nil {
+			delete(r.detached, logID)
+		}
+	}
+	r.liveDetached = len(r.detached)
+}
+
+// Stats returns a snapshot of the cache statistics
+func (r *CachingStore) Stats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cache().snapshot()
+}
+
+// cacheMassif accounts for newly read massif data, releasing the least
+// recently used massif data if the budget is exceeded.
+func (r *CachingStore) cacheMassif(c *LogCache, massifIndex uint32, size int) {
+	r.cacheBytes(massifKey{c: c, massifIndex: massifIndex}, int64(size))
+}
+
+// cacheRanges accounts for the current size of the sparse ranges cached for
+// the massif, releasing the least recently used massif data if the budget is
+// exceeded.
+func (r *CachingStore) cacheRanges(c *LogCache, massifIndex uint32, size int64) {
+	r.cacheBytes(massifKey{c: c, massifIndex: massifIndex, kind: cacheMassifRanges}, size)
+}
+
+// cacheBlocks accounts for the blocks last committed for the massif
+func (r *CachingStore) cacheBlocks(c *LogCache, massifIndex uint32, size int64) {
+	r.cacheBytes(massifKey{c: c, massifIndex: massifIndex, kind: cacheMassifBlocks}, size)
+}
+
+// cacheVerified accounts for the checkpoint verified for the massif. The size
+// is that of the encoded checkpoint. The largest checkpoint verified for the
+// log is not accounted, it is the reference for the consistency checks and is
+// kept for as long as the log is.
+func (r *CachingStore) cacheVerified(c *LogCache, massifIndex uint32, size int) {
+	r.cacheBytes(massifKey{c: c, massifIndex: massifIndex, kind: cacheVerified}, int64(size))
+}
+
+// uncacheMassif stops accounting for the massif data, which has been dropped
+func (r *CachingStore) uncacheMassif(c *LogCache, massifIndex uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache().forgetMassif(massifKey{c: c, massifIndex: massifIndex})
+}
+
+func (r *CachingStore) cacheBytes(key massifKey, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	releaseCached(r.cache().touchMassif(key, size))
+}
+
+// releaseCached releases the cached state no longer accounted by the lru
+func releaseCached(keys []massifKey) {
+	for _, key := range keys {
+		switch key.kind {
+		case cacheMassifData:
+			key.c.releaseMassifData(key.massifIndex)
+		case cacheMassifRanges:
+			key.c.releaseMassifRanges(key.massifIndex)
+		case cacheMassifBlocks:
+			key.c.releaseMassifBlocks(key.massifIndex)
+		case cacheVerified:
+			key.c.releaseCheckpointVerified(key.massifIndex)
+		}
+	}
+}
+
+// cacheLookup accounts for a cache lookup, and marks the massif data as
+// recently used on a hit.
+func (r *CachingStore) cacheLookup(c *LogCache, massifIndex uint32, otype storage.ObjectType, hit bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !hit {
+		r.cache().stats.Misses++
+		return
+	}
+	r.cache().stats.Hits++
+	if otype == storage.ObjectMassifData {
+		r.cache().useMassif(massifKey{c: c, massifIndex: massifIndex})
+	}
+}
+
+// rangeLookup accounts for a lookup of a massif range, and marks the source of
+// the range as recently used on a hit.
+func (r *CachingStore) rangeLookup(key massifKey, hit bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !hit {
+		r.cache().stats.Misses++
+		return
+	}
+	r.cache().stats.Hits++
+	r.cache().useMassif(key)
+}
+
 func (r *CachingStore) checkOptions() error {
 
 	if r.Store == nil {
 		return fmt.Errorf("store reader is required")
 	}
+	if r.appendBlockSize < 0 || r.appendBlockSize > blobs.MaxBlockSize {
+		return fmt.Errorf("append block size %d must be at most %d", r.appendBlockSize, blobs.MaxBlockSize)
+	}
+	// Stores without an identity would share the disk cache entries
+	if r.diskCache != nil && r.diskCacheStore == "" {
+		return fmt.Errorf("the disk cache requires a store with an identity, see blobs.StoreIdentity")
+	}
 
 	return nil
 }
 
 func (r *CachingStore) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	// assuming there are no deep references to the values in the maps, this will
 	// release the maps to GC
 	r.LogCache = nil // lazily created
 	r.Selected = nil
+	r.detached = nil
+	r.liveDetached = 0
+	r.lru = newCacheLRU(r.maxCacheBytes, r.maxCacheLogs)
+}
+
+// cache returns the lru, creating it for a store which was not initialised.
+// r.mu must be held.
+func (r *CachingStore) cache() *cacheLRU {
+	if r.lru == nil {
+		r.lru = newCacheLRU(r.maxCacheBytes, r.maxCacheLogs)
+	}
+	return r.lru
 }
 
 func (r *CachingStore) lastPrefixedObject(ctx context.Context, prefixPath string) (*blobs.LogBlobContext, uint32, error) {
@@ -179,27 +463,116 @@ func (r *CachingStore) lastPrefixedObject(ctx context.Context, prefixPath string
 	return &bc, uint32(count - 1), nil
 }
 
-// lastObjectWithHeight finds the last object using the v2 path format.
-func (r *CachingStore) lastObjectWithHeight(ctx context.Context, c *LogCache, massifHeight uint8, otype storage.ObjectType) (uint32, error) {
-	// Get base prefix from core function
-	basePrefix, err := storage.StorageObjectPrefixWithHeight(c.LogID, massifHeight, otype)
+// logMassifHeight returns the massif height of the log, if it is known, and
+// otherwise the massif height the store was created with.
+func (r *CachingStore) logMassifHeight(c *LogCache) uint8 {
+	if massifHeight := c.massifHeight(); massifHeight != 0 {
+		return massifHeight
+	}
+	return r.massifHeight
+}
+
+// discoverLogMassifHeight finds the massif height of the log, if the store is
+// configured to do so and the height is not already known.
+//
+// The massifs prefix for the store height is listed first. If the layout puts
+// the height in the path, as the v2 paths do, and nothing is found there, the
+// log is found by its logid tag instead. The height is taken from the path of
+// the first massif found, or from its start header if the path has none. If the
+// log has no massifs the height remains unknown, it will be set by the first
+// massif Put.
+func (r *CachingStore) discoverLogMassifHeight(ctx context.Context, c *LogCache) error {
+	if !r.discoverMassifHeight || c.massifHeight() != 0 {
+		return nil
+	}
+
+	prefix, err := r.layout.ObjectPrefix(c.LogID, r.massifHeight, storage.ObjectPathMassifs)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	bc, err := blobs.FirstPrefixedBlob(ctx, r.Store, prefix)
+	if err != nil && !errors.Is(err, blobs.ErrBlobNotFound) {
+		return translateAzureError(err, err)
+	}
+	if bc.BlobPath == "" && r.layoutHasHeight(c) {
+		if bc.BlobPath, err = r.taggedMassifPath(ctx, c); err != nil {
+			return err
+		}
+	}
+	if bc.BlobPath == "" {
+		return nil
 	}
 
-	// Add Arbor service prefix (Azure may use different prefix in production)
-	var servicePrefix string
-	switch otype {
-	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
-		servicePrefix = storage.V2MerklelogMassifsPrefix + "/"
-	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
-		servicePrefix = storage.V2MerklelogCheckpointsPrefix + "/"
-	default:
-		return 0, fmt.Errorf("unsupported object type %v", otype)
+	info, err := r.layout.ParsePath(bc.BlobPath)
+	if err != nil {
+		return err
+	}
+	if info.MassifHeight != 0 {
+		c.setMassifHeight(info.MassifHeight)
+		return nil
+	}
+
+	if err = bc.ReadDataN(ctx, massifs.StartHeaderSize, r.Store); err != nil {
+		return err
+	}
+	start := massifs.MassifStart{}
+	if err = start.UnmarshalBinary(bc.Data); err != nil {
+		return fmt.Errorf("failed to decode start for %s: %w", bc.BlobPath, err)
 	}
+	c.setMassifHeight(start.MassifHeight)
+	return nil
+}
+
+// layoutHasHeight returns true if the massif paths of the log depend on the
+// massif height
+func (r *CachingStore) layoutHasHeight(c *LogCache) bool {
+	prefix, err := r.layout.ObjectPrefix(c.LogID, r.massifHeight, storage.ObjectPathMassifs)
+	if err != nil {
+		return false
+	}
+	other, err := r.layout.ObjectPrefix(c.LogID, r.massifHeight+1, storage.ObjectPathMassifs)
+	return err == nil && other != prefix
+}
+
+// taggedMassifPath queries the blob index for a massif of the log by its logid
+// tag, and returns its path, or "" if there is none. Objects written before the
+// tag was introduced are not found.
+func (r *CachingStore) taggedMassifPath(ctx context.Context, c *LogCache) (string, error) {
+	tagsFilter := fmt.Sprintf(`"%s"='%s'`, TagKeyLogID, EncodeTagLogID(c.LogID))
+
+	var marker azblob.ListMarker
+	for {
+		var opts []azblob.Option
+		if marker != nil && *marker != "" {
+			opts = append(opts, azblob.WithListMarker(marker))
+		}
+		filtered, err := r.Store.FilteredList(ctx, tagsFilter, opts...)
+		if err != nil {
+			return "", translateAzureError(err, err)
+		}
+		for _, it := range filtered.Items {
+			if it.Name == nil {
+				continue
+			}
+			info, err := r.layout.ParsePath(*it.Name)
+			if err == nil && info.Type == storage.ObjectMassifData && bytes.Equal(info.LogID, c.LogID) {
+				return *it.Name, nil
+			}
+		}
+		marker = filtered.Marker
+		if marker == nil || *marker == "" {
+			return "", nil
+		}
+	}
+}
 
-	// Combine service prefix with base format
-	fullPrefix := servicePrefix + basePrefix
+// lastObjectWithHeight finds the last object by listing the prefix for the
+// object type.
+func (r *CachingStore) lastObjectWithHeight(ctx context.Context, c *LogCache, massifHeight uint8, otype storage.ObjectType) (uint32, error) {
+	fullPrefix, err := r.layout.ObjectPrefix(c.LogID, massifHeight, otype)
+	if err != nil {
+		return 0, err
+	}
 
 	switch otype {
 	case storage.ObjectMassifStart, storage.ObjectMassifData:
@@ -207,17 +580,13 @@ func (r *CachingStore) lastObjectWithHeight(ctx context.Context, c *LogCache, ma
 		if err != nil {
 			return 0, fmt.Errorf("failed to get last prefixed object for massif: %w", err)
 		}
-		r.Selected.Az.Massifs[massifIndex] = bc
-		r.Selected.LastMassifIndex = massifIndex
-		return massifIndex, nil
+		return massifIndex, c.setHead(massifIndex, bc, otype)
 	case storage.ObjectCheckpoint:
 		bc, massifIndex, err := r.lastPrefixedObject(ctx, fullPrefix)
 		if err != nil {
 			return 0, fmt.Errorf("failed to get last prefixed object for checkpoint: %w", err)
 		}
-		c.Az.Checkpoints[massifIndex] = bc
-		c.LastCheckpointIndex = massifIndex
-		return massifIndex, nil
+		return massifIndex, c.setHead(massifIndex, bc, otype)
 	default:
 		return 0, fmt.Errorf("unsupported object type %v", otype)
 	}
@@ -241,6 +610,21 @@ func isAzureBlobNotFoundError(err error) bool {
 	return false
 }
 
+// azureErrorStatus returns the http status code, and the storage error code if
+// available, for both the storage and the core azure sdk error types.
+func azureErrorStatus(err error) (int, azStorageBlob.StorageErrorCode, bool) {
+	var storageError *azStorageBlob.StorageError
+	if errors.As(err, &storageError) {
+		resp := storageError.Response()
+		return resp.StatusCode, storageError.ErrorCode, true
+	}
+	var responseError *azcore.ResponseError
+	if errors.As(err, &responseError) {
+		return responseError.StatusCode, azStorageBlob.StorageErrorCode(responseError.ErrorCode), true
+	}
+	return 0, "", false
+}
+
 // translateAzureError translates Azure-specific errors to standard storage errors
 func translateAzureError(err error, fallback error) error {
 	if err == nil {
@@ -248,24 +632,22 @@ func translateAzureError(err error, fallback error) error {
 	}
 
 	// Use the same error handling pattern as logblobcontext.go
-	var storageError *azStorageBlob.StorageError
-	if errors.As(err, &storageError) {
-		resp := storageError.Response()
-		switch resp.StatusCode {
-		case http.StatusNotFound:
-			return storage.ErrDoesNotExist
-		case http.StatusForbidden:
-			return storage.ErrNotAvailable // Permission denied
-		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
-			return storage.ErrNotAvailable // Throttling or service unavailable
-		case http.StatusPreconditionFailed:
-			return storage.ErrContentOC // Precondition failed (ETag mismatch)
-		default:
-			return fallback
-		}
+	statusCode, _, ok := azureErrorStatus(err)
+	if !ok {
+		return fallback
+	}
+	switch statusCode {
+	case http.StatusNotFound:
+		return storage.ErrDoesNotExist
+	case http.StatusForbidden:
+		return storage.ErrNotAvailable // Permission denied
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return storage.ErrNotAvailable // Throttling or service unavailable
+	case http.StatusPreconditionFailed:
+		return storage.ErrContentOC // Precondition failed (ETag mismatch)
+	default:
+		return fallback
 	}
-
-	return fallback
 }
 
 // translateAzurePutError translates Azure put-specific errors to standard storage errors
@@ -274,33 +656,30 @@ func translateAzurePutError(err error) error {
 		return nil
 	}
 
-	var storageError *azStorageBlob.StorageError
-	if errors.As(err, &storageError) {
-		resp := storageError.Response()
-		switch resp.StatusCode {
-		case http.StatusConflict:
-			// Could be either ErrExistsOC (blob already exists) or ErrContentOC (ETag mismatch)
-			// Check error code to distinguish
-			errorCode := azStorageBlob.StorageErrorCode(storageError.ErrorCode)
-			if errorCode == azStorageBlob.StorageErrorCodeBlobAlreadyExists {
-				return storage.ErrExistsOC
-			} else {
-				return storage.ErrContentOC // ETag mismatch or other conflict
-			}
-		case http.StatusPreconditionFailed:
-			return storage.ErrContentOC // Precondition failed (ETag mismatch)
-		case http.StatusNotFound:
-			return storage.ErrDoesNotExist
-		case http.StatusForbidden:
-			return fmt.Errorf("%w: permission denied: %v", storage.ErrNotAvailable, err)
-		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
-			return fmt.Errorf("%w: throttling or service unavailable: %v", storage.ErrNotAvailable, err)
-		default:
-			// Preserve the original error for debugging unexpected status codes
-			return fmt.Errorf("%w: unexpected status code %d: %v", storage.ErrNotAvailable, resp.StatusCode, err)
+	statusCode, errorCode, ok := azureErrorStatus(err)
+	if !ok {
+		// For non-Azure errors, preserve the original error
+		return fmt.Errorf("%w: %v", storage.ErrNotAvailable, err)
+	}
+	switch statusCode {
+	case http.StatusConflict:
+		// Could be either ErrExistsOC (blob already exists) or ErrContentOC (ETag mismatch)
+		// Check error code to distinguish
+		if errorCode == azStorageBlob.StorageErrorCodeBlobAlreadyExists {
+			return storage.ErrExistsOC
+		} else {
+			return storage.ErrContentOC // ETag mismatch or other conflict
 		}
+	case http.StatusPreconditionFailed:
+		return storage.ErrContentOC // Precondition failed (ETag mismatch)
+	case http.StatusNotFound:
+		return storage.ErrDoesNotExist
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: permission denied: %v", storage.ErrNotAvailable, err)
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: throttling or service unavailable: %v", storage.ErrNotAvailable, err)
+	default:
+		// Preserve the original error for debugging unexpected status codes
+		return fmt.Errorf("%w: unexpected status code %d: %v", storage.ErrNotAvailable, statusCode, err)
 	}
-
-	// For non-Azure errors, preserve the original error
-	return fmt.Errorf("%w: %v", storage.ErrNotAvailable, err)
 }
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingStore_DiscoverMassifHeight(t *testing.T) {
+	store := newTestBlobStore(t)
+
+	// write a log of height 3 and a log of height 5 to the same container
+	writer := newTestStore(t, store, 3)
+	logs := map[uint8]storage.LogID{3: newTestLogID(), 5: newTestLogID()}
+	for massifHeight, logID := range logs {
+		h, err := writer.Log(t.Context(), logID)
+		require.NoError(t, err)
+		for i := range uint32(2) {
+			require.NoError(t, h.Put(t.Context(), i, storage.ObjectMassifData, newTestMassif(massifHeight, i), true))
+			// the checkpoints follow the height established by the massifs
+			require.NoError(t, h.Put(t.Context(), i, storage.ObjectCheckpoint, newTestCheckpoint(t, massifs.MMRState{MMRSize: 1}), true))
+		}
+		path, err := h.ObjectPath(1, storage.ObjectCheckpoint)
+		require.NoError(t, err)
+		assert.Contains(t, path, fmt.Sprintf("/%d/", massifHeight))
+	}
+
+	r, err := NewStore(t.Context(), Options{Store: store, DiscoverMassifHeight: true}, 3)
+	require.NoError(t, err)
+	for massifHeight, logID := range logs {
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		assert.Equal(t, massifHeight, r.Selected.MassifHeight)
+
+		massifIndex, err := r.HeadIndex(t.Context(), storage.ObjectMassifData)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), massifIndex)
+		massifIndex, err = r.HeadIndex(t.Context(), storage.ObjectCheckpoint)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), massifIndex)
+
+		data, err := r.MassifReadN(t.Context(), 1, -1)
+		require.NoError(t, err)
+		assert.Equal(t, newTestMassif(massifHeight, 1), data)
+	}
+
+	// a log which does not exist yet uses the store height
+	h, err := r.Log(t.Context(), newTestLogID())
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), h.Cache().MassifHeight)
+	path, err := h.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Contains(t, path, "/3/")
+
+	// a log of the store height is found with a single list, any other height
+	// with a list and a tag query, and the height comes from the path
+	for massifHeight, logID := range logs {
+		r, err := NewStore(t.Context(), Options{Store: store, DiscoverMassifHeight: true}, 3)
+		require.NoError(t, err)
+		listCount, filterCount, readCount := store.listCount, store.filterCount, store.readCount
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		assert.Equal(t, massifHeight, r.Selected.MassifHeight)
+		assert.Equal(t, listCount+1, store.listCount)
+		if massifHeight == 3 {
+			assert.Equal(t, filterCount, store.filterCount)
+		} else {
+			assert.Equal(t, filterCount+1, store.filterCount)
+		}
+		assert.Equal(t, readCount, store.readCount)
+	}
+
+	// a miss is not remembered, once the log has a massif its height is found
+	emptyLogID := newTestLogID()
+	h, err = r.Log(t.Context(), emptyLogID)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), h.Cache().MassifHeight)
+	h, err = writer.Log(t.Context(), emptyLogID)
+	require.NoError(t, err)
+	require.NoError(t, h.Put(t.Context(), 0, storage.ObjectMassifData, newTestMassif(5, 0), true))
+	h, err = r.Log(t.Context(), emptyLogID)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(5), h.Cache().MassifHeight)
+
+	// without discovery, the store height is assumed for all logs
+	r, err = NewStore(t.Context(), Options{Store: store}, 3)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logs[5]))
+	_, err = r.HeadIndex(t.Context(), storage.ObjectMassifData)
+	assert.ErrorIs(t, err, storage.ErrLogEmpty)
+}
+
+func TestCachingStore_ContentIntegrity(t *testing.T) {
+	for _, appendWrites := range []bool{false, true} {
+		t.Run(fmt.Sprintf("appendWrites=%v", appendWrites), func(t *testing.T) {
+			store := newTestBlobStore(t)
+			opts := Options{Store: store, StoreWriter: store, AppendWrites: appendWrites}
+			w, err := NewStore(t.Context(), opts, 3)
+			require.NoError(t, err)
+			logID := newTestLogID()
+			require.NoError(t, w.SelectLog(t.Context(), logID))
+			mc := putTestMassifs(t, w, 1)
+			storagePath, err := w.ObjectPath(0, storage.ObjectMassifData)
+			require.NoError(t, err)
+
+			r := newTestStore(t, store, 3)
+			require.NoError(t, r.SelectLog(t.Context(), logID))
+			got, err := r.MassifReadN(t.Context(), 0, -1)
+			require.NoError(t, err)
+			assert.Equal(t, mc.Data, got)
+
+			// corrupt the stored content, without changing the stored hash
+			stored := store.stored(storagePath)
+			stored.data[len(stored.data)-1] ^= 0xff
+			store.setRawBlob(storagePath, stored.data, stored.metadata)
+
+			r = newTestStore(t, store, 3)
+			require.NoError(t, r.SelectLog(t.Context(), logID))
+			_, err = r.MassifReadN(t.Context(), 0, -1)
+			assert.ErrorIs(t, err, blobs.ErrContentIntegrity)
+			_, ok, err := r.MassifData(0)
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCachingStore_zeroValue(t *testing.T) {
+	var r CachingStore
+	logID := newTestLogID()
+	_, err := r.Log(t.Context(), logID)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{ResidentLogs: 1}, r.Stats())
+	r.DropLog(logID)
+	assert.Equal(t, CacheStats{}, r.Stats())
+}
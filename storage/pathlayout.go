@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+)
+
+var ErrPathNotRecognized = errors.New("the blob path is not recognized by the path layout")
+
+// ObjectPathInfo describes the object identified by a blob path
+type ObjectPathInfo struct {
+	LogID        storage.LogID
+	MassifHeight uint8
+	Type         storage.ObjectType
+	MassifIndex  uint32
+}
+
+// PathLayout determines the blob paths used for the objects of a log.
+//
+// The listing of the prefix returned by ObjectPrefix must produce the objects
+// in massif index order, as the head of the log is found by listing.
+type PathLayout interface {
+	// ObjectPath returns the blob path for the object
+	ObjectPath(logID storage.LogID, massifHeight uint8, otype storage.ObjectType, massifIndex uint32) (string, error)
+	// ObjectPrefix returns the list prefix for all objects of the type in the log
+	ObjectPrefix(logID storage.LogID, massifHeight uint8, otype storage.ObjectType) (string, error)
+	// ParsePath recovers the object details from a blob path produced by ObjectPath
+	ParsePath(blobPath string) (ObjectPathInfo, error)
+}
+
+// V2PathLayout is the default layout:
+//
+//	v2/merklelog/massifs/{massifHeight}/{logID}/{massifIndex:016d}.log
+//	v2/merklelog/checkpoints/{massifHeight}/{logID}/{massifIndex:016d}.sth
+//
+// The service prefixes may be changed for deployments which use a different
+// prefix or share a container.
+type V2PathLayout struct {
+	MassifsPrefix     string // Defaults to storage.V2MerklelogMassifsPrefix
+	CheckpointsPrefix string // Defaults to storage.V2MerklelogCheckpointsPrefix
+}
+
+// servicePrefix returns the prefix, including the trailing separator, for the
+// object type
+func (l V2PathLayout) servicePrefix(otype storage.ObjectType) (string, error) {
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
+		if l.MassifsPrefix != "" {
+			return l.MassifsPrefix + "/", nil
+		}
+		return storage.V2MerklelogMassifsPrefix + "/", nil
+	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
+		if l.CheckpointsPrefix != "" {
+			return l.CheckpointsPrefix + "/", nil
+		}
+		return storage.V2MerklelogCheckpointsPrefix + "/", nil
+	default:
+		return "", fmt.Errorf("unsupported object type: %v", otype)
+	}
+}
+
+func (l V2PathLayout) ObjectPrefix(logID storage.LogID, massifHeight uint8, otype storage.ObjectType) (string, error) {
+	servicePrefix, err := l.servicePrefix(otype)
+	if err != nil {
+		return "", err
+	}
+	basePrefix, err := storage.StorageObjectPrefixWithHeight(logID, massifHeight, otype)
+	if err != nil {
+		return "", fmt.Errorf("failed to get prefix path for type %v: %w", otype, err)
+	}
+	return servicePrefix + basePrefix, nil
+}
+
+func (l V2PathLayout) ObjectPath(logID storage.LogID, massifHeight uint8, otype storage.ObjectType, massifIndex uint32) (string, error) {
+	prefix, err := l.ObjectPrefix(logID, massifHeight, otype)
+	if err != nil {
+		return "", err
+	}
+	storagePath, err := storage.ObjectPath(prefix, logID, massifIndex, otype)
+	if err != nil {
+		return "", fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
+	}
+	return storagePath, nil
+}
+
+func (l V2PathLayout) ParsePath(blobPath string) (ObjectPathInfo, error) {
+	for _, prefixType := range []storage.ObjectType{storage.ObjectPathMassifs, storage.ObjectPathCheckpoints} {
+		servicePrefix, err := l.servicePrefix(prefixType)
+		if err != nil {
+			return ObjectPathInfo{}, err
+		}
+		if !strings.HasPrefix(blobPath, servicePrefix) {
+			continue
+		}
+
+		// {massifHeight}/{logID}/{massifIndex}.{ext}
+		parts := strings.Split(strings.TrimPrefix(blobPath, servicePrefix), "/")
+		if len(parts) != 3 {
+			return ObjectPathInfo{}, fmt.Errorf("%w: %s", ErrPathNotRecognized, blobPath)
+		}
+		massifHeight, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return ObjectPathInfo{}, fmt.Errorf("%w: %s: massif height: %v", ErrPathNotRecognized, blobPath, err)
+		}
+		logUUID, err := uuid.Parse(parts[1])
+		if err != nil {
+			return ObjectPathInfo{}, fmt.Errorf("%w: %s: log id: %v", ErrPathNotRecognized, blobPath, err)
+		}
+		otype, massifIndex, err := storage.ObjectIndexFromPath(parts[2])
+		if err != nil {
+			return ObjectPathInfo{}, fmt.Errorf("%w: %s: %v", ErrPathNotRecognized, blobPath, err)
+		}
+		if (prefixType == storage.ObjectPathMassifs) != (otype == storage.ObjectMassifData) {
+			return ObjectPathInfo{}, fmt.Errorf("%w: %s: object type %v under the wrong prefix", ErrPathNotRecognized, blobPath, otype)
+		}
+		return ObjectPathInfo{
+			LogID:        storage.LogID(logUUID[:]),
+			MassifHeight: uint8(massifHeight),
+			Type:         otype,
+			MassifIndex:  massifIndex,
+		}, nil
+	}
+	return ObjectPathInfo{}, fmt.Errorf("%w: %s", ErrPathNotRecognized, blobPath)
+}
+
+const (
+	V1MMRTenantPrefix      = "v1/mmrs/tenant/"
+	V1MMRMassifsDir        = "massifs"
+	V1MMRMassifSealsDir    = "massifseals"
+	v1MMRPathComponentsLen = 4 // {logID}/{logInstance}/{dir}/{massifIndex}.{ext}
+)
+
+// V1PathLayout is the legacy datatrails tenant layout:
+//
+//	v1/mmrs/tenant/{logID}/0/massifs/{massifIndex:016d}.log
+//	v1/mmrs/tenant/{logID}/0/massifseals/{massifIndex:016d}.sth
+//
+// The massif height is not part of the path, it is only available from the
+// massif start header. ParsePath returns a zero MassifHeight.
+type V1PathLayout struct{}
+
+func (l V1PathLayout) ObjectPrefix(logID storage.LogID, massifHeight uint8, otype storage.ObjectType) (string, error) {
+	logUUID, err := uuid.FromBytes(logID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get prefix path for type %v: %w", otype, err)
+	}
+
+	var dir string
+	switch otype {
+	case storage.ObjectMassifStart, storage.ObjectMassifData, storage.ObjectPathMassifs:
+		dir = V1MMRMassifsDir
+	case storage.ObjectCheckpoint, storage.ObjectPathCheckpoints:
+		dir = V1MMRMassifSealsDir
+	default:
+		return "", fmt.Errorf("unsupported object type: %v", otype)
+	}
+	return fmt.Sprintf("%s%s/%d/%s/", V1MMRTenantPrefix, logUUID, storage.LogInstanceN, dir), nil
+}
+
+func (l V1PathLayout) ObjectPath(logID storage.LogID, massifHeight uint8, otype storage.ObjectType, massifIndex uint32) (string, error) {
+	prefix, err := l.ObjectPrefix(logID, massifHeight, otype)
+	if err != nil {
+		return "", err
+	}
+	storagePath, err := storage.ObjectPath(prefix, logID, massifIndex, otype)
+	if err != nil {
+		return "", fmt.Errorf("failed to get storage path for massif %d: %w", massifIndex, err)
+	}
+	return storagePath, nil
+}
+
+func (l V1PathLayout) ParsePath(blobPath string) (ObjectPathInfo, error) {
+	if !strings.HasPrefix(blobPath, V1MMRTenantPrefix) {
+		return ObjectPathInfo{}, fmt.Errorf("%w: %s", ErrPathNotRecognized, blobPath)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(blobPath, V1MMRTenantPrefix), "/")
+	if len(parts) != v1MMRPathComponentsLen || parts[1] != strconv.Itoa(storage.LogInstanceN) {
+		return ObjectPathInfo{}, fmt.Errorf("%w: %s", ErrPathNotRecognized, blobPath)
+	}
+	logUUID, err := uuid.Parse(parts[0])
+	if err != nil {
+		return ObjectPathInfo{}, fmt.Errorf("%w: %s: log id: %v", ErrPathNotRecognized, blobPath, err)
+	}
+	otype, massifIndex, err := storage.ObjectIndexFromPath(parts[3])
+	if err != nil {
+		return ObjectPathInfo{}, fmt.Errorf("%w: %s: %v", ErrPathNotRecognized, blobPath, err)
+	}
+	switch {
+	case parts[2] == V1MMRMassifsDir && otype == storage.ObjectMassifData:
+	case parts[2] == V1MMRMassifSealsDir && otype == storage.ObjectCheckpoint:
+	default:
+		return ObjectPathInfo{}, fmt.Errorf("%w: %s: object type %v under the wrong prefix", ErrPathNotRecognized, blobPath, otype)
+	}
+	return ObjectPathInfo{
+		LogID:       storage.LogID(logUUID[:]),
+		Type:        otype,
+		MassifIndex: massifIndex,
+	}, nil
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV2PathLayout(t *testing.T) {
+	logUUID := uuid.New()
+	logID := storage.LogID(logUUID[:])
+
+	tests := []struct {
+		name       string
+		layout     V2PathLayout
+		otype      storage.ObjectType
+		wantPath   string
+		wantPrefix string
+	}{
+		{
+			name:       "default massif",
+			otype:      storage.ObjectMassifData,
+			wantPath:   fmt.Sprintf("v2/merklelog/massifs/14/%s/0000000000000003.log", logUUID),
+			wantPrefix: fmt.Sprintf("v2/merklelog/massifs/14/%s/", logUUID),
+		},
+		{
+			name:       "default checkpoint",
+			otype:      storage.ObjectCheckpoint,
+			wantPath:   fmt.Sprintf("v2/merklelog/checkpoints/14/%s/0000000000000003.sth", logUUID),
+			wantPrefix: fmt.Sprintf("v2/merklelog/checkpoints/14/%s/", logUUID),
+		},
+		{
+			name:       "custom massif",
+			layout:     V2PathLayout{MassifsPrefix: "tenant/massifs", CheckpointsPrefix: "tenant/seals"},
+			otype:      storage.ObjectMassifData,
+			wantPath:   fmt.Sprintf("tenant/massifs/14/%s/0000000000000003.log", logUUID),
+			wantPrefix: fmt.Sprintf("tenant/massifs/14/%s/", logUUID),
+		},
+		{
+			name:       "custom checkpoint",
+			layout:     V2PathLayout{MassifsPrefix: "tenant/massifs", CheckpointsPrefix: "tenant/seals"},
+			otype:      storage.ObjectCheckpoint,
+			wantPath:   fmt.Sprintf("tenant/seals/14/%s/0000000000000003.sth", logUUID),
+			wantPrefix: fmt.Sprintf("tenant/seals/14/%s/", logUUID),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := tt.layout.ObjectPath(logID, 14, tt.otype, 3)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPath, path)
+
+			prefix, err := tt.layout.ObjectPrefix(logID, 14, tt.otype)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPrefix, prefix)
+			assert.True(t, strings.HasPrefix(path, prefix))
+
+			info, err := tt.layout.ParsePath(path)
+			require.NoError(t, err)
+			assert.Equal(t, ObjectPathInfo{LogID: logID, MassifHeight: 14, Type: tt.otype, MassifIndex: 3}, info)
+		})
+	}
+}
+
+func TestV2PathLayout_ParsePath_errors(t *testing.T) {
+	logUUID := uuid.New()
+	for _, path := range []string{
+		fmt.Sprintf("v1/mmrs/tenant/%s/0/massifs/0000000000000003.log", logUUID),
+		fmt.Sprintf("v2/merklelog/massifs/14/%s/0000000000000003.sth", logUUID),
+		fmt.Sprintf("v2/merklelog/massifs/300/%s/0000000000000003.log", logUUID),
+		"v2/merklelog/massifs/14/not-a-uuid/0000000000000003.log",
+		fmt.Sprintf("v2/merklelog/checkpoints/14/%s/", logUUID),
+	} {
+		_, err := V2PathLayout{}.ParsePath(path)
+		assert.ErrorIs(t, err, ErrPathNotRecognized, path)
+	}
+}
+
+func TestCachingStore_PathLayout(t *testing.T) {
+	store := newTestBlobStore(t)
+	layout := V2PathLayout{MassifsPrefix: "custom/massifs", CheckpointsPrefix: "custom/checkpoints"}
+	r, err := NewStore(t.Context(), Options{Store: store, StoreWriter: store, PathLayout: layout}, 3)
+	require.NoError(t, err)
+
+	logID := newTestLogID()
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	for i := range uint32(2) {
+		require.NoError(t, r.Put(t.Context(), i, storage.ObjectMassifData, newTestMassif(3, i), true))
+	}
+	require.NoError(t, r.Put(t.Context(), 0, storage.ObjectCheckpoint, newTestCheckpoint(t, massifs.MMRState{MMRSize: 1}), true))
+	for path := range store.blobs {
+		assert.True(t, strings.HasPrefix(path, "custom/"), path)
+	}
+
+	massifIndex, err := r.HeadIndex(t.Context(), storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), massifIndex)
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+}
+
+func TestV1PathLayout(t *testing.T) {
+	logUUID := uuid.New()
+	logID := storage.LogID(logUUID[:])
+	layout := V1PathLayout{}
+
+	for otype, want := range map[storage.ObjectType]string{
+		storage.ObjectMassifData: fmt.Sprintf("v1/mmrs/tenant/%s/0/massifs/0000000000000003.log", logUUID),
+		storage.ObjectCheckpoint: fmt.Sprintf("v1/mmrs/tenant/%s/0/massifseals/0000000000000003.sth", logUUID),
+	} {
+		// the height is not part of the v1 paths
+		path, err := layout.ObjectPath(logID, 14, otype, 3)
+		require.NoError(t, err)
+		assert.Equal(t, want, path)
+		prefix, err := layout.ObjectPrefix(logID, 3, otype)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(path, prefix))
+
+		info, err := layout.ParsePath(path)
+		require.NoError(t, err)
+		assert.Equal(t, ObjectPathInfo{LogID: logID, Type: otype, MassifIndex: 3}, info)
+	}
+
+	for _, path := range []string{
+		fmt.Sprintf("v2/merklelog/massifs/14/%s/0000000000000003.log", logUUID),
+		fmt.Sprintf("v1/mmrs/tenant/%s/1/massifs/0000000000000003.log", logUUID),
+		fmt.Sprintf("v1/mmrs/tenant/%s/0/massifseals/0000000000000003.log", logUUID),
+	} {
+		_, err := layout.ParsePath(path)
+		assert.ErrorIs(t, err, ErrPathNotRecognized, path)
+	}
+}
+
+func TestCachingStore_V1PathLayout(t *testing.T) {
+	store := newTestBlobStore(t)
+
+	// the legacy log has a different height to the store
+	logUUID := uuid.New()
+	logID := storage.LogID(logUUID[:])
+	for i := range uint32(3) {
+		store.setBlob(fmt.Sprintf("v1/mmrs/tenant/%s/0/massifs/%016d.log", logUUID, i), newTestMassif(14, i))
+		store.setBlob(fmt.Sprintf("v1/mmrs/tenant/%s/0/massifseals/%016d.sth", logUUID, i), []byte("checkpoint"))
+	}
+
+	r, err := NewStore(t.Context(), Options{Store: store, PathLayout: V1PathLayout{}, DiscoverMassifHeight: true}, 3)
+	require.NoError(t, err)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+	assert.Equal(t, uint8(14), r.Selected.MassifHeight)
+
+	massifIndex, err := r.HeadIndex(t.Context(), storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), massifIndex)
+	massifIndex, err = r.HeadIndex(t.Context(), storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), massifIndex)
+
+	data, err := r.MassifReadN(t.Context(), 2, -1)
+	require.NoError(t, err)
+	assert.Equal(t, newTestMassif(14, 2), data)
+	data, err = r.CheckpointRead(t.Context(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("checkpoint"), data)
+
+	// the path does not depend on the height, so a log which does not exist
+	// yet is listed once
+	listCount := store.listCount
+	emptyUUID := uuid.New()
+	require.NoError(t, r.SelectLog(t.Context(), storage.LogID(emptyUUID[:])))
+	assert.Equal(t, uint8(0), r.Selected.MassifHeight)
+	assert.Equal(t, listCount+1, store.listCount)
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
 )
 
 // Note: we favour hex encoding because hex values sort lexically and blob tags
@@ -15,11 +17,17 @@ var (
 	ErrMissingFirstIndexTag   = errors.New("the required tag 'firstindex' is missing")
 	ErrMissingLastIDTag       = errors.New("the required tag 'lastid' is missing")
 	ErrIncorrectFirstIndexTag = errors.New("the required tag 'firstindex' is present but the value doesn't match the log")
+	ErrIncorrectLastIDTag     = errors.New("the required tag 'lastid' is present but the value doesn't match the log")
+	ErrIncorrectLogIDTag      = errors.New("the tag 'logid' is present but the value doesn't match the log")
 )
 
 const (
 	TagKeyFirstIndex = "firstindex"
 	TagKeyLastID     = "lastid"
+	// TagKeyLogID tags each object with its log, so that a tag query can
+	// select the logs of interest. Objects written before it was introduced
+	// don't have it.
+	TagKeyLogID      = "logid"
 	TagFirstIndexFmt = "%016x"
 )
 
@@ -40,6 +48,20 @@ func GetLastIDHex(tags map[string]string) string {
 	return lastIDTag
 }
 
+func GetLogIDHex(tags map[string]string) string {
+	return tags[TagKeyLogID]
+}
+
+// SetLogID sets the logid tag to the hex encoded log id
+func SetLogID(logID storage.LogID, tags map[string]string) {
+	tags[TagKeyLogID] = EncodeTagLogID(logID)
+}
+
+// EncodeTagLogID returns the logid tag value for the log id
+func EncodeTagLogID(logID storage.LogID) string {
+	return hex.EncodeToString(logID)
+}
+
 func SetFirstIndex(firstIndex uint64, tags map[string]string) {
 	// take care to 0 pad to preserve lexical sort
 	tags[TagKeyFirstIndex] = fmt.Sprintf(TagFirstIndexFmt, firstIndex)
@@ -54,7 +76,10 @@ func DecodeTagHex64(tagValue string) (uint64, error) {
 	if len(b) > 8 {
 		return 0, fmt.Errorf("%w: %s", ErrHex64TagOverflow, tagValue)
 	}
-	return binary.BigEndian.Uint64(b), nil
+	// Values written without the zero padding are still big endian
+	var padded [8]byte
+	copy(padded[8-len(b):], b)
+	return binary.BigEndian.Uint64(padded[:]), nil
 }
 
 func EncodeTagHex64(tagValue uint64) string {
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeTagHex64(t *testing.T) {
+	v, err := DecodeTagHex64(EncodeTagHex64(0x0102030405060708))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x0102030405060708), v)
+
+	v, err = DecodeTagHex64("0102")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x0102), v)
+
+	_, err = DecodeTagHex64("010203040506070809")
+	assert.ErrorIs(t, err, ErrHex64TagOverflow)
+}
+
+func TestCachingStore_ValidateTags(t *testing.T) {
+	store := newTestBlobStore(t)
+	w := newTestStore(t, store, 3)
+	logID := newTestLogID()
+	require.NoError(t, w.SelectLog(t.Context(), logID))
+
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, 3)
+	require.NoError(t, err)
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectMassifData, addTestLeaves(t, &mc, 2), true))
+	checkpt := newTestCheckpoint(t, massifs.MMRState{MMRSize: mc.RangeCount(), IDTimestamp: mc.GetLastIDTimestamp()})
+	require.NoError(t, w.Put(t.Context(), 0, storage.ObjectCheckpoint, checkpt, true))
+	massifPath, err := w.ObjectPath(0, storage.ObjectMassifData)
+	require.NoError(t, err)
+	checkptPath, err := w.ObjectPath(0, storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	massifTags := store.stored(massifPath).tags
+	checkptTags := store.stored(checkptPath).tags
+
+	newReader := func() *CachingStore {
+		r, err := NewStore(t.Context(), Options{Store: store, ValidateTags: true}, 3)
+		require.NoError(t, err)
+		require.NoError(t, r.SelectLog(t.Context(), logID))
+		return r
+	}
+
+	r := newReader()
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		path    string
+		tags    map[string]string
+		wantErr error
+	}{
+		{
+			name:    "massif missing firstindex",
+			path:    massifPath,
+			tags:    map[string]string{TagKeyLastID: massifTags[TagKeyLastID]},
+			wantErr: ErrMissingFirstIndexTag,
+		},
+		{
+			name:    "massif incorrect firstindex",
+			path:    massifPath,
+			tags:    map[string]string{TagKeyFirstIndex: EncodeTagHex64(7), TagKeyLastID: massifTags[TagKeyLastID]},
+			wantErr: ErrIncorrectFirstIndexTag,
+		},
+		{
+			name:    "massif missing lastid",
+			path:    massifPath,
+			tags:    map[string]string{TagKeyFirstIndex: massifTags[TagKeyFirstIndex]},
+			wantErr: ErrMissingLastIDTag,
+		},
+		{
+			name:    "massif incorrect lastid",
+			path:    massifPath,
+			tags:    map[string]string{TagKeyFirstIndex: massifTags[TagKeyFirstIndex], TagKeyLastID: EncodeTagHex64(1)},
+			wantErr: ErrIncorrectLastIDTag,
+		},
+		{
+			name:    "checkpoint incorrect lastid",
+			path:    checkptPath,
+			tags:    map[string]string{TagKeyFirstIndex: checkptTags[TagKeyFirstIndex], TagKeyLastID: EncodeTagHex64(1)},
+			wantErr: ErrIncorrectLastIDTag,
+		},
+		{
+			name:    "checkpoint missing firstindex",
+			path:    checkptPath,
+			tags:    map[string]string{TagKeyLastID: checkptTags[TagKeyLastID]},
+			wantErr: ErrMissingFirstIndexTag,
+		},
+		{
+			name: "checkpoint incorrect logid",
+			path: checkptPath,
+			tags: map[string]string{
+				TagKeyFirstIndex: checkptTags[TagKeyFirstIndex], TagKeyLastID: checkptTags[TagKeyLastID],
+				TagKeyLogID: EncodeTagLogID(newTestLogID()),
+			},
+			wantErr: ErrIncorrectLogIDTag,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.setTags(massifPath, massifTags)
+			store.setTags(checkptPath, checkptTags)
+			store.setTags(tt.path, tt.tags)
+
+			r := newReader()
+			if tt.path == massifPath {
+				_, err = r.MassifReadN(t.Context(), 0, -1)
+			} else {
+				_, err = r.CheckpointRead(t.Context(), 0)
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			// objects which fail validation are not cached
+			_, ok, err := r.Native(0, storage.ObjectMassifData)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			_, ok, err = r.Native(0, storage.ObjectCheckpoint)
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+
+	// tags read from before an update of the object are read again
+	store.setTags(massifPath, massifTags)
+	store.setTags(checkptPath, checkptTags)
+	stale := map[string]string{TagKeyFirstIndex: massifTags[TagKeyFirstIndex], TagKeyLastID: EncodeTagHex64(1)}
+	store.staleTags = map[string]map[string]string{massifPath: stale, checkptPath: stale}
+	readCount := store.readCount
+	r = newReader()
+	_, err = r.MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+	_, err = r.CheckpointRead(t.Context(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, readCount+4, store.readCount)
+
+	// objects written before the logid tag was introduced are accepted
+	assert.Equal(t, EncodeTagLogID(logID), massifTags[TagKeyLogID])
+	store.setTags(massifPath, map[string]string{
+		TagKeyFirstIndex: massifTags[TagKeyFirstIndex], TagKeyLastID: massifTags[TagKeyLastID],
+	})
+	store.setTags(checkptPath, checkptTags)
+	_, err = newReader().MassifReadN(t.Context(), 0, -1)
+	require.NoError(t, err)
+
+	// without validation the tags are not checked
+	h, err := newTestStore(t, store, 3).Log(t.Context(), logID)
+	require.NoError(t, err)
+	_, err = h.CheckpointRead(t.Context(), 0)
+	assert.NoError(t, err)
+}
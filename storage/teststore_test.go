@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/datatrails/go-datatrails-common/logger"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlobStore is a store, in a container of its own in the blob store
+// emulator, which counts the requests made by the store under test. It
+// implements blobs.RangeReader and blobs.BlockWriter, but not the container
+// client, so that every request made by the store under test goes through it.
+//
+// A few faults, which the emulator can not produce on demand, are injected.
+type testBlobStore struct {
+	storer *azblob.Storer
+	blocks blobs.BlockWriter
+	t      *testing.T
+
+	mu          sync.Mutex
+	readCount   int
+	rangeCount  int
+	putCount    int
+	stagedBytes int
+	listCount   int
+	filterCount int
+	filters     []string // The tag filters FilteredList was called with
+
+	// filterLag simulates the eventual consistency of the blob index,
+	// FilteredList finds nothing
+	filterLag bool
+
+	// staleTags are returned once by Reader, or by ReaderRange when the tags
+	// are requested, in place of the tags of the blob,
+	// as if they were read before its content was updated
+	staleTags map[string]map[string]string
+
+	// name is the blobs.StoreIdentity of the store
+	name string
+}
+
+// testBlob is the stored state of a blob, read without counting
+type testBlob struct {
+	data     []byte
+	tags     map[string]string
+	metadata map[string]string
+	blocks   []blobs.Block
+}
+
+// newTestBlobStore creates a container for the test in the emulator, it is
+// deleted when the test ends.
+func newTestBlobStore(t *testing.T) *testBlobStore {
+	t.Helper()
+	logger.New("TEST")
+
+	container := "unit-" + uuid.NewString()
+	storer, err := azblob.NewDev(azblob.NewDevConfigFromEnv(), container)
+	if err != nil {
+		t.Fatalf("failed to connect to blob store emulator: %v", err)
+	}
+	client := storer.GetServiceClient()
+	_, err = client.CreateContainer(t.Context(), container, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = client.DeleteContainer(context.Background(), container, nil)
+	})
+
+	blocks, ok := blobs.NewBlockWriter(storer)
+	require.True(t, ok)
+	return &testBlobStore{storer: storer, blocks: blocks, t: t}
+}
+
+func (s *testBlobStore) StoreIdentity() string {
+	return s.name
+}
+
+// setBlob replaces the blob content out of band, as a racing writer would.
+// The content MD5 is stored in the metadata, as blobs.PutContent does.
+func (s *testBlobStore) setBlob(blobPath string, data []byte) {
+	_, err := blobs.PutContent(s.t.Context(), s.storer, blobPath, data, blobs.CommitOptions{})
+	require.NoError(s.t, err)
+}
+
+// setRawBlob replaces the blob content out of band, with the given metadata
+// in place of the MD5 of the content.
+func (s *testBlobStore) setRawBlob(blobPath string, data []byte, metadata map[string]string) {
+	var opts []azblob.Option
+	if metadata != nil {
+		opts = append(opts, azblob.WithMetadata(metadata))
+	}
+	_, err := s.storer.Put(s.t.Context(), blobPath, azblob.NewBytesReaderCloser(data), opts...)
+	require.NoError(s.t, err)
+}
+
+// setTags replaces the blob index tags out of band, the etag is unchanged
+func (s *testBlobStore) setTags(blobPath string, tags map[string]string) {
+	blobClient, err := s.storer.GetContainerClient().NewBlobClient(blobPath)
+	require.NoError(s.t, err)
+	_, err = blobClient.SetTags(s.t.Context(), &azStorageBlob.BlobSetTagsOptions{TagsMap: tags})
+	require.NoError(s.t, err)
+}
+
+// stored reads the blob, its tags, metadata and committed blocks
+func (s *testBlobStore) stored(blobPath string) testBlob {
+	rr, data, err := blobs.BlobRead(s.t.Context(), blobPath, s.storer, azblob.WithGetTags())
+	require.NoError(s.t, err)
+	blocks, err := s.blocks.BlockList(s.t.Context(), blobPath)
+	require.NoError(s.t, err)
+	b := testBlob{data: data, metadata: rr.Metadata, blocks: blocks}
+	if len(rr.Tags) > 0 {
+		b.tags = rr.Tags
+	}
+	return b
+}
+
+// takeStaleTags returns, and forgets, the stale tags for the blob
+func (s *testBlobStore) takeStaleTags(blobPath string) (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags, ok := s.staleTags[blobPath]
+	delete(s.staleTags, blobPath)
+	return tags, ok
+}
+
+func (s *testBlobStore) Reader(
+	ctx context.Context,
+	blobPath string,
+	opts ...azblob.Option,
+) (*azblob.ReaderResponse, error) {
+	s.mu.Lock()
+	s.readCount++
+	s.mu.Unlock()
+
+	rr, err := s.storer.Reader(ctx, blobPath, opts...)
+	if err != nil {
+		return rr, err
+	}
+	if tags, ok := s.takeStaleTags(blobPath); ok {
+		rr.Tags = tags
+	}
+	return rr, nil
+}
+
+// ReaderRange implements blobs.RangeReader
+func (s *testBlobStore) ReaderRange(
+	ctx context.Context,
+	blobPath string,
+	offset, count int64,
+	opts ...blobs.RangeOption,
+) (*azblob.ReaderResponse, error) {
+	s.mu.Lock()
+	s.rangeCount++
+	s.mu.Unlock()
+
+	rr, data, err := blobs.BlobReadRange(ctx, blobPath, s.storer, offset, count, opts...)
+	if err != nil || rr.StatusCode == http.StatusNotModified {
+		return rr, err
+	}
+	var o blobs.RangeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.GetTags {
+		if tags, ok := s.takeStaleTags(blobPath); ok {
+			rr.Tags = tags
+		}
+	}
+	rr.Reader = io.NopCloser(bytes.NewReader(data))
+	rr.ContentLength = int64(len(data))
+	return rr, nil
+}
+
+func (s *testBlobStore) Put(
+	ctx context.Context,
+	blobPath string,
+	source io.ReadSeekCloser,
+	opts ...azblob.Option,
+) (*azblob.WriteResponse, error) {
+	s.mu.Lock()
+	s.putCount++
+	s.mu.Unlock()
+	return s.storer.Put(ctx, blobPath, source, opts...)
+}
+
+func (s *testBlobStore) List(ctx context.Context, opts ...azblob.Option) (*azblob.ListerResponse, error) {
+	s.mu.Lock()
+	s.listCount++
+	s.mu.Unlock()
+	return s.storer.List(ctx, opts...)
+}
+
+func (s *testBlobStore) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	s.mu.Lock()
+	s.filterCount++
+	s.filters = append(s.filters, tagsFilter)
+	lag := s.filterLag
+	s.mu.Unlock()
+	if lag {
+		return &azblob.FilterResponse{}, nil
+	}
+	return s.storer.FilteredList(ctx, tagsFilter, opts...)
+}
+
+// StageBlock implements blobs.BlockWriter
+func (s *testBlobStore) StageBlock(ctx context.Context, blobPath string, blockID string, data []byte) error {
+	s.mu.Lock()
+	s.stagedBytes += len(data)
+	s.mu.Unlock()
+	return s.blocks.StageBlock(ctx, blobPath, blockID, data)
+}
+
+// CommitBlockList implements blobs.BlockWriter
+func (s *testBlobStore) CommitBlockList(
+	ctx context.Context, blobPath string, blockIDs []string, opts blobs.CommitOptions,
+) (*azblob.WriteResponse, error) {
+	return s.blocks.CommitBlockList(ctx, blobPath, blockIDs, opts)
+}
+
+// BlockList implements blobs.BlockWriter
+func (s *testBlobStore) BlockList(ctx context.Context, blobPath string) ([]blobs.Block, error) {
+	return s.blocks.BlockList(ctx, blobPath)
+}
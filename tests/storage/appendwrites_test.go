@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/datatrails/go-datatrails-common/logger"
+	"github.com/forestrie/go-merklelog-provider-testing/mmrtesting"
+	"github.com/forestrie/go-merklelog-provider-testing/providers"
+)
+
+// The committer tests read back every massif written, so these check that
+// writing massifs as staged blocks stores exactly what a full write would.
+
+func TestAppendWrites_firstMassif(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_firstMassif"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterFirstMassifTest(tc, factory)
+}
+
+func TestAppendWrites_massifAddFirst(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_massifAddFirst"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterAddFirstTwoLeavesTest(tc, factory)
+}
+
+func TestAppendWrites_massifExtend(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_massifExtend"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterExtendAndCommitFirstTest(tc, factory)
+}
+
+func TestAppendWrites_massifComplete(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_massifComplete"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterCompleteFirstTest(tc, factory)
+}
+
+func TestAppendWrites_threemassifs(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_threemassifs"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterThreeMassifsTest(tc, factory)
+}
+
+func TestAppendWrites_massifoverfillsafe(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_massifoverfillsafe"))
+	factory := NewBuilderFactory(tc, WithAppendWrites())
+	providers.StorageMassifCommitterOverfillSafeTest(tc, factory)
+}
+
+// TestAppendWrites_smallBlocks writes the massifs as many small blocks, so
+// that most puts re-use committed blocks and merge the trailing ones.
+func TestAppendWrites_smallBlocks(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestAppendWrites_smallBlocks"))
+	factory := NewBuilderFactory(tc, WithAppendWrites(), WithAppendBlockSize(256))
+	providers.StorageMassifCommitterThreeMassifsTest(tc, factory)
+}
@@ -53,8 +53,36 @@ func (c *TestContext) GetT() *testing.T {
 	return c.T
 }
 
-func NewLogBuilder(tc *TestContext, massifHeight uint8) mmrtesting.LogBuilder {
+// BuilderOption adjusts the store options of the logs a builder makes
+type BuilderOption func(*azstorage.Options)
+
+// WithAppendWrites builds logs whose massifs are written by staging only the
+// changed and appended blocks
+func WithAppendWrites() BuilderOption {
+	return func(o *azstorage.Options) {
+		o.AppendWrites = true
+	}
+}
+
+// WithAppendBlockSize sets the size of the blocks staged by append writes
+func WithAppendBlockSize(size int) BuilderOption {
+	return func(o *azstorage.Options) {
+		o.AppendBlockSize = size
+	}
+}
+
+// WithPathLayout builds logs whose objects are stored in the given layout
+func WithPathLayout(layout azstorage.PathLayout) BuilderOption {
+	return func(o *azstorage.Options) {
+		o.PathLayout = layout
+	}
+}
+
+func NewLogBuilder(tc *TestContext, massifHeight uint8, opts ...BuilderOption) mmrtesting.LogBuilder {
 	azopts := tc.AzDefaultOpts()
+	for _, opt := range opts {
+		opt(&azopts)
+	}
 
 	store, err := azstorage.NewStore(tc.T.Context(), azopts, massifHeight)
 	require.NoError(tc.T, err)
@@ -77,9 +105,9 @@ func NewLogBuilder(tc *TestContext, massifHeight uint8) mmrtesting.LogBuilder {
 	return builder
 }
 
-func NewBuilderFactory(tc *TestContext) providers.BuilderFactory {
+func NewBuilderFactory(tc *TestContext, opts ...BuilderOption) providers.BuilderFactory {
 	return func(massifHeight uint8) mmrtesting.LogBuilder {
-		return NewLogBuilder(tc, massifHeight)
+		return NewLogBuilder(tc, massifHeight, opts...)
 	}
 }
 
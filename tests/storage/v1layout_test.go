@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/datatrails/go-datatrails-common/logger"
+	azstorage "github.com/forestrie/go-merklelog-azure/storage"
+	"github.com/forestrie/go-merklelog-provider-testing/mmrtesting"
+	"github.com/forestrie/go-merklelog-provider-testing/providers"
+	"github.com/forestrie/go-merklelog/massifs"
+	commoncose "github.com/forestrie/go-merklelog/massifs/cose"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/veraison/go-cose"
+)
+
+// newV1Store returns a store for the legacy v1 tenant layout in the emulator
+func newV1Store(tc *TestContext, massifHeight uint8) *azstorage.CachingStore {
+	azopts := tc.AzDefaultOpts()
+	azopts.PathLayout = azstorage.V1PathLayout{}
+	store, err := azstorage.NewStore(tc.T.Context(), azopts, massifHeight)
+	require.NoError(tc.T, err)
+	return store
+}
+
+// newV1Checkpoint returns an unsigned checkpoint for the state, it can be
+// decoded but it does not verify.
+func newV1Checkpoint(t *testing.T, state massifs.MMRState) []byte {
+	codec, err := massifs.NewCBORCodec()
+	require.NoError(t, err)
+	payload, err := codec.MarshalCBOR(state)
+	require.NoError(t, err)
+	msg := commoncose.CoseSign1Message{
+		Sign1Message: &cose.Sign1Message{Payload: payload, Signature: []byte("signature")},
+	}
+	data, err := msg.MarshalCBOR()
+	require.NoError(t, err)
+	return data
+}
+
+// TestV1Layout_objectReader seeds a small log at the literal paths of the
+// legacy v1 tenant layout, without the store under test, and reads it back with
+// HeadIndex, MassifReadN and CheckpointRead.
+func TestV1Layout_objectReader(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestV1Layout_objectReader"))
+
+	// v1 log ids are tenant uuids
+	logUUID := uuid.New()
+	logID := storage.LogID(logUUID[:])
+	prefix := fmt.Sprintf("v1/mmrs/tenant/%s/0/", logUUID)
+	t.Cleanup(func() { tc.DeleteByStoragePrefix(prefix) })
+
+	const massifHeight = 3
+	mc, err := massifs.CreateFirstMassifContext(t.Context(), 1, massifHeight)
+	require.NoError(t, err)
+	var written [][]byte
+	for i := range 3 {
+		if i > 0 {
+			require.NoError(t, mc.StartNextMassif())
+			require.NoError(t, mc.CreatePeakStackMap())
+		}
+		for range 4 {
+			id := mc.GetLastIDTimestamp() + 1
+			value := sha256.Sum256([]byte{byte(id)})
+			_, err = mc.AddHashedLeaf(sha256.New(), id, nil, []byte("log"), []byte("app"), value[:])
+			require.NoError(t, err)
+		}
+		data := slices.Clone(mc.Data)
+		_, err = tc.Storer.Put(t.Context(), fmt.Sprintf("%smassifs/%016d.log", prefix, i), azblob.NewBytesReaderCloser(data))
+		require.NoError(t, err)
+		written = append(written, data)
+	}
+	checkpt := newV1Checkpoint(t, massifs.MMRState{MMRSize: mc.RangeCount(), IDTimestamp: mc.GetLastIDTimestamp()})
+	_, err = tc.Storer.Put(t.Context(), fmt.Sprintf("%smassifseals/%016d.sth", prefix, 2), azblob.NewBytesReaderCloser(checkpt))
+	require.NoError(t, err)
+
+	r := newV1Store(tc, massifHeight)
+	require.NoError(t, r.SelectLog(t.Context(), logID))
+
+	path, err := r.ObjectPath(2, storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%smassifs/%016d.log", prefix, 2), path)
+
+	massifIndex, err := r.HeadIndex(t.Context(), storage.ObjectMassifData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), massifIndex)
+	massifIndex, err = r.HeadIndex(t.Context(), storage.ObjectCheckpoint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), massifIndex)
+
+	for i, want := range written {
+		got, err := r.MassifReadN(t.Context(), uint32(i), -1)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	got, err := r.CheckpointRead(t.Context(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, checkpt, got)
+}
+
+func TestV1Layout_massifAddFirst(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestV1Layout_massifAddFirst"))
+	factory := NewBuilderFactory(tc, WithPathLayout(azstorage.V1PathLayout{}))
+
+	providers.StorageMassifCommitterAddFirstTwoLeavesTest(tc, factory)
+}
+
+func TestV1Layout_massifExtend(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestV1Layout_massifExtend"))
+	factory := NewBuilderFactory(tc, WithPathLayout(azstorage.V1PathLayout{}))
+
+	providers.StorageMassifCommitterExtendAndCommitFirstTest(tc, factory)
+}
+
+func TestV1Layout_massifComplete(t *testing.T) {
+	logger.New("TEST")
+	tc := NewTestContext(t, nil, mmrtesting.WithTestLabelPrefix("TestV1Layout_massifComplete"))
+	factory := NewBuilderFactory(tc, WithPathLayout(azstorage.V1PathLayout{}))
+
+	providers.StorageMassifCommitterCompleteFirstTest(tc, factory)
+}
@@ -0,0 +1,167 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/snowflakeid"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+)
+
+// DefaultCursorOverlap is subtracted from a saved cursor when resuming, so
+// that changes whose lastid tags were not yet indexed when the cursor was
+// saved are seen again. Azure promises tag index consistency within "seconds"
+const DefaultCursorOverlap = time.Minute
+
+// CursorStore persists the highest lastid processed by a watch, so that the
+// watch can resume from it after a restart. The cursor is the hex lastid, as
+// used in the lastid blob tags.
+type CursorStore interface {
+	// LoadCursor returns the saved cursor, or the empty string if none has
+	// been saved.
+	LoadCursor(ctx context.Context) (string, error)
+	SaveCursor(ctx context.Context, lastID string) error
+}
+
+// ResumeConfig sets cfg.IDSince from the saved cursor, less the overlap, if
+// there is one. The config is unchanged if no cursor has been saved. It must
+// be called before ConfigDefaults, or NewWatcher.
+func ResumeConfig(ctx context.Context, cfg *WatchConfig, cursors CursorStore, overlap time.Duration) error {
+	cursor, err := cursors.LoadCursor(ctx)
+	if err != nil {
+		return err
+	}
+	if cursor == "" {
+		return nil
+	}
+	id, epoch, err := massifs.SplitIDTimestampHex(cursor)
+	if err != nil {
+		return fmt.Errorf("invalid watch cursor %q: %w", cursor, err)
+	}
+	cfg.Latest = false
+	cfg.Since = time.Time{}
+	cfg.IDSince = massifs.IDTimeHex(snowflakeid.IDTime(id, snowflakeid.EpochTimeUTC(epoch)).Add(-overlap))
+	return nil
+}
+
+// activityLastID returns the highest lastid of the activity, or the empty
+// string if there is none.
+func activityLastID(activity ...watcher.LogActivity) string {
+	var lastID string
+	for _, a := range activity {
+		lastID = max(lastID, a.IDCommitted)
+		if a.IDConfirmed != sealIDNotFound {
+			lastID = max(lastID, a.IDConfirmed)
+		}
+	}
+	return lastID
+}
+
+// FileCursorStore keeps the cursor in a local file. The file is replaced
+// atomically each time the cursor is saved.
+type FileCursorStore struct {
+	Path string
+}
+
+func (s FileCursorStore) LoadCursor(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s FileCursorStore) SaveCursor(ctx context.Context, lastID string) error {
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(lastID + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.Path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+type cursorWriter interface {
+	Put(
+		ctx context.Context,
+		blobPath string,
+		source io.ReadSeekCloser,
+		opts ...azblob.Option,
+	) (*azblob.WriteResponse, error)
+}
+
+// BlobCursorStore keeps the cursor in a blob, so that it can be shared by
+// watchers which do not have persistent local storage.
+type BlobCursorStore struct {
+	Store       blobs.Reader
+	StoreWriter cursorWriter
+	BlobPath    string
+}
+
+func (s BlobCursorStore) LoadCursor(ctx context.Context) (string, error) {
+	cursor, _, err := s.readCursor(ctx)
+	return cursor, err
+}
+
+// SaveCursor saves the cursor, unless a watcher sharing the blob has already
+// saved a later one. The blob is only replaced if it is unchanged since it was
+// read, or created if it still does not exist, and the save is tried again if
+// another watcher saved its cursor in the meantime.
+func (s BlobCursorStore) SaveCursor(ctx context.Context, lastID string) error {
+	for {
+		saved, etag, err := s.readCursor(ctx)
+		if err != nil {
+			return err
+		}
+		opts := blobs.CommitOptions{IfMatch: etag}
+		if saved == "" && etag == "" {
+			opts.IfNoneMatch = "*"
+		}
+		// A cursor which is not a lastid is replaced, rather than compared
+		if _, _, err = massifs.SplitIDTimestampHex(saved); err == nil && saved >= lastID {
+			return nil
+		}
+		_, err = blobs.PutContent(ctx, s.StoreWriter, s.BlobPath, []byte(lastID+"\n"), opts)
+		if !blobs.IsConditionNotMet(err) {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// readCursor returns the saved cursor and the ETag of the blob, or the empty
+// strings if it does not exist.
+func (s BlobCursorStore) readCursor(ctx context.Context) (string, string, error) {
+	bc := &blobs.LogBlobContext{BlobPath: s.BlobPath}
+	err := bc.ReadData(ctx, s.Store)
+	if errors.Is(err, storage.ErrDoesNotExist) || blobs.IsBlobNotFound(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(bc.Data)), bc.ETag, nil
+}
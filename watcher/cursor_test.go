@@ -0,0 +1,191 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/forestrie/go-merklelog/massifs/snowflakeid"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cursorBlobStore is a minimal in memory blob store for the cursor blob. The
+// cursor is always saved conditional on the version read, so Put fails if the
+// blob has changed since the last Reader. racer, if it is set, is called
+// before each Put, to simulate another watcher saving its cursor.
+type cursorBlobStore struct {
+	mockReader
+	blobs map[string][]byte
+	etags map[string]string
+	read  map[string]string // The ETag returned by the last Reader
+	puts  int
+	racer func(s *cursorBlobStore)
+}
+
+func newCursorBlobStore() *cursorBlobStore {
+	return &cursorBlobStore{blobs: map[string][]byte{}, etags: map[string]string{}, read: map[string]string{}}
+}
+
+func (s *cursorBlobStore) Reader(ctx context.Context, identity string, opts ...azblob.Option) (*azblob.ReaderResponse, error) {
+	data, ok := s.blobs[identity]
+	etag := s.etags[identity]
+	s.read[identity] = etag
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", identity, storage.ErrDoesNotExist)
+	}
+	return &azblob.ReaderResponse{
+		Reader: io.NopCloser(bytes.NewReader(data)), ContentLength: int64(len(data)), ETag: &etag,
+	}, nil
+}
+
+func (s *cursorBlobStore) Put(
+	ctx context.Context, identity string, source io.ReadSeekCloser, opts ...azblob.Option,
+) (*azblob.WriteResponse, error) {
+	if racer := s.racer; racer != nil {
+		s.racer = nil
+		racer(s)
+	}
+	if read := s.read[identity]; s.etags[identity] != read {
+		if read == "" {
+			return nil, fmt.Errorf("%s: %w", identity, storage.ErrExistsOC)
+		}
+		return nil, fmt.Errorf("%s: %w", identity, storage.ErrContentOC)
+	}
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, err
+	}
+	s.setBlob(identity, data)
+	return &azblob.WriteResponse{Size: int64(len(data))}, nil
+}
+
+func (s *cursorBlobStore) setBlob(identity string, data []byte) {
+	s.puts++
+	s.blobs[identity] = data
+	s.etags[identity] = fmt.Sprintf("etag-%d", s.puts)
+}
+
+func TestCursorStores(t *testing.T) {
+	blobStore := newCursorBlobStore()
+	stores := map[string]CursorStore{
+		"file": FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")},
+		"blob": BlobCursorStore{Store: blobStore, StoreWriter: blobStore, BlobPath: "watch/cursor"},
+	}
+	for name, cursors := range stores {
+		t.Run(name, func(t *testing.T) {
+			cursor, err := cursors.LoadCursor(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, "", cursor)
+
+			lastID := watchMakeId(Unix20231215T1344120000)
+			require.NoError(t, cursors.SaveCursor(t.Context(), lastID))
+			cursor, err = cursors.LoadCursor(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, lastID, cursor)
+		})
+	}
+}
+
+func TestBlobCursorStore_SaveCursor(t *testing.T) {
+	blobPath := "watch/cursor"
+	earlier := watchMakeId(Unix20231215T1344120000)
+	later := watchMakeId(Unix20231215T1344120000 + 1)
+
+	t.Run("never lowered", func(t *testing.T) {
+		blobStore := newCursorBlobStore()
+		cursors := BlobCursorStore{Store: blobStore, StoreWriter: blobStore, BlobPath: blobPath}
+		require.NoError(t, cursors.SaveCursor(t.Context(), later))
+		require.NoError(t, cursors.SaveCursor(t.Context(), earlier))
+		assert.Equal(t, 1, blobStore.puts)
+		cursor, err := cursors.LoadCursor(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, later, cursor)
+	})
+
+	t.Run("racing create", func(t *testing.T) {
+		blobStore := newCursorBlobStore()
+		blobStore.racer = func(s *cursorBlobStore) { s.setBlob(blobPath, []byte(later+"\n")) }
+		cursors := BlobCursorStore{Store: blobStore, StoreWriter: blobStore, BlobPath: blobPath}
+		require.NoError(t, cursors.SaveCursor(t.Context(), earlier))
+		cursor, err := cursors.LoadCursor(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, later, cursor)
+	})
+
+	t.Run("racing replace", func(t *testing.T) {
+		latest := watchMakeId(Unix20231215T1344120000 + 2)
+		blobStore := newCursorBlobStore()
+		cursors := BlobCursorStore{Store: blobStore, StoreWriter: blobStore, BlobPath: blobPath}
+		require.NoError(t, cursors.SaveCursor(t.Context(), earlier))
+
+		// the other watcher saves an earlier cursor than ours, which replaces it
+		blobStore.racer = func(s *cursorBlobStore) { s.setBlob(blobPath, []byte(later+"\n")) }
+		require.NoError(t, cursors.SaveCursor(t.Context(), latest))
+		assert.Equal(t, 3, blobStore.puts)
+		cursor, err := cursors.LoadCursor(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, latest, cursor)
+	})
+}
+
+func TestResumeConfig(t *testing.T) {
+	cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+	// nothing saved, the config is unchanged
+	cfg := WatchConfig{Latest: true}
+	require.NoError(t, ResumeConfig(t.Context(), &cfg, cursors, DefaultCursorOverlap))
+	assert.True(t, cfg.Latest)
+	assert.Equal(t, "", cfg.IDSince)
+
+	saved := time.Unix(int64(Unix20231215T1344120000), 0)
+	lastID := massifs.IDTimeHex(saved)
+	require.NoError(t, cursors.SaveCursor(t.Context(), lastID))
+	require.NoError(t, ResumeConfig(t.Context(), &cfg, cursors, DefaultCursorOverlap))
+	assert.False(t, cfg.Latest)
+
+	id, epoch, err := massifs.SplitIDTimestampHex(cfg.IDSince)
+	require.NoError(t, err)
+	since := snowflakeid.IDTime(id, snowflakeid.EpochTimeUTC(epoch))
+	assert.Equal(t, saved.Add(-DefaultCursorOverlap).UnixMilli(), since.UnixMilli())
+	assert.Less(t, cfg.IDSince, lastID)
+
+	require.NoError(t, cursors.SaveCursor(t.Context(), "thisisnothex"))
+	assert.Error(t, ResumeConfig(t.Context(), &cfg, cursors, DefaultCursorOverlap))
+}
+
+func TestWatch_cursor(t *testing.T) {
+	massifPath := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log"
+	sealPath := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifseals/0/0000000000000001.sth"
+	cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 1,
+		Cursor:     cursors,
+	}
+	reader := &mockReader{
+		results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(
+				massifPath, watchMakeId(Unix20231215T1344120000+1),
+				sealPath, watchMakeId(Unix20231215T1344120000+2),
+			)},
+		},
+	}
+	activityC, errC := Watch(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader)
+	activity, errs := drainWatch(t, activityC, errC)
+	assert.Empty(t, errs)
+	require.Len(t, activity, 1)
+
+	cursor, err := cursors.LoadCursor(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, watchMakeId(Unix20231215T1344120000+2), cursor)
+}
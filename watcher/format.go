@@ -0,0 +1,126 @@
+package watcher
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+	"github.com/google/uuid"
+)
+
+// OutputFormat selects the Formatter used for the watch output
+type OutputFormat string
+
+const (
+	FormatJSON   OutputFormat = "json"   // A single indented JSON array, the default
+	FormatNDJSON OutputFormat = "ndjson" // One JSON object per line
+	FormatCSV    OutputFormat = "csv"    // CSV with a header row
+	FormatTable  OutputFormat = "table"  // An aligned table with a header row
+)
+
+// activityColumns are the CSV and table columns, named as the json fields
+var activityColumns = []string{"logid", "massifindex", "idcommitted", "idconfirmed", "lastmodified", "massif", "checkpoint"}
+
+// Formatter writes log activity in a particular format
+type Formatter interface {
+	Format(w io.Writer, activity []watcher.LogActivity) error
+}
+
+// NewFormatter returns the formatter for the output format. The empty format
+// selects FormatJSON.
+func NewFormatter(format OutputFormat) (Formatter, error) {
+	switch OutputFormat(strings.ToLower(string(format))) {
+	case "", FormatJSON:
+		return JSONFormatter{}, nil
+	case FormatNDJSON:
+		return NDJSONFormatter{}, nil
+	case FormatCSV:
+		return CSVFormatter{}, nil
+	case FormatTable:
+		return TableFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// JSONFormatter writes the activity as a single indented JSON array
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(w io.Writer, activity []watcher.LogActivity) error {
+	data, err := json.MarshalIndent(activity, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// NDJSONFormatter writes each activity as a JSON object on its own line
+type NDJSONFormatter struct{}
+
+func (NDJSONFormatter) Format(w io.Writer, activity []watcher.LogActivity) error {
+	encoder := json.NewEncoder(w)
+	for _, a := range activity {
+		if err := encoder.Encode(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CSVFormatter writes the activity as CSV, with a header row
+type CSVFormatter struct{}
+
+func (CSVFormatter) Format(w io.Writer, activity []watcher.LogActivity) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(activityColumns); err != nil {
+		return err
+	}
+	for _, a := range activity {
+		if err := cw.Write(activityRow(a)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// TableFormatter writes the activity as a table, with aligned columns, for
+// reading in a terminal.
+type TableFormatter struct{}
+
+func (TableFormatter) Format(w io.Writer, activity []watcher.LogActivity) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, strings.ToUpper(strings.Join(activityColumns, "\t"))); err != nil {
+		return err
+	}
+	for _, a := range activity {
+		if _, err := fmt.Fprintln(tw, strings.Join(activityRow(a), "\t")); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func activityRow(a watcher.LogActivity) []string {
+	return []string{
+		logIDString(a.LogID), strconv.Itoa(a.Massif), a.IDCommitted, a.IDConfirmed,
+		a.LastModified, a.MassifURL, a.CheckpointURL,
+	}
+}
+
+// logIDString returns the log id in its uuid form, or as hex if it is not a
+// uuid.
+func logIDString(logID storage.LogID) string {
+	if u, err := uuid.FromBytes(logID); err == nil {
+		return u.String()
+	}
+	return hex.EncodeToString(logID)
+}
@@ -0,0 +1,93 @@
+package watcher
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFormatActivity(t *testing.T) []watcher.LogActivity {
+	logID := uuid.MustParse("01947000-3456-780f-bfa9-29881e3bac88")
+	return []watcher.LogActivity{
+		{
+			Massif:        1,
+			LogID:         storage.LogID(logID[:]),
+			IDCommitted:   watchMakeId(Unix20231215T1344120000 + 1),
+			IDConfirmed:   watchMakeId(Unix20231215T1344120000),
+			LastModified:  watchParseIDRFC3339(t, watchMakeId(Unix20231215T1344120000+1)),
+			MassifURL:     "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log",
+			CheckpointURL: "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifseals/0/0000000000000001.sth",
+		},
+		{
+			Massif:      12,
+			LogID:       storage.LogID{1, 2, 3},
+			IDCommitted: watchMakeId(Unix20231215T1344120000 + 2),
+			IDConfirmed: sealIDNotFound,
+			MassifURL:   "v1/mmrs/tenant/010203/massifs/0/0000000000000012.log",
+		},
+	}
+}
+
+func formatActivity(t *testing.T, format OutputFormat, activity []watcher.LogActivity) string {
+	t.Helper()
+	formatter, err := NewFormatter(format)
+	require.NoError(t, err)
+	var out strings.Builder
+	require.NoError(t, formatter.Format(&out, activity))
+	return out.String()
+}
+
+func TestFormatters(t *testing.T) {
+	activity := testFormatActivity(t)
+
+	t.Run("json", func(t *testing.T) {
+		assert.Equal(t, string(marshalActivity(t, activity...)), formatActivity(t, "", activity))
+		assert.Equal(t, string(marshalActivity(t, activity...)), formatActivity(t, FormatJSON, activity))
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		scanner := bufio.NewScanner(strings.NewReader(formatActivity(t, FormatNDJSON, activity)))
+		var got []watcher.LogActivity
+		for scanner.Scan() {
+			var a watcher.LogActivity
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &a))
+			got = append(got, a)
+		}
+		assert.Equal(t, activity, got)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		records, err := csv.NewReader(strings.NewReader(formatActivity(t, FormatCSV, activity))).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		assert.Equal(t, activityColumns, records[0])
+		assert.Equal(t, []string{
+			"01947000-3456-780f-bfa9-29881e3bac88", "1", activity[0].IDCommitted, activity[0].IDConfirmed,
+			activity[0].LastModified, activity[0].MassifURL, activity[0].CheckpointURL,
+		}, records[1])
+		assert.Equal(t, "010203", records[2][0])
+		assert.Equal(t, "", records[2][6])
+	})
+
+	t.Run("table", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(formatActivity(t, FormatTable, activity)), "\n")
+		require.Len(t, lines, 3)
+		assert.True(t, strings.HasPrefix(lines[0], "LOGID "))
+		assert.True(t, strings.HasPrefix(lines[1], "01947000-3456-780f-bfa9-29881e3bac88  1 "))
+		// the columns are aligned
+		col := strings.Index(lines[0], "IDCOMMITTED")
+		assert.Equal(t, col, strings.Index(lines[1], activity[0].IDCommitted))
+		assert.Equal(t, col, strings.Index(lines[2], activity[1].IDCommitted))
+	})
+
+	_, err := NewFormatter("yaml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package watcher
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+)
+
+const (
+	// DefaultLogProbeInterval is how often the watched logs are checked for
+	// objects with a logid tag, so that a log which was written before the
+	// tag was introduced is selected by the tag query once it is written again.
+	DefaultLogProbeInterval = 10 * time.Minute
+)
+
+// logSelector selects the watched logs in the tag query, with a query per log,
+// when WatchConfig.MaxLogQueries allows for them. Otherwise, or if any watched log has no
+// objects with a logid tag, a single query lists every active log and
+// collateActivity filters them on the client. The logs are probed for the tag
+// again every probeInterval.
+//
+// A log which has some objects with a logid tag is assumed to have it on every
+// object written since, so every writer of a watched log must set the tag.
+// Changes to objects written without it are not seen.
+type logSelector struct {
+	logIDs        []string // the hex logid tag values
+	probeInterval time.Duration
+	probed        time.Time // when the logs were last probed, zero if never
+	fallback      bool
+}
+
+// newLogSelector returns nil if the logs should be filtered on the client
+func newLogSelector(cfg WatchConfig) *logSelector {
+	if len(cfg.WatchLogs) == 0 || len(cfg.WatchLogs) > cfg.MaxLogQueries {
+		return nil
+	}
+	s := &logSelector{probeInterval: DefaultLogProbeInterval}
+	for logID, watched := range cfg.WatchLogs {
+		if watched {
+			s.logIDs = append(s.logIDs, hex.EncodeToString([]byte(logID)))
+		}
+	}
+	if len(s.logIDs) == 0 {
+		return nil
+	}
+	sort.Strings(s.logIDs)
+	return s
+}
+
+// filters returns the tag queries for a poll with the lastid tagsFilter. The
+// first call, and the first after each probe interval, checks that each
+// watched log has a logid tag.
+func (s *logSelector) filters(ctx context.Context, reader azblob.Reader, tagsFilter string) ([]string, error) {
+	if s == nil {
+		return []string{tagsFilter}, nil
+	}
+	if s.probed.IsZero() || time.Since(s.probed) >= s.probeInterval {
+		fallback := false
+		for _, logID := range s.logIDs {
+			filtered, err := reader.FilteredList(ctx, logIDFilter(logID), azblob.WithListMaxResults(1))
+			if err != nil {
+				return nil, err
+			}
+			if len(filtered.Items) == 0 {
+				fallback = true
+				break
+			}
+		}
+		s.fallback = fallback
+		s.probed = time.Now()
+	}
+	if s.fallback {
+		return []string{tagsFilter}, nil
+	}
+	filters := make([]string, 0, len(s.logIDs))
+	for _, logID := range s.logIDs {
+		filters = append(filters, fmt.Sprintf(`%s AND %s`, logIDFilter(logID), tagsFilter))
+	}
+	return filters, nil
+}
+
+func logIDFilter(logID string) string {
+	return fmt.Sprintf(`"logid"='%s'`, logID)
+}
+
+// collectLogPages collects the pages for each of the queries made by a poll
+func collectLogPages(
+	ctx context.Context,
+	reader azblob.Reader,
+	collator pageCollator,
+	selector *logSelector,
+	tagsFilter string,
+) error {
+	filters, err := selector.filters(ctx, reader, tagsFilter)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err = CollectPages(ctx, reader, collator, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
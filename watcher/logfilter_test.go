@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	azStorageBlob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tagsReader returns the items listed for each tags filter, and records the
+// filters it was asked for.
+type tagsReader struct {
+	mockReader
+	items   map[string][]*azStorageBlob.FilterBlobItem
+	filters []string
+}
+
+func (r *tagsReader) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	r.filters = append(r.filters, tagsFilter)
+	return &azblob.FilterResponse{Items: r.items[tagsFilter]}, nil
+}
+
+func TestNewLogSelector(t *testing.T) {
+	logs := map[string]bool{}
+	assert.Nil(t, newLogSelector(WatchConfig{}))
+	assert.Nil(t, newLogSelector(WatchConfig{WatchLogs: logs}))
+
+	for i := range 10 {
+		logs[string([]byte{byte(i)})] = true
+	}
+	s := newLogSelector(WatchConfig{WatchLogs: logs, MaxLogQueries: 10})
+	require.NotNil(t, s)
+	assert.Len(t, s.logIDs, 10)
+	assert.Equal(t, "00", s.logIDs[0])
+
+	// filtering by the tag query is opt in
+	assert.Nil(t, newLogSelector(WatchConfig{WatchLogs: logs}))
+	assert.Nil(t, newLogSelector(WatchConfig{WatchLogs: logs, MaxLogQueries: -1}))
+	logs["more"] = true
+	assert.Nil(t, newLogSelector(WatchConfig{WatchLogs: logs, MaxLogQueries: 10}))
+	assert.NotNil(t, newLogSelector(WatchConfig{WatchLogs: logs, MaxLogQueries: 20}))
+}
+
+func TestWatchForChanges_logQueries(t *testing.T) {
+	logA := uuid.MustParse("01947000-3456-780f-bfa9-29881e3bac88")
+	logB := uuid.MustParse("84e0e9e9-d479-4d4e-9e8c-afc19a8fc185")
+	massifA := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log"
+	massifB := "v1/mmrs/tenant/84e0e9e9-d479-4d4e-9e8c-afc19a8fc185/massifs/0/0000000000000002.log"
+	massifOther := "v1/mmrs/tenant/112758ce-a8cb-4924-8df8-fcba1e31f8b0/massifs/0/0000000000000001.log"
+
+	cfg := WatchConfig{
+		IDSince: watchMakeId(Unix20231215T1344120000 - 1),
+		WatchLogs: map[string]bool{
+			string(logA[:]): true,
+			string(logB[:]): true,
+		},
+		MaxLogQueries: 2,
+	}
+	lastIDFilter := fmt.Sprintf(`"lastid">='%s'`, cfg.IDSince)
+	logFilter := func(logID uuid.UUID) string {
+		return fmt.Sprintf(`"logid"='%s'`, hex.EncodeToString(logID[:]))
+	}
+	activeLogIDs := func(reporter *mockReporter) []string {
+		require.Len(t, reporter.outf, 1)
+		var activity []watcher.LogActivity
+		require.NoError(t, json.Unmarshal([]byte(reporter.outf[0]), &activity))
+		var logIDs []string
+		for _, a := range activity {
+			logIDs = append(logIDs, uuid.UUID(a.LogID).String())
+		}
+		return logIDs
+	}
+
+	t.Run("tagged", func(t *testing.T) {
+		reader := &tagsReader{items: map[string][]*azStorageBlob.FilterBlobItem{
+			logFilter(logA):                          newFilterBlobItems(massifA, watchMakeId(Unix20231215T1344120000)),
+			logFilter(logB):                          newFilterBlobItems(massifB, watchMakeId(Unix20231215T1344120000)),
+			logFilter(logA) + " AND " + lastIDFilter: newFilterBlobItems(massifA, watchMakeId(Unix20231215T1344120000+1)),
+			logFilter(logB) + " AND " + lastIDFilter: newFilterBlobItems(massifB, watchMakeId(Unix20231215T1344120000+1)),
+		}}
+		reporter := &mockReporter{}
+		require.NoError(t, WatchForChanges(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader, reporter))
+		assert.Equal(t, []string{logA.String(), logB.String()}, activeLogIDs(reporter))
+		// the query listing every active log is not made
+		assert.NotContains(t, reader.filters, lastIDFilter)
+	})
+
+	t.Run("untagged", func(t *testing.T) {
+		// logB was last written before the logid tag was introduced
+		reader := &tagsReader{items: map[string][]*azStorageBlob.FilterBlobItem{
+			logFilter(logA): newFilterBlobItems(massifA, watchMakeId(Unix20231215T1344120000)),
+			lastIDFilter: newFilterBlobItems(
+				massifA, watchMakeId(Unix20231215T1344120000+1),
+				massifOther, watchMakeId(Unix20231215T1344120000+1),
+				massifB, watchMakeId(Unix20231215T1344120000+1),
+			),
+		}}
+		reporter := &mockReporter{}
+		require.NoError(t, WatchForChanges(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader, reporter))
+		assert.Equal(t, []string{logA.String(), logB.String()}, activeLogIDs(reporter))
+		assert.Equal(t, []string{logFilter(logA), logFilter(logB), lastIDFilter}, reader.filters)
+	})
+}
+
+func TestLogSelector_reprobe(t *testing.T) {
+	logA := uuid.MustParse("01947000-3456-780f-bfa9-29881e3bac88")
+	massifA := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log"
+	lastIDFilter := fmt.Sprintf(`"lastid">='%s'`, watchMakeId(Unix20231215T1344120000))
+	logFilter := fmt.Sprintf(`"logid"='%s'`, hex.EncodeToString(logA[:]))
+
+	s := newLogSelector(WatchConfig{WatchLogs: map[string]bool{string(logA[:]): true}, MaxLogQueries: 1})
+	require.NotNil(t, s)
+
+	// the log has no logid tags yet, so every active log is listed
+	reader := &tagsReader{items: map[string][]*azStorageBlob.FilterBlobItem{}}
+	filters, err := s.filters(t.Context(), reader, lastIDFilter)
+	require.NoError(t, err)
+	assert.Equal(t, []string{lastIDFilter}, filters)
+
+	// the log is written with the tag, but is not probed again until the
+	// interval has passed
+	reader.items[logFilter] = newFilterBlobItems(massifA, watchMakeId(Unix20231215T1344120000))
+	filters, err = s.filters(t.Context(), reader, lastIDFilter)
+	require.NoError(t, err)
+	assert.Equal(t, []string{lastIDFilter}, filters)
+	assert.Equal(t, []string{logFilter}, reader.filters)
+
+	s.probed = time.Now().Add(-DefaultLogProbeInterval)
+	filters, err = s.filters(t.Context(), reader, lastIDFilter)
+	require.NoError(t, err)
+	assert.Equal(t, []string{logFilter + " AND " + lastIDFilter}, filters)
+	assert.Equal(t, []string{logFilter, logFilter}, reader.filters)
+}
@@ -24,6 +24,13 @@ func NewLogTailCollator(
 	}
 }
 
+// Reset forgets the tails collated so far, so that a collator used for many
+// polls holds only the tails found by the current one.
+func (c *LogTailCollator) Reset() {
+	c.Massifs = make(map[string]*watcher.LogTail)
+	c.Seals = make(map[string]*watcher.LogTail)
+}
+
 func collectTags(aztags *azblob.BlobTags) map[string]string {
 	if aztags == nil || len(aztags.BlobTagSet) == 0 {
 		return map[string]string{}
@@ -39,8 +46,27 @@ func collectTags(aztags *azblob.BlobTags) map[string]string {
 }
 
 // collectPageItem is typically used to handle the first item in a page prior to processing the remainder in a loop
+//
+// A collator which is used for several polls sees the same massif again as
+// leaves are added to it, so the last id of the tail is advanced when the
+// path is for the current tail.
 func (c *LogTailCollator) collectPageItem(it *azblob.FilterBlobItem) error {
-	return c.CollatePath(*it.Name, azstorage.GetLastIDHex(collectTags(it.Tags)))
+	lastID := azstorage.GetLastIDHex(collectTags(it.Tags))
+	if err := c.CollatePath(*it.Name, lastID); err != nil {
+		return err
+	}
+	logID := c.Path2LogID(*it.Name)
+	if logID == nil {
+		return nil
+	}
+	otype, _, err := c.Path2ObjectIndex(*it.Name)
+	if err != nil {
+		return err
+	}
+	if lt := c.Tail(logID, otype); lt != nil && lt.Path == *it.Name && lastID > lt.LastID {
+		lt.LastID = lastID
+	}
+	return nil
 }
 
 // CollatePage process a single page of azure blob filter results and collates
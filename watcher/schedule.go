@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+)
+
+const (
+	// DefaultBackoffFactor is used for an adaptive interval when
+	// WatchConfig.BackoffFactor is not set.
+	DefaultBackoffFactor = 2.0
+	// rateLimitFactor is applied, in addition to the backoff factor, when the
+	// store is throttling the watch.
+	rateLimitFactor = 2.0
+)
+
+// pollScheduler chooses the interval before each poll. With a fixed interval,
+// it always returns cfg.Interval. When cfg.MaxInterval is set, the interval
+// adapts to the activity: it returns to the minimum whenever activity is
+// found, grows by the backoff factor after each quiet poll, up to the maximum,
+// and grows faster when the list request was rate limited.
+type pollScheduler struct {
+	min, max time.Duration
+	factor   float64
+	interval time.Duration
+}
+
+func newPollScheduler(cfg WatchConfig) *pollScheduler {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	s := &pollScheduler{min: interval, max: interval, factor: 1, interval: interval}
+	if cfg.MaxInterval <= 0 {
+		return s
+	}
+	s.factor = cfg.BackoffFactor
+	if s.factor <= 1 {
+		s.factor = DefaultBackoffFactor
+	}
+	s.min = time.Duration(float64(interval) / s.factor)
+	if cfg.MinInterval > 0 {
+		s.min = cfg.MinInterval
+	}
+	s.max = max(cfg.MaxInterval, s.min)
+	s.interval = min(max(interval, s.min), s.max)
+	return s
+}
+
+// next returns the interval before the next poll, given whether the last poll
+// found activity and the error, if any, from its list requests.
+func (s *pollScheduler) next(active bool, err error) time.Duration {
+	if wait, ok := blobs.IsRateLimiting(err); ok {
+		s.interval = s.grow(s.factor * rateLimitFactor)
+		// The service may ask for a longer wait than the maximum
+		return max(s.interval, wait)
+	}
+	if active && err == nil {
+		s.interval = s.min
+		return s.interval
+	}
+	s.interval = s.grow(s.factor)
+	return s.interval
+}
+
+func (s *pollScheduler) grow(factor float64) time.Duration {
+	if factor <= 1 {
+		return s.interval
+	}
+	return min(time.Duration(float64(s.interval)*factor), s.max)
+}
+
+// sleepContext waits for d, returning false if the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRateLimitedError(retryAfter string) error {
+	rerr := &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}
+	if retryAfter != "" {
+		rerr.RawResponse = &http.Response{Header: http.Header{"Retry-After": []string{retryAfter}}}
+	}
+	return rerr
+}
+
+func TestPollScheduler(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {
+		s := newPollScheduler(WatchConfig{Interval: 3 * time.Second})
+		assert.Equal(t, 3*time.Second, s.next(false, nil))
+		assert.Equal(t, 3*time.Second, s.next(true, nil))
+		assert.Equal(t, 3*time.Second, s.next(false, newRateLimitedError("")))
+	})
+
+	t.Run("adaptive", func(t *testing.T) {
+		s := newPollScheduler(WatchConfig{
+			Interval: 2 * time.Second, MinInterval: time.Second, MaxInterval: 10 * time.Second, BackoffFactor: 2,
+		})
+		// quiet polls back off up to the ceiling
+		assert.Equal(t, 4*time.Second, s.next(false, nil))
+		assert.Equal(t, 8*time.Second, s.next(false, nil))
+		assert.Equal(t, 10*time.Second, s.next(false, nil))
+		assert.Equal(t, 10*time.Second, s.next(false, nil))
+		// activity returns to the minimum
+		assert.Equal(t, time.Second, s.next(true, nil))
+		assert.Equal(t, time.Second, s.next(true, nil))
+		// other errors are treated as quiet polls
+		assert.Equal(t, 2*time.Second, s.next(false, errors.New("list failed")))
+	})
+
+	t.Run("adaptive defaults", func(t *testing.T) {
+		s := newPollScheduler(WatchConfig{Interval: 2 * time.Second, MaxInterval: 10 * time.Second})
+		assert.Equal(t, 4*time.Second, s.next(false, nil))
+		// the minimum is below the interval
+		assert.Equal(t, time.Second, s.next(true, nil))
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		s := newPollScheduler(WatchConfig{Interval: time.Second, MaxInterval: time.Minute})
+		assert.Equal(t, 2*time.Second, s.next(false, nil))
+		// rate limiting backs off harder than a quiet poll
+		assert.Equal(t, 8*time.Second, s.next(true, newRateLimitedError("")))
+		// and the service may ask for longer than the ceiling
+		assert.Equal(t, 2*time.Minute, s.next(false, newRateLimitedError("120")))
+		assert.Equal(t, time.Minute, s.next(false, nil))
+	})
+}
+
+// throttledReader fails the first list requests as rate limited
+type throttledReader struct {
+	mockReader
+	throttle int
+}
+
+func (r *throttledReader) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	if r.throttle > 0 {
+		r.throttle--
+		return nil, newRateLimitedError("")
+	}
+	return r.mockReader.FilteredList(ctx, tagsFilter, opts...)
+}
+
+func TestWatchForChanges_rateLimited(t *testing.T) {
+	cfg := WatchConfig{
+		IDSince:     watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:    time.Millisecond,
+		MaxInterval: 10 * time.Millisecond,
+		WatchCount:  3,
+	}
+	reader := &throttledReader{
+		throttle: 1,
+		mockReader: mockReader{
+			results: []*azblob.FilterResponse{
+				{Items: newFilterBlobItems(
+					"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+1),
+				)},
+			},
+		},
+	}
+	reporter := &mockReporter{}
+	require.NoError(t, WatchForChanges(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader, reporter))
+	assert.Len(t, reporter.outf, 1)
+
+	// a rate limited poll counts towards WatchCount, the rate limiting error is
+	// returned once they are all used
+	cfg.WatchCount = 2
+	reader = &throttledReader{throttle: 2, mockReader: mockReader{results: reader.results}}
+	reporter = &mockReporter{}
+	err := WatchForChanges(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader, reporter)
+	_, ok := blobs.IsRateLimiting(err)
+	assert.True(t, ok)
+	assert.Empty(t, reporter.outf)
+	assert.Equal(t, 0, reader.throttle)
+
+	// without an interval the rate limiting error is returned
+	cfg.Interval = 0
+	err = WatchForChanges(t.Context(), cfg, newTestWatcherCollator(t, cfg), &throttledReader{throttle: 1}, &mockReporter{})
+	_, ok = blobs.IsRateLimiting(err)
+	assert.True(t, ok)
+}
+
+func TestNextFilter_beyondHorizon(t *testing.T) {
+	w, err := NewWatcher(WatchConfig{Interval: 10 * time.Second, MaxInterval: 2 * time.Minute, Horizon: 30 * time.Second})
+	require.NoError(t, err)
+	w.FirstFilter()
+
+	s := newPollScheduler(w.Cfg)
+	var wait time.Duration
+	for range 4 {
+		wait = s.next(false, nil)
+	}
+	require.Greater(t, wait, w.Cfg.Horizon)
+
+	// the previous poll was further back than the horizon, the filter starts
+	// from it rather than from the horizon
+	polled := time.Now().Add(-wait)
+	w.polled = polled
+	assert.Equal(t, fmt.Sprintf(`"lastid">='%s'`, massifs.IDTimeHex(polled)), w.NextFilter())
+	assert.Equal(t, polled, w.LastSince)
+
+	// polls within the horizon keep the sliding window
+	w.NextFilter()
+	assert.WithinDuration(t, time.Now().Add(-w.Cfg.Horizon), w.LastSince, time.Second)
+}
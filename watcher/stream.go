@@ -0,0 +1,132 @@
+package watcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+)
+
+// tailResetter is implemented by collators which can forget the tails
+// collated by previous polls, as LogTailCollator does.
+type tailResetter interface {
+	Reset()
+}
+
+// activityKey identifies the state of a log tail which has been reported
+type activityKey struct {
+	massif      int
+	idCommitted string
+	idConfirmed string
+}
+
+// Watch polls for log activity, according to the provided config, until the
+// context is done. Each poll reports the logs whose massif or checkpoint tail
+// has changed since it was last reported, so a log with no new activity is
+// not reported again. Errors from a poll are reported on the error channel and
+// polling continues at the next interval.
+//
+// The collator is reset before each poll, if it implements Reset, and only
+// the logs found by the last poll are remembered, so the state kept does not
+// grow with the life of the watch.
+//
+// If cfg.Cursor is set, the highest lastid reported is saved once all of the
+// activity found by a poll has been received. It is not saved after a poll
+// which failed, the pages it did not read may hold logs with lower lastids.
+// Failures to save it are reported on the error channel.
+//
+// The interval between polls adapts to the activity if cfg.MaxInterval is set,
+// see WatchConfig.
+//
+// If cfg.WatchCount is positive, polling stops after that many polls. Both
+// channels are closed when polling stops, and the caller must receive from
+// both until then.
+func Watch(
+	ctx context.Context,
+	cfg WatchConfig,
+	collator collator,
+	reader azblob.Reader,
+) (<-chan watcher.LogActivity, <-chan error) {
+	activityC := make(chan watcher.LogActivity)
+	// Buffered so that a poll which fails is not held up by a caller which is
+	// only receiving activity
+	errC := make(chan error, 1)
+
+	selector := newLogSelector(cfg)
+	schedule := newPollScheduler(cfg)
+
+	go func() {
+		defer close(activityC)
+		defer close(errC)
+
+		reported := map[string]activityKey{}
+		var cursor string
+		tagsFilter := collator.FirstFilter()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for count := 0; cfg.WatchCount <= 0 || count < cfg.WatchCount; count++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			if r, ok := collator.(tailResetter); ok {
+				r.Reset()
+			}
+			err := collectLogPages(ctx, reader, collator, selector, tagsFilter)
+			if err != nil {
+				select {
+				case errC <- err:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				tagsFilter = collator.NextFilter()
+			}
+
+			active := false
+			roundLastID := cursor
+			seen := map[string]bool{}
+			for _, a := range collateActivity(cfg, collator) {
+				seen[string(a.LogID)] = true
+				key := activityKey{massif: a.Massif, idCommitted: a.IDCommitted, idConfirmed: a.IDConfirmed}
+				if prev, ok := reported[string(a.LogID)]; ok && prev == key {
+					continue
+				}
+				select {
+				case activityC <- a:
+					reported[string(a.LogID)] = key
+					active = true
+					roundLastID = max(roundLastID, activityLastID(a))
+				case <-ctx.Done():
+					return
+				}
+			}
+			// A log which the poll did not find has no activity since the
+			// filter, anything it reports later is new.
+			if err == nil {
+				for logID := range reported {
+					if !seen[logID] {
+						delete(reported, logID)
+					}
+				}
+			}
+			if err == nil && cfg.Cursor != nil && roundLastID > cursor {
+				if err := cfg.Cursor.SaveCursor(ctx, roundLastID); err != nil {
+					select {
+					case errC <- err:
+					case <-ctx.Done():
+						return
+					}
+				} else {
+					cursor = roundLastID
+				}
+			}
+			timer.Reset(schedule.next(active, err))
+		}
+	}()
+	return activityC, errC
+}
@@ -0,0 +1,217 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog/massifs/storage"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatcherCollator(t *testing.T, cfg WatchConfig) *watcherCollator {
+	t.Helper()
+	w, err := NewWatcher(cfg)
+	require.NoError(t, err)
+	return &watcherCollator{
+		Watcher: w,
+		LogTailCollator: NewLogTailCollator(
+			func(storagePath string) storage.LogID {
+				return storage.ParsePrefixedLogID("tenant/", storagePath)
+			},
+			storage.ObjectIndexFromPath,
+		),
+	}
+}
+
+// drainWatch receives from both channels until they are closed
+func drainWatch(
+	t *testing.T, activityC <-chan watcher.LogActivity, errC <-chan error,
+) ([]watcher.LogActivity, []error) {
+	t.Helper()
+	var activity []watcher.LogActivity
+	var errs []error
+	for activityC != nil || errC != nil {
+		select {
+		case a, ok := <-activityC:
+			if !ok {
+				activityC = nil
+				continue
+			}
+			activity = append(activity, a)
+		case err, ok := <-errC:
+			if !ok {
+				errC = nil
+				continue
+			}
+			errs = append(errs, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch to finish")
+		}
+	}
+	return activity, errs
+}
+
+func TestWatch(t *testing.T) {
+	massifPath := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log"
+	sealPath := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifseals/0/0000000000000001.sth"
+	otherPath := "v1/mmrs/tenant/112758ce-a8cb-4924-8df8-fcba1e31f8b0/massifs/0/0000000000000000.log"
+
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 4,
+	}
+	reader := &mockReader{
+		results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(
+				massifPath, watchMakeId(Unix20231215T1344120000+1),
+				otherPath, watchMakeId(Unix20231215T1344120000+1),
+			)},
+			// unchanged, nothing is reported
+			{Items: newFilterBlobItems(
+				massifPath, watchMakeId(Unix20231215T1344120000+1),
+			)},
+			// leaves added to the same massif, and a checkpoint
+			{Items: newFilterBlobItems(
+				massifPath, watchMakeId(Unix20231215T1344120000+2),
+				sealPath, watchMakeId(Unix20231215T1344120000+2),
+			)},
+		},
+	}
+
+	activityC, errC := Watch(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader)
+	activity, errs := drainWatch(t, activityC, errC)
+	assert.Empty(t, errs)
+	require.Len(t, activity, 3)
+
+	assert.Equal(t, 1, activity[0].Massif)
+	assert.Equal(t, watchMakeId(Unix20231215T1344120000+1), activity[0].IDCommitted)
+	assert.Equal(t, sealIDNotFound, activity[0].IDConfirmed)
+	assert.Equal(t, 0, activity[1].Massif)
+
+	assert.Equal(t, activity[0].LogID, activity[2].LogID)
+	assert.Equal(t, watchMakeId(Unix20231215T1344120000+2), activity[2].IDCommitted)
+	assert.Equal(t, watchMakeId(Unix20231215T1344120000+2), activity[2].IDConfirmed)
+	assert.Equal(t, sealPath, activity[2].CheckpointURL)
+}
+
+type errReader struct {
+	mockReader
+	err error
+}
+
+func (r *errReader) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	return nil, r.err
+}
+
+func TestWatch_errors(t *testing.T) {
+	cfg := WatchConfig{Latest: true, Interval: time.Millisecond, WatchCount: 2}
+	errList := errors.New("list failed")
+
+	activityC, errC := Watch(t.Context(), cfg, newTestWatcherCollator(t, cfg), &errReader{err: errList})
+	activity, errs := drainWatch(t, activityC, errC)
+	assert.Empty(t, activity)
+	require.Len(t, errs, 2)
+	assert.ErrorIs(t, errs[0], errList)
+}
+
+// pageErrReader fails the list request for the page after the given number
+type pageErrReader struct {
+	mockReader
+	pages int
+	err   error
+}
+
+func (r *pageErrReader) FilteredList(ctx context.Context, tagsFilter string, opts ...azblob.Option) (*azblob.FilterResponse, error) {
+	if r.resultIndex >= r.pages {
+		return nil, r.err
+	}
+	return r.mockReader.FilteredList(ctx, tagsFilter, opts...)
+}
+
+func TestWatch_cursorFailedPage(t *testing.T) {
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 1,
+		Cursor:     FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")},
+	}
+	errList := errors.New("list failed")
+	marker := "page2"
+	// the first page is read, the second fails
+	reader := &pageErrReader{
+		pages: 1,
+		err:   errList,
+		mockReader: mockReader{
+			pageTokens: []azblob.ListMarker{&marker},
+			results: []*azblob.FilterResponse{
+				{Items: newFilterBlobItems(
+					"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+2),
+				)},
+			},
+		},
+	}
+
+	activityC, errC := Watch(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader)
+	activity, errs := drainWatch(t, activityC, errC)
+	require.Len(t, activity, 1)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], errList)
+
+	cursor, err := cfg.Cursor.LoadCursor(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "", cursor)
+}
+
+func TestWatch_cancel(t *testing.T) {
+	cfg := WatchConfig{Latest: true, Interval: time.Hour}
+	ctx, cancel := context.WithCancel(t.Context())
+
+	activityC, errC := Watch(ctx, cfg, newTestWatcherCollator(t, cfg), &mockReader{})
+	cancel()
+	activity, errs := drainWatch(t, activityC, errC)
+	assert.Empty(t, activity)
+	assert.Empty(t, errs)
+}
+
+func TestWatch_state(t *testing.T) {
+	massifPath := "v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log"
+	otherPath := "v1/mmrs/tenant/112758ce-a8cb-4924-8df8-fcba1e31f8b0/massifs/0/0000000000000000.log"
+
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 3,
+	}
+	// the first poll fails, the caller receives only the activity until it
+	// is found
+	reader := &throttledReader{
+		throttle: 1,
+		mockReader: mockReader{results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(massifPath, watchMakeId(Unix20231215T1344120000+1))},
+			{Items: newFilterBlobItems(otherPath, watchMakeId(Unix20231215T1344120000+1))},
+		}},
+	}
+	collator := newTestWatcherCollator(t, cfg)
+	activityC, errC := Watch(t.Context(), cfg, collator, reader)
+	select {
+	case a := <-activityC:
+		assert.Equal(t, 1, a.Massif)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed poll blocked the watch")
+	}
+	activity, errs := drainWatch(t, activityC, errC)
+	require.Len(t, activity, 1)
+	assert.Equal(t, 0, activity[0].Massif)
+	require.Len(t, errs, 1)
+
+	// only the tails found by the last poll are kept
+	assert.Len(t, collator.Massifs, 1)
+	assert.Contains(t, collator.Massifs, string(storage.ParsePrefixedLogID("tenant/", otherPath)))
+}
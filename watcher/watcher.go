@@ -7,13 +7,14 @@ package watcher
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	azstorageblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
 	"github.com/forestrie/go-merklelog/massifs"
 	"github.com/forestrie/go-merklelog/massifs/snowflakeid"
 	"github.com/forestrie/go-merklelog/massifs/storage"
@@ -44,6 +45,32 @@ type WatchConfig struct {
 	ObjectPrefixURL string          // URL
 	LastSince       *time.Time
 	LastIDSince     string
+
+	// Format selects how WatchForChanges outputs the activity, the default is
+	// FormatJSON.
+	Format OutputFormat
+
+	// Cursor, if set, is saved with the highest lastid reported. Use
+	// ResumeConfig to resume a watch from it. A watch feeding a WebhookSink
+	// uses WebhookSink.PollCursor.
+	Cursor CursorStore
+
+	// MaxInterval, if set, makes the polling interval adaptive. It starts at
+	// Interval, drops to MinInterval while activity is found, and is multiplied
+	// by BackoffFactor after each quiet poll up to MaxInterval. It grows faster
+	// when the store is rate limiting the list requests. BackoffFactor
+	// defaults to DefaultBackoffFactor and MinInterval to Interval divided by
+	// the BackoffFactor.
+	MinInterval   time.Duration
+	MaxInterval   time.Duration
+	BackoffFactor float64
+
+	// MaxLogQueries, if set, is the most WatchLogs which are selected by the
+	// tag query, with a query for each log, rather than on the client. By
+	// default the logs are always filtered on the client. Every writer of the
+	// watched logs must set the logid tag for them to be selected by the tag
+	// query, changes written without it are missed.
+	MaxLogQueries int
 }
 
 type Watcher struct {
@@ -51,6 +78,10 @@ type Watcher struct {
 	// these are just for reporting for now
 	LastSince   time.Time
 	LastIDSince string
+
+	// polled is when the previous filter was made, the next filter does not
+	// start after it so that polls further apart than the Horizon miss nothing.
+	polled time.Time
 }
 
 func (w *Watcher) FirstFilter() string {
@@ -60,6 +91,7 @@ func (w *Watcher) FirstFilter() string {
 	}
 	w.LastSince = w.Cfg.Since
 	w.LastIDSince = w.Cfg.IDSince
+	w.polled = time.Now()
 	return fmt.Sprintf(`"lastid">='%s'`, w.Cfg.IDSince)
 }
 
@@ -71,7 +103,12 @@ func (w *Watcher) NextFilter() string {
 	if w.Cfg.Horizon == 0 {
 		return w.FirstFilter()
 	}
-	w.LastSince = time.Now().Add(-w.Cfg.Horizon)
+	now := time.Now()
+	w.LastSince = now.Add(-w.Cfg.Horizon)
+	if !w.polled.IsZero() && w.polled.Before(w.LastSince) {
+		w.LastSince = w.polled
+	}
+	w.polled = now
 	w.LastIDSince = massifs.IDTimeHex(w.LastSince)
 	return fmt.Sprintf(`"lastid">='%s'`, w.LastIDSince)
 }
@@ -108,56 +145,43 @@ func WatchForChanges(
 	reader azblob.Reader, reporter watchReporter,
 ) error {
 
+	formatter, err := NewFormatter(cfg.Format)
+	if err != nil {
+		return err
+	}
+
 	tagsFilter := collator.FirstFilter()
+	selector := newLogSelector(cfg)
+	schedule := newPollScheduler(cfg)
 
 	count := cfg.WatchCount
 
 	for {
 
 		// For each count, collate all the pages
-		err := CollectPages(ctx, reader, collator, tagsFilter)
+		err := collectLogPages(ctx, reader, collator, selector, tagsFilter)
+		if _, ok := blobs.IsRateLimiting(err); ok && cfg.Interval != 0 && count > 1 {
+			// retry the same filter once the throttling has eased. The poll
+			// counts towards WatchCount, as it does for Watch, so that a
+			// store which keeps throttling does not hold the watch forever.
+			count--
+			if !sleepContext(ctx, schedule.next(false, err)) {
+				return ctx.Err()
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
-		var activity []watcher.LogActivity
-
-		tails := collator.SortedTails(storage.ObjectMassifData)
-		for _, lt := range tails {
-			if cfg.WatchLogs != nil && !cfg.WatchLogs[string(lt.LogID)] {
-				continue
-			}
-
-			sealLastID := sealIDNotFound
-			seal := collator.Tail(lt.LogID, storage.ObjectCheckpoint)
-			if seal != nil {
-				sealLastID = seal.LastID
-			}
-
-			// This is console mode output
-
-			a := watcher.LogActivity{
-				LogID:       lt.LogID,
-				Massif:      int(lt.Number),
-				IDCommitted: lt.LastID, IDConfirmed: sealLastID,
-				LastModified: LastActivityRFC3339(lt.LastID, sealLastID),
-				MassifURL:    fmt.Sprintf("%s%s", cfg.ObjectPrefixURL, lt.Path),
-			}
-
-			if sealLastID != sealIDNotFound {
-				a.CheckpointURL = fmt.Sprintf("%s%s", cfg.ObjectPrefixURL, seal.Path)
-			}
-
-			activity = append(activity, a)
-		}
-
+		activity := collateActivity(cfg, collator)
 		if activity != nil {
 
 			if cfg.LastSince != nil && cfg.LastIDSince != "" {
 
 				reporter.Logf(
 					"%d active logs since %v (%s).",
-					len(tails),
+					len(collator.SortedTails(storage.ObjectMassifData)),
 					cfg.LastSince.Format(time.RFC3339),
 					cfg.LastIDSince,
 				)
@@ -169,11 +193,17 @@ func WatchForChanges(
 				)
 			}
 
-			marshaledJson, err := json.MarshalIndent(activity, "", "  ")
-			if err != nil {
+			var out strings.Builder
+			if err = formatter.Format(&out, activity); err != nil {
 				return err
 			}
-			reporter.Outf(string(marshaledJson))
+			reporter.Outf("%s", out.String())
+
+			if cfg.Cursor != nil {
+				if err = cfg.Cursor.SaveCursor(ctx, activityLastID(activity...)); err != nil {
+					return err
+				}
+			}
 
 			// Terminate immediately once we have results
 			return nil
@@ -188,8 +218,44 @@ func WatchForChanges(
 		count--
 
 		tagsFilter = collator.NextFilter()
-		time.Sleep(cfg.Interval)
+		if !sleepContext(ctx, schedule.next(false, nil)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// collateActivity returns the activity for the watched logs, in log id order,
+// from the tails collated so far.
+func collateActivity(cfg WatchConfig, collator collator) []watcher.LogActivity {
+	var activity []watcher.LogActivity
+
+	tails := collator.SortedTails(storage.ObjectMassifData)
+	for _, lt := range tails {
+		if cfg.WatchLogs != nil && !cfg.WatchLogs[string(lt.LogID)] {
+			continue
+		}
+
+		sealLastID := sealIDNotFound
+		seal := collator.Tail(lt.LogID, storage.ObjectCheckpoint)
+		if seal != nil {
+			sealLastID = seal.LastID
+		}
+
+		a := watcher.LogActivity{
+			LogID:       lt.LogID,
+			Massif:      int(lt.Number),
+			IDCommitted: lt.LastID, IDConfirmed: sealLastID,
+			LastModified: LastActivityRFC3339(lt.LastID, sealLastID),
+			MassifURL:    fmt.Sprintf("%s%s", cfg.ObjectPrefixURL, lt.Path),
+		}
+
+		if sealLastID != sealIDNotFound {
+			a.CheckpointURL = fmt.Sprintf("%s%s", cfg.ObjectPrefixURL, seal.Path)
+		}
+
+		activity = append(activity, a)
 	}
+	return activity
 }
 
 func ConfigDefaults(cfg *WatchConfig) error {
@@ -0,0 +1,294 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+	// prefixed with "sha256=", when the sink is configured with a secret.
+	WebhookSignatureHeader = "X-Merklelog-Signature-256"
+
+	DefaultWebhookMaxBatch  = 100
+	DefaultWebhookBatchWait = 50 * time.Millisecond
+	DefaultWebhookTimeout   = 30 * time.Second
+)
+
+var ErrWebhookDelivery = errors.New("webhook delivery failed")
+
+// WebhookOptions configure a WebhookSink
+type WebhookOptions struct {
+	URL string
+	// Client defaults to a client with a DefaultWebhookTimeout request timeout
+	Client *http.Client
+	// Secret, if set, is the key used to sign each request body
+	Secret []byte
+	// Retry configures the backoff between delivery attempts. Requests which
+	// fail with a transport error, 408, 429 or a 5xx status are retried.
+	Retry blobs.RetryOptions
+	// Cursor, if set, is saved with the highest lastid delivered once all of
+	// the activity found by a poll has been accepted by the endpoint. Run
+	// learns where each poll ends from the watch, which must be configured
+	// with PollCursor as its WatchConfig.Cursor, otherwise it is not saved.
+	Cursor CursorStore
+
+	MaxBatch  int           // The most activity sent in a single request
+	BatchWait time.Duration // How long to wait for a batch to fill
+}
+
+// WebhookSink POSTs batches of log activity, as a JSON array, to an HTTP
+// endpoint.
+//
+// Delivery is at-least-once: the cursor is saved only after the endpoint has
+// accepted the activity, so a watch resumed from the cursor reports again
+// anything which was not delivered. Receivers should expect duplicates.
+type WebhookSink struct {
+	opts   WebhookOptions
+	cursor string
+
+	polls   chan pollEnd
+	stopped chan struct{}
+}
+
+// pollEnd marks the end of the activity found by a poll, done receives the
+// result of saving the cursor.
+type pollEnd struct {
+	lastID string
+	done   chan error
+}
+
+func NewWebhookSink(opts WebhookOptions) (*WebhookSink, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("a webhook url is required")
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	if opts.Retry.MaxAttempts <= 0 {
+		opts.Retry.MaxAttempts = blobs.DefaultRetryMaxAttempts
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = DefaultWebhookMaxBatch
+	}
+	if opts.BatchWait <= 0 {
+		opts.BatchWait = DefaultWebhookBatchWait
+	}
+	return &WebhookSink{opts: opts, polls: make(chan pollEnd), stopped: make(chan struct{})}, nil
+}
+
+// PollCursor returns the CursorStore to configure as the WatchConfig.Cursor
+// of the watch feeding Run. Watch saves its cursor once all of the activity
+// found by a poll has been received, so Run delivers what it holds and then
+// saves WebhookOptions.Cursor. A poll split across several batches is saved
+// only once all of them have been delivered.
+func (s *WebhookSink) PollCursor() CursorStore {
+	return webhookPollCursor{s: s}
+}
+
+type webhookPollCursor struct {
+	s *WebhookSink
+}
+
+func (c webhookPollCursor) LoadCursor(ctx context.Context) (string, error) {
+	if c.s.opts.Cursor == nil {
+		return "", nil
+	}
+	return c.s.opts.Cursor.LoadCursor(ctx)
+}
+
+// SaveCursor waits for Run to deliver the activity it has received.
+func (c webhookPollCursor) SaveCursor(ctx context.Context, lastID string) error {
+	end := pollEnd{lastID: lastID, done: make(chan error, 1)}
+	select {
+	case c.s.polls <- end:
+	case <-c.s.stopped:
+		return fmt.Errorf("%w: the sink has stopped", ErrWebhookDelivery)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-end.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run delivers the activity received from activityC, typically the channel
+// returned by Watch, in batches. It returns nil when the channel is closed,
+// or the error for the first batch which could not be delivered. On error it
+// calls cancel, if set, which should stop the watch sending to activityC.
+// Run must only be called once for a sink.
+func (s *WebhookSink) Run(
+	ctx context.Context, activityC <-chan watcher.LogActivity, cancel context.CancelFunc,
+) error {
+	defer close(s.stopped)
+
+	err := s.run(ctx, activityC)
+	if err != nil && cancel != nil {
+		cancel()
+	}
+	return err
+}
+
+func (s *WebhookSink) run(ctx context.Context, activityC <-chan watcher.LogActivity) error {
+	for {
+		var batch []watcher.LogActivity
+		select {
+		case a, ok := <-activityC:
+			if !ok {
+				return nil
+			}
+			batch = append(batch, a)
+		case end := <-s.polls:
+			end.done <- s.saveCursor(ctx, end.lastID)
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		closed := false
+		var end *pollEnd
+		timer := time.NewTimer(s.opts.BatchWait)
+	fill:
+		for len(batch) < s.opts.MaxBatch {
+			select {
+			case a, ok := <-activityC:
+				if !ok {
+					closed = true
+					break fill
+				}
+				batch = append(batch, a)
+			case e := <-s.polls:
+				end = &e
+				break fill
+			case <-timer.C:
+				break fill
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		timer.Stop()
+
+		if err := s.Deliver(ctx, batch); err != nil {
+			if end != nil {
+				end.done <- err
+			}
+			return err
+		}
+		if end != nil {
+			end.done <- s.saveCursor(ctx, end.lastID)
+		}
+		if closed {
+			return nil
+		}
+	}
+}
+
+// saveCursor saves the cursor, if one is configured and lastID is beyond the
+// last saved.
+func (s *WebhookSink) saveCursor(ctx context.Context, lastID string) error {
+	if s.opts.Cursor == nil || lastID <= s.cursor {
+		return nil
+	}
+	if err := s.opts.Cursor.SaveCursor(ctx, lastID); err != nil {
+		return err
+	}
+	s.cursor = lastID
+	return nil
+}
+
+// Deliver POSTs the batch, retrying transient failures. It does not save the
+// cursor, a batch may hold only part of the activity found by a poll.
+func (s *WebhookSink) Deliver(ctx context.Context, batch []watcher.LogActivity) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		var wait time.Duration
+		wait, err = s.post(ctx, body)
+		if err == nil {
+			break
+		}
+		if wait < 0 || attempt >= s.opts.Retry.MaxAttempts {
+			return err
+		}
+		if wait == 0 {
+			wait = s.opts.Retry.Backoff(attempt)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// post makes a single delivery attempt. On failure it returns the wait
+// requested by the endpoint, zero for the default backoff, or -1 if the
+// request should not be retried.
+func (s *WebhookSink) post(ctx context.Context, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.opts.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(s.opts.Secret, body))
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, fmt.Errorf("%w: %v", ErrWebhookDelivery, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%w: %s", ErrWebhookDelivery, resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		if seconds, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, err
+		}
+		return 0, err
+	default:
+		return -1, err
+	}
+}
+
+// WebhookSignature returns the hex HMAC-SHA256 of the body, as sent in the
+// WebhookSignatureHeader. Receivers may use it to check the signature.
+func WebhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
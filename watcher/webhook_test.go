@@ -0,0 +1,261 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datatrails/go-datatrails-common/azblob"
+	"github.com/forestrie/go-merklelog-azure/blobs"
+	"github.com/forestrie/go-merklelog/massifs/watcher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookServer records the batches it accepts, and fails the first requests
+// with the given statuses.
+type webhookServer struct {
+	mu       sync.Mutex
+	fail     []int
+	attempts int
+	batches  [][]watcher.LogActivity
+	sigs     []string
+	bodies   [][]byte
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if len(s.fail) > 0 {
+		status := s.fail[0]
+		s.fail = s.fail[1:]
+		w.WriteHeader(status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var batch []watcher.LogActivity
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.batches = append(s.batches, batch)
+	s.sigs = append(s.sigs, r.Header.Get(WebhookSignatureHeader))
+	s.bodies = append(s.bodies, body)
+}
+
+func testWebhookActivity(lastIDs ...string) []watcher.LogActivity {
+	var activity []watcher.LogActivity
+	for i, lastID := range lastIDs {
+		activity = append(activity, watcher.LogActivity{
+			Massif: i, LogID: []byte{byte(i)}, IDCommitted: lastID, IDConfirmed: sealIDNotFound,
+		})
+	}
+	return activity
+}
+
+func TestWebhookSink_Deliver(t *testing.T) {
+	secret := []byte("secret")
+	fastRetry := blobs.RetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	t.Run("retried and signed", func(t *testing.T) {
+		server := &webhookServer{fail: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+		sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Secret: secret, Retry: fastRetry, Cursor: cursors})
+		require.NoError(t, err)
+		activity := testWebhookActivity(watchMakeId(Unix20231215T1344120000), watchMakeId(Unix20231215T1344120000+1))
+		require.NoError(t, sink.Deliver(t.Context(), activity))
+
+		assert.Equal(t, 3, server.attempts)
+		require.Len(t, server.batches, 1)
+		assert.Equal(t, activity, server.batches[0])
+		assert.Equal(t, "sha256="+WebhookSignature(secret, server.bodies[0]), server.sigs[0])
+
+		// a batch may be part of a poll, the cursor is saved by Run
+		cursor, err := cursors.LoadCursor(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, "", cursor)
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		server := &webhookServer{fail: []int{500, 500, 500}}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+		cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+		sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Retry: fastRetry, Cursor: cursors})
+		require.NoError(t, err)
+		err = sink.Deliver(t.Context(), testWebhookActivity(watchMakeId(Unix20231215T1344120000)))
+		assert.ErrorIs(t, err, ErrWebhookDelivery)
+		assert.Equal(t, 3, server.attempts)
+
+		// not delivered, so the cursor is not advanced
+		cursor, err := cursors.LoadCursor(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, "", cursor)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		server := &webhookServer{fail: []int{http.StatusBadRequest}}
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Retry: fastRetry})
+		require.NoError(t, err)
+		err = sink.Deliver(t.Context(), testWebhookActivity(watchMakeId(Unix20231215T1344120000)))
+		assert.ErrorIs(t, err, ErrWebhookDelivery)
+		assert.Equal(t, 1, server.attempts)
+	})
+}
+
+func TestWebhookSink_Run(t *testing.T) {
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 2,
+	}
+	reader := &mockReader{
+		results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(
+				"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+1),
+				"v1/mmrs/tenant/112758ce-a8cb-4924-8df8-fcba1e31f8b0/massifs/0/0000000000000000.log", watchMakeId(Unix20231215T1344120000+2),
+			)},
+		},
+	}
+	sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Cursor: cursors, BatchWait: time.Second})
+	require.NoError(t, err)
+	cfg.Cursor = sink.PollCursor()
+
+	activityC, errC := Watch(t.Context(), cfg, newTestWatcherCollator(t, cfg), reader)
+	go func() {
+		for range errC {
+		}
+	}()
+	require.NoError(t, sink.Run(t.Context(), activityC, nil))
+
+	require.Len(t, server.batches, 1)
+	assert.Len(t, server.batches[0], 2)
+	cursor, err := cursors.LoadCursor(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, watchMakeId(Unix20231215T1344120000+2), cursor)
+}
+
+func TestWebhookSink_Run_pollSplit(t *testing.T) {
+	// The second batch of the poll is rejected, so the cursor is not saved
+	// past the log it holds, even though its lastid is lower than those
+	// delivered in the first batch.
+	server := &webhookServer{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		n := len(server.batches)
+		server.mu.Unlock()
+		if n > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+	cfg := WatchConfig{
+		IDSince:    watchMakeId(Unix20231215T1344120000 - 1),
+		Interval:   time.Millisecond,
+		WatchCount: 1,
+	}
+	reader := &mockReader{
+		results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(
+				"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+3),
+				"v1/mmrs/tenant/112758ce-a8cb-4924-8df8-fcba1e31f8b0/massifs/0/0000000000000000.log", watchMakeId(Unix20231215T1344120000+1),
+			)},
+		},
+	}
+	sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Cursor: cursors, MaxBatch: 1, BatchWait: time.Second})
+	require.NoError(t, err)
+	cfg.Cursor = sink.PollCursor()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	activityC, errC := Watch(ctx, cfg, newTestWatcherCollator(t, cfg), reader)
+	go func() {
+		for range errC {
+		}
+	}()
+	err = sink.Run(ctx, activityC, cancel)
+	assert.ErrorIs(t, err, ErrWebhookDelivery)
+	for range activityC {
+	}
+
+	require.Len(t, server.batches, 1)
+	cursor, err := cursors.LoadCursor(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "", cursor)
+}
+
+func TestWebhookSink_Run_failing(t *testing.T) {
+	// The endpoint never accepts a batch, Run stops the watch rather than
+	// leaving it blocked sending the activity of the next poll.
+	server := &webhookServer{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.attempts++
+		server.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	cursors := FileCursorStore{Path: filepath.Join(t.TempDir(), "cursor")}
+
+	// no WatchCount, the watch only stops when it is cancelled
+	cfg := WatchConfig{
+		IDSince:  watchMakeId(Unix20231215T1344120000 - 1),
+		Interval: time.Millisecond,
+	}
+	reader := &mockReader{
+		results: []*azblob.FilterResponse{
+			{Items: newFilterBlobItems(
+				"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+1),
+			)},
+			{Items: newFilterBlobItems(
+				"v1/mmrs/tenant/01947000-3456-780f-bfa9-29881e3bac88/massifs/0/0000000000000001.log", watchMakeId(Unix20231215T1344120000+2),
+			)},
+		},
+	}
+	retry := blobs.RetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	sink, err := NewWebhookSink(WebhookOptions{URL: ts.URL, Retry: retry, Cursor: cursors, BatchWait: time.Millisecond})
+	require.NoError(t, err)
+	cfg.Cursor = sink.PollCursor()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	activityC, errC := Watch(ctx, cfg, newTestWatcherCollator(t, cfg), reader)
+	err = sink.Run(ctx, activityC, cancel)
+	assert.ErrorIs(t, err, ErrWebhookDelivery)
+
+	// both channels close once the watch has stopped
+	drainWatch(t, activityC, errC)
+	assert.Equal(t, retry.MaxAttempts, server.attempts)
+	cursor, err := cursors.LoadCursor(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "", cursor)
+}
+
+func TestNewWebhookSink_timeout(t *testing.T) {
+	sink, err := NewWebhookSink(WebhookOptions{URL: "http://localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultWebhookTimeout, sink.opts.Client.Timeout)
+}